@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+
+	"gemini-watermark-remover/watermark"
+)
+
+// runCalibrate implements the calibrate subcommand: it fits a watermark
+// profile to captures of the watermark over known backgrounds and writes it
+// as a bundle that --profiles can load.
+func runCalibrate(args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+
+	var (
+		name      string
+		margin    int
+		minWidth  int
+		minHeight int
+		outDir    string
+		captures  stringList
+	)
+	fs.StringVar(&name, "name", "", "Name of the profile (required)")
+	fs.IntVar(&margin, "margin", 32, "Distance of the watermark from the bottom and right image edges in pixels")
+	fs.IntVar(&minWidth, "min-width", 0, "Expect the watermark on images wider than this")
+	fs.IntVar(&minHeight, "min-height", 0, "Expect the watermark on images taller than this")
+	fs.StringVar(&outDir, "out", ".", "Directory to write the profile bundle to")
+	fs.Var(&captures, "capture", "Capture as BACKGROUND=FILE, e.g. black=black.png or #808080=gray.png (repeatable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s calibrate [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Fits a watermark profile to captures of the watermark over known uniform\n")
+		fmt.Fprintf(os.Stderr, "backgrounds. Each capture must be cropped to the watermark square.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s calibrate --name variant-64 --margin 40 \\\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "      --capture black=black.png --capture white=white.png --out ./profiles\n")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("calibrate: --name is required")
+	}
+	if len(captures) < 2 {
+		return errors.New("calibrate: at least two --capture values over different backgrounds are required")
+	}
+
+	var inputs []watermark.Capture
+	for _, spec := range captures {
+		capture, err := loadCapture(spec)
+		if err != nil {
+			return fmt.Errorf("calibrate: %w", err)
+		}
+		inputs = append(inputs, capture)
+	}
+
+	rule := watermark.SelectionRule{MinWidth: minWidth, MinHeight: minHeight}
+	calibration, err := watermark.Calibrate(name, inputs, margin, rule)
+	if err != nil {
+		return fmt.Errorf("calibrate: %w", err)
+	}
+
+	path, err := watermark.SaveProfile(calibration.Profile, outDir)
+	if err != nil {
+		return fmt.Errorf("calibrate: %w", err)
+	}
+
+	profile := calibration.Profile
+	fmt.Printf("Calibrated profile %s from %d capture(s): %s\n", profile.Name, len(inputs), profile.Config())
+	fmt.Printf("  Logo color: (%.1f, %.1f, %.1f)\n", profile.LogoColor[0], profile.LogoColor[1], profile.LogoColor[2])
+	fmt.Printf("  Fit error: rms %.3f, max %.3f (8-bit levels)\n", calibration.RMSError, calibration.MaxError)
+	fmt.Printf("  Saved to %s\n", path)
+	return nil
+}
+
+// loadCapture parses a BACKGROUND=FILE capture specification and decodes
+// the image.
+func loadCapture(spec string) (watermark.Capture, error) {
+	colorSpec, path, ok := strings.Cut(spec, "=")
+	if !ok || path == "" {
+		return watermark.Capture{}, fmt.Errorf("invalid capture %q, expected BACKGROUND=FILE", spec)
+	}
+
+	background, err := parseBackground(colorSpec)
+	if err != nil {
+		return watermark.Capture{}, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return watermark.Capture{}, fmt.Errorf("failed to open capture: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return watermark.Capture{}, fmt.Errorf("failed to decode capture %s: %w", path, err)
+	}
+	return watermark.Capture{Image: img, Background: background}, nil
+}
+
+// parseBackground parses a background color given as "black", "white",
+// "#RRGGBB" or "R,G,B" (decimal 0-255).
+func parseBackground(spec string) ([3]float64, error) {
+	switch strings.ToLower(spec) {
+	case "black":
+		return [3]float64{0, 0, 0}, nil
+	case "white":
+		return [3]float64{255, 255, 255}, nil
+	}
+
+	var background [3]float64
+	if hex, ok := strings.CutPrefix(spec, "#"); ok {
+		value, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return background, fmt.Errorf("invalid background color %q, expected #RRGGBB", spec)
+		}
+		background = [3]float64{float64(value >> 16), float64(value >> 8 & 0xff), float64(value & 0xff)}
+		return background, nil
+	}
+
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return background, fmt.Errorf("invalid background color %q, expected black, white, #RRGGBB or R,G,B", spec)
+	}
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 0 || value > 255 {
+			return background, fmt.Errorf("invalid background color %q, channels must be 0-255", spec)
+		}
+		background[i] = float64(value)
+	}
+	return background, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gemini-watermark-remover/watermark"
+)
+
+func TestParseBackground(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected [3]float64
+		valid    bool
+	}{
+		{"black", [3]float64{0, 0, 0}, true},
+		{"White", [3]float64{255, 255, 255}, true},
+		{"#808080", [3]float64{128, 128, 128}, true},
+		{"#ff8000", [3]float64{255, 128, 0}, true},
+		{"10, 20, 30", [3]float64{10, 20, 30}, true},
+		{"#8080", [3]float64{}, false},
+		{"#gggggg", [3]float64{}, false},
+		{"1,2", [3]float64{}, false},
+		{"0,0,256", [3]float64{}, false},
+		{"gray", [3]float64{}, false},
+	}
+
+	for _, tc := range testCases {
+		result, err := parseBackground(tc.input)
+		if tc.valid && (err != nil || result != tc.expected) {
+			t.Errorf("parseBackground(%q) = %v, %v, expected %v", tc.input, result, err, tc.expected)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("parseBackground(%q) expected error, got %v", tc.input, result)
+		}
+	}
+}
+
+func TestRunCalibrate(t *testing.T) {
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	truth, _ := engine.Profile(watermark.ProfileGemini48)
+
+	dir := t.TempDir()
+	write := func(name string, background uint8) string {
+		img := image.NewRGBA(image.Rect(0, 0, truth.Size, truth.Size))
+		for i, alpha := range truth.AlphaMap {
+			v := uint8(float64(alpha)*watermark.LogoValue + (1-float64(alpha))*float64(background) + 0.5)
+			img.SetRGBA(i%truth.Size, i/truth.Size, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to create capture: %v", err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, img); err != nil {
+			t.Fatalf("Failed to encode capture: %v", err)
+		}
+		return path
+	}
+	black := write("black.png", 0)
+	white := write("white.png", 255)
+
+	err = runCalibrate([]string{
+		"--name", "recalibrated", "--margin", "32", "--out", dir,
+		"--capture", "black=" + black, "--capture", "white=" + white,
+	})
+	if err != nil {
+		t.Fatalf("runCalibrate() error: %v", err)
+	}
+
+	profile, err := watermark.LoadProfile(filepath.Join(dir, "recalibrated.json"))
+	if err != nil {
+		t.Fatalf("LoadProfile() error: %v", err)
+	}
+	for c, v := range profile.LogoColor {
+		if math.Abs(v-watermark.LogoValue) > 2 {
+			t.Errorf("logo channel %d: expected ~255, got %.1f", c, v)
+		}
+	}
+
+	// Missing arguments are reported before any work is done
+	if err := runCalibrate([]string{"--capture", "black=" + black, "--capture", "white=" + white}); err == nil {
+		t.Error("expected error without --name")
+	}
+	if err := runCalibrate([]string{"--name", "x", "--capture", "black=" + black}); err == nil {
+		t.Error("expected error with a single capture")
+	}
+	if err := runCalibrate([]string{"--name", "x", "--capture", black, "--capture", white}); err == nil {
+		t.Error("expected error for captures without a background")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"gemini-watermark-remover/watermark"
+)
+
+// runEstimate implements the estimate subcommand: it derives a watermark
+// profile from many watermarked images and writes it as a bundle that
+// --profiles can load.
+func runEstimate(args []string) error {
+	fs := flag.NewFlagSet("estimate", flag.ContinueOnError)
+
+	var (
+		name      string
+		size      int
+		margin    int
+		minWidth  int
+		minHeight int
+		outDir    string
+	)
+	fs.StringVar(&name, "name", "", "Name of the profile (required)")
+	fs.IntVar(&size, "size", 48, "Width and height of the watermark in pixels")
+	fs.IntVar(&margin, "margin", 32, "Distance of the watermark from the bottom and right image edges in pixels")
+	fs.IntVar(&minWidth, "min-width", 0, "Expect the watermark on images wider than this")
+	fs.IntVar(&minHeight, "min-height", 0, "Expect the watermark on images taller than this")
+	fs.StringVar(&outDir, "out", ".", "Directory to write the profile bundle to")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s estimate [options] <files|directories|globs>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Derives a watermark profile from many watermarked images of the same size\n")
+		fmt.Fprintf(os.Stderr, "class (at least %d, several hundred recommended).\n\n", watermark.MinEstimationImages)
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s estimate --name observed-96 --size 96 --margin 64 ./outputs/\n", os.Args[0])
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("estimate: --name is required")
+	}
+
+	files, err := collectImages(fs.Args())
+	if err != nil {
+		return fmt.Errorf("estimate: %w", err)
+	}
+
+	estimator, err := watermark.NewEstimator(watermark.WatermarkConfig{Size: size, Margin: margin})
+	if err != nil {
+		return fmt.Errorf("estimate: %w", err)
+	}
+
+	skipped := 0
+	for _, file := range files {
+		if err := addToEstimator(estimator, file); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", file, err)
+			skipped++
+		}
+	}
+
+	rule := watermark.SelectionRule{MinWidth: minWidth, MinHeight: minHeight}
+	profile, err := estimator.Estimate(name, rule)
+	if err != nil {
+		return fmt.Errorf("estimate: %w", err)
+	}
+
+	path, err := watermark.SaveProfile(profile, outDir)
+	if err != nil {
+		return fmt.Errorf("estimate: %w", err)
+	}
+
+	fmt.Printf("Estimated profile %s from %d image(s) (%d skipped): %s\n",
+		profile.Name, estimator.Count(), skipped, profile.Config())
+	fmt.Printf("  Logo color: (%.1f, %.1f, %.1f)\n", profile.LogoColor[0], profile.LogoColor[1], profile.LogoColor[2])
+	fmt.Printf("  Saved to %s\n", path)
+	return nil
+}
+
+// addToEstimator decodes an image file and adds it to the estimator.
+func addToEstimator(estimator *watermark.Estimator, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	return estimator.Add(img)
+}
+
+// collectImages expands files, directories and glob patterns into a list of
+// supported image files. Unlike the main command it does not skip files
+// carrying the output suffix.
+func collectImages(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if isGlobPattern(arg) {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && !info.IsDir() && isSupportedImage(match) {
+					files = append(files, match)
+				}
+			}
+			continue
+		}
+
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && isSupportedImage(entry.Name()) {
+				files = append(files, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no image files given")
+	}
+	return files, nil
+}
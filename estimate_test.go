@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gemini-watermark-remover/watermark"
+)
+
+func TestCollectImages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "b.jpg", "c_clean.png", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	files, err := collectImages([]string{dir})
+	if err != nil {
+		t.Fatalf("collectImages() error: %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 images from directory, got %v", files)
+	}
+
+	files, err = collectImages([]string{filepath.Join(dir, "*.png")})
+	if err != nil {
+		t.Fatalf("collectImages() error: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 images from glob, got %v", files)
+	}
+
+	if _, err := collectImages([]string{filepath.Join(dir, "*.gif")}); err == nil {
+		t.Error("expected error when nothing matches")
+	}
+	if _, err := collectImages([]string{filepath.Join(dir, "missing.png")}); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestRunEstimate(t *testing.T) {
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	truth, _ := engine.Profile(watermark.ProfileGemini48)
+
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	width, height := 160, 160
+	region := watermark.CalculatePosition(width, height, truth.Config())
+	for i := 0; i < 40; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		base := rng.Intn(220)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := float64(base + rng.Intn(36))
+				if (image.Point{X: x, Y: y}).In(region) {
+					alpha := float64(truth.AlphaMap[(y-region.Min.Y)*truth.Size+x-region.Min.X])
+					v = alpha*watermark.LogoValue + (1-alpha)*v
+				}
+				img.SetRGBA(x, y, color.RGBA{R: uint8(v + 0.5), G: uint8(v + 0.5), B: uint8(v + 0.5), A: 255})
+			}
+		}
+
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("img%02d.png", i)))
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatalf("Failed to encode image: %v", err)
+		}
+		f.Close()
+	}
+
+	outDir := t.TempDir()
+	if err := runEstimate([]string{"--name", "observed", "--out", outDir, dir}); err != nil {
+		t.Fatalf("runEstimate() error: %v", err)
+	}
+	if _, err := watermark.NewEngine(watermark.WithProfilePaths(filepath.Join(outDir, "observed.json"))); err != nil {
+		t.Errorf("estimated profile cannot be loaded: %v", err)
+	}
+
+	if err := runEstimate([]string{dir}); err == nil {
+		t.Error("expected error without --name")
+	}
+}
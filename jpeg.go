@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+
+	"gemini-watermark-remover/jpegpatch"
+)
+
+// fallbackJPEGQuality is the quality used for JPEG outputs whose source
+// encoding cannot be read.
+const fallbackJPEGQuality = 95
+
+// writeJPEG encodes result, the cleaned version of the JPEG file source, to w.
+// The output reuses the source's quantization tables and chroma subsampling,
+// or standard tables at --jpeg-quality. With --jpeg-patch it rewrites only
+// the MCUs that changed so the rest of the file stays bit-identical, and
+// falls back to a full re-encode for files the patcher does not support.
+// Unless --quiet is set, it reports the source and output quality.
+func writeJPEG(w io.Writer, source []byte, result image.Image) error {
+	info, err := jpegpatch.Inspect(source)
+	if err != nil {
+		quality := fallbackJPEGQuality
+		if jpegQuality > 0 {
+			quality = jpegQuality
+		}
+		if !quiet {
+			fmt.Printf("  JPEG quality: source unknown (%v), output %d\n", err, quality)
+		}
+		return jpeg.Encode(w, result, &jpeg.Options{Quality: quality})
+	}
+	sourceQuality := describeQuality(info.Quality, info.Standard)
+
+	if jpegPatch {
+		patched, stats, err := jpegpatch.Patch(source, result)
+		if err == nil {
+			if verbose {
+				fmt.Printf("  JPEG patch: %d of %d MCUs changed, %d re-encoded\n", stats.Changed, stats.MCUs, stats.Reencoded)
+			}
+			if !quiet {
+				fmt.Printf("  JPEG quality: source %s, output %s (source tables)\n", sourceQuality, sourceQuality)
+			}
+			_, err = w.Write(patched)
+			return err
+		}
+		if !quiet {
+			fmt.Printf("  Cannot patch JPEG in place (%v), re-encoding\n", err)
+		}
+	}
+
+	options := &jpegpatch.Options{Quant: info.Quant, Grayscale: info.Grayscale, Subsample: info.Subsample}
+	output := sourceQuality + " (source tables)"
+	if jpegQuality > 0 {
+		options.Quant = jpegpatch.QuantTables(jpegQuality)
+		output = describeQuality(jpegQuality, true)
+	}
+	if !quiet {
+		fmt.Printf("  JPEG quality: source %s, output %s, %s\n", sourceQuality, output, describeLayout(info))
+	}
+	return jpegpatch.Encode(w, result, options)
+}
+
+// describeQuality formats an estimated JPEG quality, marking estimates of
+// non-standard tables as approximate.
+func describeQuality(quality int, standard bool) string {
+	if standard {
+		return fmt.Sprint(quality)
+	}
+	return fmt.Sprintf("~%d", quality)
+}
+
+// describeLayout formats the components of a JPEG file, such as "Y'CbCr
+// 4:2:0" or "grayscale".
+func describeLayout(info jpegpatch.Info) string {
+	if info.Grayscale {
+		return "grayscale"
+	}
+	ratio := strings.TrimPrefix(info.Subsample.String(), "YCbCrSubsampleRatio")
+	return "Y'CbCr " + strings.Join(strings.Split(ratio, ""), ":")
+}
@@ -0,0 +1,59 @@
+package jpegpatch
+
+import "math"
+
+// dctCos holds cos((2x+1) u pi / 16) at [u][x], scaled by C(u) / 2 with
+// C(0) = 1/sqrt(2) and C(u) = 1 otherwise.
+var dctCos = func() (table [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			table[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}()
+
+// fdct returns the forward DCT (ITU T.81, A.3.3) of a block of 8-bit
+// samples, level-shifted by 128, in natural order.
+func fdct(samples *[64]float64) *[64]float64 {
+	// Rows, then columns
+	var rows, coefs [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 8; x++ {
+				sum += (samples[y*8+x] - 128) * dctCos[u][x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				sum += rows[y*8+u] * dctCos[v][y]
+			}
+			coefs[v*8+u] = sum
+		}
+	}
+	return &coefs
+}
+
+// quantize divides DCT coefficients by a quantization table, rounding to
+// the nearest integer within the range baseline coding can represent.
+func quantize(coefs *[64]float64, table *[64]int32) [64]int32 {
+	var block [64]int32
+	for i, c := range coefs {
+		q := float64(max(table[i], 1))
+		limit := 1023.0
+		if i == 0 {
+			limit = 2047
+		}
+		block[i] = int32(math.Max(-limit, math.Min(limit, math.Round(c/q))))
+	}
+	return block
+}
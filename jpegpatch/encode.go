@@ -0,0 +1,288 @@
+package jpegpatch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// huffmanSpec is a Huffman table as stored in a DHT segment: the number of
+// codes of each length and the symbols in code order.
+type huffmanSpec struct {
+	counts [16]int
+	values []byte
+}
+
+// standardHuffman holds the luma DC, luma AC, chroma DC and chroma AC
+// Huffman tables of ITU T.81, Annex K.3, which cover every symbol.
+var standardHuffman = [4]huffmanSpec{
+	{
+		[16]int{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]int{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]int{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]int{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// Options are the encoding parameters of Encode. Typically Quant and the
+// layout come from the Info of the source file, or Quant from QuantTables.
+type Options struct {
+	// Quant holds the luma and chroma quantization tables in natural
+	// order. Entries are clamped to 1..255 for baseline coding.
+	Quant [2][64]int32
+
+	// Grayscale encodes only the luma component. Subsample is the chroma
+	// subsampling of Y'CbCr output.
+	Grayscale bool
+	Subsample image.YCbCrSubsampleRatio
+}
+
+// Encode writes img as a baseline JPEG with the given quantization tables
+// and chroma subsampling, and the standard Huffman tables. With nil options
+// it encodes Y'CbCr 4:2:0 at DefaultQuality, like image/jpeg.
+func Encode(w io.Writer, img image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{Quant: QuantTables(DefaultQuality), Subsample: image.YCbCrSubsampleRatio420}
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() >= 1<<16 || bounds.Dy() >= 1<<16 {
+		return fmt.Errorf("jpegpatch: cannot encode a %dx%d image", bounds.Dx(), bounds.Dy())
+	}
+
+	f := &file{width: bounds.Dx(), height: bounds.Dy(), hmax: 1, vmax: 1}
+	if o.Grayscale {
+		f.comps = []component{{id: 1, h: 1, v: 1}}
+	} else {
+		h, v, ok := samplingFactors(o.Subsample)
+		if !ok {
+			return fmt.Errorf("jpegpatch: unknown chroma subsampling %v", o.Subsample)
+		}
+		f.comps = []component{
+			{id: 1, h: h, v: v},
+			{id: 2, h: 1, v: 1, tq: 1, td: 1, ta: 1},
+			{id: 3, h: 1, v: 1, tq: 1, td: 1, ta: 1},
+		}
+		f.hmax, f.vmax = h, v
+	}
+	for i := range f.comps {
+		f.scan = append(f.scan, i)
+	}
+	f.setSizes()
+	f.setBlocks()
+	for t := range o.Quant {
+		for i, q := range o.Quant[t] {
+			f.quant[t][i] = max(1, min(255, q))
+		}
+	}
+	for t, spec := range standardHuffman {
+		h, err := newHuffman(spec.counts, spec.values)
+		if err != nil {
+			return err
+		}
+		if t%2 == 0 {
+			f.dc[t/2] = h
+		} else {
+			f.ac[t/2] = h
+		}
+	}
+
+	p := imagePlanes(img, f, o.Subsample)
+	for c := range f.comps {
+		comp := &f.comps[c]
+		for by := 0; by < comp.blocksH; by++ {
+			for bx := 0; bx < comp.blocksW; bx++ {
+				comp.coefs[by*comp.blocksW+bx] = quantize(fdct(p.block(c, bx, by)), &f.quant[comp.tq])
+			}
+		}
+	}
+	all := make([]bool, f.mcus)
+	for i := range all {
+		all[i] = true
+	}
+	scan, _, err := f.encodeScan(all)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(f.appendHeaders(nil, scan))
+	return err
+}
+
+// samplingFactors returns the luma sampling factors of a chroma subsampling,
+// with both chroma components sampled once per MCU.
+func samplingFactors(ratio image.YCbCrSubsampleRatio) (h, v int, ok bool) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+		return 1, 1, true
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1, true
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2, true
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2, true
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1, true
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2, true
+	}
+	return 0, 0, false
+}
+
+// imagePlanes returns the component planes of img for the layout of f.
+// Images already in that layout are read directly; others are converted,
+// averaging chroma over the pixels each sample covers.
+func imagePlanes(img image.Image, f *file, ratio image.YCbCrSubsampleRatio) *planes {
+	p := &planes{}
+	bounds := img.Bounds()
+	if len(f.comps) == 1 {
+		if gray, ok := img.(*image.Gray); ok && bounds.Min == (image.Point{}) {
+			p.add(gray.Pix, gray.Stride, f.comps[0])
+			return p
+		}
+		pix := make([]uint8, f.width*f.height)
+		for y := 0; y < f.height; y++ {
+			for x := 0; x < f.width; x++ {
+				pix[y*f.width+x] = color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+			}
+		}
+		p.add(pix, f.width, f.comps[0])
+		return p
+	}
+
+	if ycc, ok := img.(*image.YCbCr); ok && ycc.SubsampleRatio == ratio && bounds.Min == (image.Point{}) {
+		p.add(ycc.Y, ycc.YStride, f.comps[0])
+		p.add(ycc.Cb, ycc.CStride, f.comps[1])
+		p.add(ycc.Cr, ycc.CStride, f.comps[2])
+		return p
+	}
+
+	luma := f.comps[0]
+	chroma := f.comps[1]
+	sx, sy := luma.h, luma.v // Pixels per chroma sample
+	y := make([]uint8, luma.width*luma.height)
+	cb := make([]uint8, chroma.width*chroma.height)
+	cr := make([]uint8, chroma.width*chroma.height)
+	sums := make([][3]int, chroma.width*chroma.height)
+	for py := 0; py < f.height; py++ {
+		for px := 0; px < f.width; px++ {
+			r, g, b, _ := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+			yy, u, v := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			y[py*luma.width+px] = yy
+			i := (py/sy)*chroma.width + px/sx
+			sums[i] = [3]int{sums[i][0] + int(u), sums[i][1] + int(v), sums[i][2] + 1}
+		}
+	}
+	for i, sum := range sums {
+		cb[i] = uint8((sum[0] + sum[2]/2) / sum[2])
+		cr[i] = uint8((sum[1] + sum[2]/2) / sum[2])
+	}
+	p.add(y, luma.width, luma)
+	p.add(cb, chroma.width, chroma)
+	p.add(cr, chroma.width, chroma)
+	return p
+}
+
+// appendHeaders appends a complete JPEG file with the tables and frame of f
+// and the entropy-coded data scan.
+func (f *file) appendHeaders(out, scan []byte) []byte {
+	out = append(out, 0xFF, markerSOI)
+
+	tables := 1
+	if len(f.comps) > 1 {
+		tables = 2
+	}
+	var dqt, dht []byte
+	for t := 0; t < tables; t++ {
+		dqt = append(dqt, byte(t))
+		for k := 0; k < 64; k++ {
+			dqt = append(dqt, byte(f.quant[t][unzig[k]]))
+		}
+		for class, spec := range standardHuffman[2*t : 2*t+2] {
+			dht = append(dht, byte(class<<4|t))
+			for _, n := range spec.counts {
+				dht = append(dht, byte(n))
+			}
+			dht = append(dht, spec.values...)
+		}
+	}
+	out = appendSegment(out, markerDQT, dqt)
+
+	sof := []byte{8, 0, 0, 0, 0, byte(len(f.comps))}
+	binary.BigEndian.PutUint16(sof[1:], uint16(f.height))
+	binary.BigEndian.PutUint16(sof[3:], uint16(f.width))
+	sos := []byte{byte(len(f.comps))}
+	for _, comp := range f.comps {
+		sof = append(sof, comp.id, byte(comp.h<<4|comp.v), byte(comp.tq))
+		sos = append(sos, comp.id, byte(comp.td<<4|comp.ta))
+	}
+	sos = append(sos, 0, 63, 0)
+	out = appendSegment(out, markerSOF0, sof)
+	out = appendSegment(out, markerDHT, dht)
+	out = appendSegment(out, markerSOS, sos)
+
+	out = append(out, scan...)
+	return append(out, 0xFF, markerEOI)
+}
+
+// appendSegment appends a marker segment with the given payload.
+func appendSegment(out []byte, marker byte, payload []byte) []byte {
+	out = append(out, 0xFF, marker, 0, 0)
+	binary.BigEndian.PutUint16(out[len(out)-2:], uint16(2+len(payload)))
+	return append(out, payload...)
+}
@@ -0,0 +1,141 @@
+package jpegpatch
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestInspect_Quality(t *testing.T) {
+	photo := createPhoto(64, 48, 7)
+	for _, quality := range []int{10, 50, 75, 90, 100} {
+		info, err := Inspect(encode(t, photo, quality))
+		if err != nil {
+			t.Fatalf("Inspect() error: %v", err)
+		}
+		if info.Quality != quality || !info.Standard {
+			t.Errorf("quality %d: estimated %d (standard %v)", quality, info.Quality, info.Standard)
+		}
+		if info.Quant != QuantTables(quality) {
+			t.Errorf("quality %d: unexpected tables", quality)
+		}
+		if info.Grayscale || info.Subsample != image.YCbCrSubsampleRatio420 || info.Progressive {
+			t.Errorf("quality %d: unexpected layout %+v", quality, info)
+		}
+	}
+
+	// Tables that are not scaled standard tables get the closest quality
+	tables := QuantTables(80)
+	tables[0][0]++
+	var buf bytes.Buffer
+	if err := Encode(&buf, photo, &Options{Quant: tables, Subsample: image.YCbCrSubsampleRatio444}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	info, err := Inspect(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Inspect() error: %v", err)
+	}
+	if info.Quality != 80 || info.Standard || info.Quant != tables {
+		t.Errorf("custom tables: estimated %d (standard %v)", info.Quality, info.Standard)
+	}
+
+	// Progressive files are inspected as well
+	progressive := encode(t, photo, 60)
+	progressive[bytes.Index(progressive, []byte{0xFF, markerSOF0})+1] = 0xC2
+	if info, err := Inspect(progressive); err != nil || !info.Progressive || info.Quality != 60 {
+		t.Errorf("progressive: got %+v, %v", info, err)
+	}
+}
+
+func TestEncode_MatchesLayout(t *testing.T) {
+	photo := createPhoto(101, 67, 8)
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410,
+	}
+	for _, ratio := range ratios {
+		options := &Options{Quant: QuantTables(92), Subsample: ratio}
+		var buf bytes.Buffer
+		if err := Encode(&buf, photo, options); err != nil {
+			t.Fatalf("%v: Encode() error: %v", ratio, err)
+		}
+		info, err := Inspect(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%v: Inspect() error: %v", ratio, err)
+		}
+		if info.Subsample != ratio || info.Quality != 92 || !info.Standard {
+			t.Errorf("%v: inspected %v at quality %d", ratio, info.Subsample, info.Quality)
+		}
+
+		result := decode(t, buf.Bytes())
+		if ycc, ok := result.(*image.YCbCr); !ok || ycc.SubsampleRatio != ratio {
+			t.Errorf("%v: decoded as %T", ratio, result)
+		}
+		if mean := meanError(photo, result); mean > 8 {
+			t.Errorf("%v: mean error %.2f", ratio, mean)
+		}
+	}
+}
+
+func TestEncode_Gray(t *testing.T) {
+	photo := createPhoto(50, 40, 9)
+	gray := image.NewGray(photo.Bounds())
+	draw.Draw(gray, gray.Bounds(), photo, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, photo, &Options{Quant: QuantTables(85), Grayscale: true}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	info, err := Inspect(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Inspect() error: %v", err)
+	}
+	if !info.Grayscale || info.Quality != 85 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	result := decode(t, buf.Bytes())
+	if _, ok := result.(*image.Gray); !ok {
+		t.Fatalf("decoded as %T", result)
+	}
+	// As close as image/jpeg at the same quality
+	reference := meanError(gray, decode(t, encode(t, gray, 85)))
+	if mean := meanError(gray, result); mean > reference+0.1 {
+		t.Errorf("mean error %.2f, image/jpeg %.2f", mean, reference)
+	}
+}
+
+func TestEncode_ReadsYCbCrDirectly(t *testing.T) {
+	// Re-encoding a decoded file with its own tables and layout keeps it
+	// close to the file, within the rounding of the DCT
+	data := encode(t, createPhoto(120, 90, 10), 85)
+	source := decode(t, data)
+	info, err := Inspect(data)
+	if err != nil {
+		t.Fatalf("Inspect() error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, source, &Options{Quant: info.Quant, Subsample: info.Subsample}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if mean := meanError(source, decode(t, buf.Bytes())); mean > 1 {
+		t.Errorf("mean error %.2f after re-encoding", mean)
+	}
+}
+
+// meanError returns the mean absolute difference of the 8-bit RGB channels
+// of two images.
+func meanError(a, b image.Image) float64 {
+	var sum float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				sum += float64(max(d, -d))
+			}
+		}
+	}
+	return sum / float64(3*bounds.Dx()*bounds.Dy())
+}
@@ -0,0 +1,420 @@
+package jpegpatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// JPEG markers (ITU T.81, Table B.1).
+const (
+	markerSOF0 = 0xC0 // Baseline DCT
+	markerSOF1 = 0xC1 // Extended sequential DCT, Huffman coding
+	markerDHT  = 0xC4
+	markerRST0 = 0xD0
+	markerRST7 = 0xD7
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerDQT  = 0xDB
+	markerDRI  = 0xDD
+	markerTEM  = 0x01
+)
+
+// errFormat reports malformed JPEG data.
+var errFormat = errors.New("jpegpatch: invalid JPEG format")
+
+// unzig maps the zig-zag order of the coefficients in the file to their
+// natural (row-major) position in a block.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// component is an image component of the frame.
+type component struct {
+	id     byte
+	h, v   int // Sampling factors
+	tq     int // Quantization table
+	td, ta int // DC and AC Huffman tables of the scan
+
+	// width and height are the number of samples; blocksW and blocksH the
+	// number of blocks stored in the scan, including padding.
+	width, height    int
+	blocksW, blocksH int
+
+	// coefs holds the quantized coefficients of every block, row by row,
+	// each in natural order.
+	coefs [][64]int32
+}
+
+// file holds the structure of a single-scan sequential JPEG file and, after
+// decodeScan, its coefficients and the position of every MCU in the scan.
+type file struct {
+	width, height int
+	comps         []component
+	hmax, vmax    int
+	quant         [4][64]int32 // Natural order
+	dc, ac        [4]*huffman
+	restart       int // MCUs per restart interval, 0 without restarts
+
+	// scan lists the frame components in scan order; a single-component
+	// scan is non-interleaved.
+	scan []int
+
+	// scanStart and scanEnd delimit the entropy-coded data.
+	scanStart, scanEnd int
+
+	// mcus is the number of MCUs and mcusW the number per row.
+	mcus, mcusW int
+
+	// segments holds the unstuffed entropy-coded data of each restart
+	// interval, and mcuBits the bit range of every MCU within its segment.
+	segments [][]byte
+	mcuBits  [][2]int
+
+	// dcAfter holds the DC predictions after every MCU, per scan
+	// component, as encoded in the file.
+	dcAfter [][]int32
+}
+
+// readMarkers calls fn with every marker segment of a JPEG file up to and
+// including the first SOS, and the position following the segment.
+func readMarkers(data []byte, fn func(marker byte, segment []byte, end int) error) error {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return errFormat
+	}
+
+	pos := 2
+	for {
+		// Markers may be preceded by fill bytes
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return errFormat
+		}
+		for pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+2 > len(data) {
+			return errFormat
+		}
+		marker := data[pos+1]
+		pos += 2
+		if marker == markerTEM || (marker >= markerRST0 && marker <= markerRST7) {
+			continue
+		}
+		if marker == markerEOI {
+			return fmt.Errorf("%w: no scan", errFormat)
+		}
+		if pos+2 > len(data) {
+			return errFormat
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return errFormat
+		}
+		segment := data[pos+2 : pos+length]
+		pos += length
+
+		if err := fn(marker, segment, pos); err != nil || marker == markerSOS {
+			return err
+		}
+	}
+}
+
+// parse reads the markers of a JPEG file up to its scan.
+func parse(data []byte) (*file, error) {
+	f := &file{}
+	frame := false
+	err := readMarkers(data, func(marker byte, segment []byte, end int) error {
+		switch {
+		case marker == markerSOF0 || marker == markerSOF1:
+			frame = true
+			return f.parseFrame(segment)
+		case marker >= 0xC2 && marker <= 0xCF && marker != markerDHT && marker != 0xC8 && marker != 0xCC:
+			return fmt.Errorf("%w: frame type %#x (only sequential Huffman coding)", ErrUnsupported, marker)
+		case marker == 0xCC:
+			return fmt.Errorf("%w: arithmetic coding", ErrUnsupported)
+		case marker == markerDHT:
+			return f.parseHuffman(segment)
+		case marker == markerDQT:
+			return f.parseQuant(segment)
+		case marker == markerDRI:
+			if len(segment) != 2 {
+				return errFormat
+			}
+			f.restart = int(binary.BigEndian.Uint16(segment))
+		case marker == markerSOS:
+			if !frame {
+				return fmt.Errorf("%w: scan before frame header", errFormat)
+			}
+			f.scanStart = end
+			return f.parseScan(segment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, f.findScanEnd(data)
+}
+
+// parseFrame reads a SOF0 or SOF1 segment.
+func (f *file) parseFrame(segment []byte) error {
+	if len(segment) < 6 {
+		return errFormat
+	}
+	if segment[0] != 8 {
+		return fmt.Errorf("%w: %d-bit samples", ErrUnsupported, segment[0])
+	}
+	f.height = int(binary.BigEndian.Uint16(segment[1:]))
+	f.width = int(binary.BigEndian.Uint16(segment[3:]))
+	n := int(segment[5])
+	if f.width == 0 || f.height == 0 {
+		return fmt.Errorf("%w: image height defined by DNL marker", ErrUnsupported)
+	}
+	if n != 1 && n != 3 {
+		return fmt.Errorf("%w: %d components", ErrUnsupported, n)
+	}
+	if len(segment) != 6+3*n {
+		return errFormat
+	}
+
+	f.comps = make([]component, n)
+	f.hmax, f.vmax = 1, 1
+	for i := range f.comps {
+		c := segment[6+3*i:]
+		comp := &f.comps[i]
+		comp.id = c[0]
+		comp.h, comp.v = int(c[1]>>4), int(c[1]&0x0F)
+		comp.tq = int(c[2])
+		if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 || comp.tq > 3 {
+			return errFormat
+		}
+		f.hmax, f.vmax = max(f.hmax, comp.h), max(f.vmax, comp.v)
+	}
+	f.setSizes()
+	return nil
+}
+
+// setSizes computes the number of samples of every component from the
+// image size and the sampling factors.
+func (f *file) setSizes() {
+	for i := range f.comps {
+		comp := &f.comps[i]
+		comp.width = (f.width*comp.h + f.hmax - 1) / f.hmax
+		comp.height = (f.height*comp.v + f.vmax - 1) / f.vmax
+	}
+}
+
+// subsampleRatio returns the image.YCbCr subsampling matching the sampling
+// factors of a three-component frame, or -1 if there is none.
+func (f *file) subsampleRatio() image.YCbCrSubsampleRatio {
+	y, cb, cr := f.comps[0], f.comps[1], f.comps[2]
+	if cb.h != 1 || cb.v != 1 || cr.h != 1 || cr.v != 1 {
+		return -1
+	}
+	switch [2]int{y.h, y.v} {
+	case [2]int{1, 1}:
+		return image.YCbCrSubsampleRatio444
+	case [2]int{2, 1}:
+		return image.YCbCrSubsampleRatio422
+	case [2]int{2, 2}:
+		return image.YCbCrSubsampleRatio420
+	case [2]int{1, 2}:
+		return image.YCbCrSubsampleRatio440
+	case [2]int{4, 1}:
+		return image.YCbCrSubsampleRatio411
+	case [2]int{4, 2}:
+		return image.YCbCrSubsampleRatio410
+	}
+	return -1
+}
+
+// parseQuant reads a DQT segment.
+func (f *file) parseQuant(segment []byte) error {
+	for len(segment) > 0 {
+		precision, id := segment[0]>>4, int(segment[0]&0x0F)
+		if id > 3 || precision > 1 {
+			return errFormat
+		}
+		size := 64 * (1 + int(precision))
+		if len(segment) < 1+size {
+			return errFormat
+		}
+		for k := 0; k < 64; k++ {
+			if precision == 0 {
+				f.quant[id][unzig[k]] = int32(segment[1+k])
+			} else {
+				f.quant[id][unzig[k]] = int32(binary.BigEndian.Uint16(segment[1+2*k:]))
+			}
+		}
+		segment = segment[1+size:]
+	}
+	return nil
+}
+
+// parseHuffman reads a DHT segment.
+func (f *file) parseHuffman(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errFormat
+		}
+		class, id := segment[0]>>4, int(segment[0]&0x0F)
+		if class > 1 || id > 3 {
+			return errFormat
+		}
+		var counts [16]int
+		total := 0
+		for i := range counts {
+			counts[i] = int(segment[1+i])
+			total += counts[i]
+		}
+		if total > 256 || len(segment) < 17+total {
+			return errFormat
+		}
+		h, err := newHuffman(counts, segment[17:17+total])
+		if err != nil {
+			return err
+		}
+		if class == 0 {
+			f.dc[id] = h
+		} else {
+			f.ac[id] = h
+		}
+		segment = segment[17+total:]
+	}
+	return nil
+}
+
+// parseScan reads an SOS segment.
+func (f *file) parseScan(segment []byte) error {
+	if len(segment) < 1 {
+		return errFormat
+	}
+	n := int(segment[0])
+	if len(segment) != 4+2*n || n < 1 {
+		return errFormat
+	}
+	if n != len(f.comps) {
+		return fmt.Errorf("%w: scan with %d of %d components", ErrUnsupported, n, len(f.comps))
+	}
+
+	for i := 0; i < n; i++ {
+		id, tables := segment[1+2*i], segment[2+2*i]
+		c := -1
+		for j := range f.comps {
+			if f.comps[j].id == id {
+				c = j
+			}
+		}
+		if c < 0 {
+			return errFormat
+		}
+		comp := &f.comps[c]
+		comp.td, comp.ta = int(tables>>4), int(tables&0x0F)
+		if comp.td > 3 || comp.ta > 3 || f.dc[comp.td] == nil || f.ac[comp.ta] == nil {
+			return fmt.Errorf("%w: missing Huffman table", errFormat)
+		}
+		f.scan = append(f.scan, c)
+	}
+	spectral := segment[1+2*n:]
+	if spectral[0] != 0 || spectral[1] != 63 || spectral[2] != 0 {
+		return fmt.Errorf("%w: spectral selection", ErrUnsupported)
+	}
+	f.setBlocks()
+	return nil
+}
+
+// setBlocks computes the block layout of the scan and allocates the
+// coefficients.
+func (f *file) setBlocks() {
+	// Block layout: an interleaved scan codes whole MCUs of hmax x vmax
+	// blocks of 8x8 pixels, a non-interleaved scan single blocks
+	if len(f.scan) == 1 {
+		comp := &f.comps[f.scan[0]]
+		comp.blocksW, comp.blocksH = (comp.width+7)/8, (comp.height+7)/8
+		f.mcusW = comp.blocksW
+		f.mcus = comp.blocksW * comp.blocksH
+	} else {
+		f.mcusW = (f.width + 8*f.hmax - 1) / (8 * f.hmax)
+		mcusH := (f.height + 8*f.vmax - 1) / (8 * f.vmax)
+		f.mcus = f.mcusW * mcusH
+		for i := range f.comps {
+			comp := &f.comps[i]
+			comp.blocksW, comp.blocksH = f.mcusW*comp.h, mcusH*comp.v
+		}
+	}
+	for i := range f.comps {
+		comp := &f.comps[i]
+		comp.coefs = make([][64]int32, comp.blocksW*comp.blocksH)
+	}
+}
+
+// findScanEnd finds the marker that ends the entropy-coded data and checks
+// that no further scan follows.
+func (f *file) findScanEnd(data []byte) error {
+	pos := f.scanStart
+	for ; pos+1 < len(data); pos++ {
+		if data[pos] != 0xFF {
+			continue
+		}
+		next := data[pos+1]
+		if next == 0x00 || (next >= markerRST0 && next <= markerRST7) {
+			pos++
+			continue
+		}
+		if next == 0xFF {
+			continue // Fill byte
+		}
+		break
+	}
+	if pos+1 >= len(data) {
+		return fmt.Errorf("%w: unterminated scan", errFormat)
+	}
+	f.scanEnd = pos
+
+	// A later SOS would belong to another scan of the same frame
+	for p := pos; p+1 < len(data); p++ {
+		if data[p] == 0xFF && data[p+1] == markerSOS {
+			return fmt.Errorf("%w: multiple scans", ErrUnsupported)
+		}
+		if data[p] == 0xFF && data[p+1] == markerEOI {
+			break
+		}
+	}
+	return nil
+}
+
+// forEachBlock calls fn with the component index and block coordinates of
+// every block of MCU m, in coding order.
+func (f *file) forEachBlock(m int, fn func(c, bx, by int)) {
+	if len(f.scan) == 1 {
+		fn(f.scan[0], m%f.mcusW, m/f.mcusW)
+		return
+	}
+	mx, my := m%f.mcusW, m/f.mcusW
+	for _, c := range f.scan {
+		comp := &f.comps[c]
+		for v := 0; v < comp.v; v++ {
+			for h := 0; h < comp.h; h++ {
+				fn(c, mx*comp.h+h, my*comp.v+v)
+			}
+		}
+	}
+}
+
+// segmentOf returns the restart interval of MCU m and whether m is the first
+// MCU of it.
+func (f *file) segmentOf(m int) (int, bool) {
+	if f.restart == 0 {
+		return 0, m == 0
+	}
+	return m / f.restart, m%f.restart == 0
+}
@@ -0,0 +1,262 @@
+// Package jpegpatch rewrites the parts of a baseline JPEG file that changed
+// in an edited copy of its decoded image, without re-encoding the rest.
+//
+// Decoding and re-encoding a JPEG degrades every block of the image. Patch
+// instead decodes the entropy-coded data of the file to quantized DCT
+// coefficients, recomputes only the 8x8 blocks whose samples differ between
+// the file and the edited image (quantized with the file's own tables), and
+// re-encodes only the MCUs (minimum coded units) containing them with the
+// file's Huffman tables. The entropy-coded bits of every other MCU are copied
+// as they are, so outside the edited MCUs the patched file decodes to exactly
+// the same samples as the original.
+//
+// Only baseline and extended sequential Huffman-coded JPEGs with 8-bit
+// samples and a single scan are supported, in grayscale or Y'CbCr with one
+// of the chroma subsamplings of image.YCbCr. Patch returns an error wrapping
+// ErrUnsupported for other files; callers typically fall back to a full
+// re-encode.
+//
+// For that fallback, Inspect reads the quantization tables and chroma
+// subsampling of a file (including progressive files) and estimates its
+// quality, and Encode writes an image with given tables and subsampling, so
+// a re-encoded file keeps the compression of its source.
+package jpegpatch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// ErrUnsupported is returned (wrapped) for JPEG files that cannot be
+// patched, such as progressive or arithmetic-coded files.
+var ErrUnsupported = errors.New("jpegpatch: unsupported JPEG")
+
+// Stats describes the work done by Patch.
+type Stats struct {
+	// MCUs is the number of MCUs in the image.
+	MCUs int
+
+	// Changed is the number of MCUs containing blocks whose samples
+	// changed and were re-quantized.
+	Changed int
+
+	// Reencoded is the number of MCUs whose entropy-coded data was
+	// rewritten: the changed MCUs plus unchanged MCUs following them whose
+	// DC prediction changed. Their coefficients, and hence their decoded
+	// samples, are unchanged.
+	Reencoded int
+}
+
+// Patch returns a copy of the JPEG file data in which the blocks that differ
+// between the decoded file and img are replaced by the content of img.
+// img must have the bounds of the decoded file; it is typically the decoded
+// image after editing a small area. *image.YCbCr images with the file's
+// subsampling and *image.Gray images for grayscale files are read directly,
+// other images are converted.
+func Patch(data []byte, img image.Image) ([]byte, Stats, error) {
+	f, err := parse(data)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+
+	reference, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	if img.Bounds() != reference.Bounds() {
+		return nil, Stats{}, fmt.Errorf("jpegpatch: image bounds %v do not match the file's %v", img.Bounds(), reference.Bounds())
+	}
+	old, err := newPlanes(reference, f)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	edited := old.edit(reference, img)
+
+	if err := f.decodeScan(data); err != nil {
+		return nil, Stats{}, err
+	}
+
+	// Re-quantize the blocks whose samples changed
+	changed := make([]bool, f.mcus)
+	for m := 0; m < f.mcus; m++ {
+		f.forEachBlock(m, func(c, bx, by int) {
+			comp := &f.comps[c]
+			if !old.blockEqual(edited, c, bx, by) {
+				comp.coefs[by*comp.blocksW+bx] = quantize(fdct(edited.block(c, bx, by)), &f.quant[comp.tq])
+				changed[m] = true
+			}
+		})
+	}
+
+	scan, stats, err := f.encodeScan(changed)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+
+	out := make([]byte, 0, len(data)+len(scan)-(f.scanEnd-f.scanStart))
+	out = append(out, data[:f.scanStart]...)
+	out = append(out, scan...)
+	out = append(out, data[f.scanEnd:]...)
+	return out, stats, nil
+}
+
+// planes holds the component samples of an image, laid out like the planes
+// of the decoded file: one plane for grayscale, or the Y, Cb and Cr planes
+// of an image.YCbCr with the file's subsampling.
+type planes struct {
+	pix    [][]uint8
+	stride []int
+	width  []int
+	height []int
+}
+
+// newPlanes copies the component planes of the decoded file.
+func newPlanes(img image.Image, f *file) (*planes, error) {
+	switch img := img.(type) {
+	case *image.Gray:
+		if len(f.comps) != 1 {
+			return nil, fmt.Errorf("%w: grayscale decode of a %d-component file", ErrUnsupported, len(f.comps))
+		}
+		p := &planes{}
+		p.add(img.Pix, img.Stride, f.comps[0])
+		return p, nil
+
+	case *image.YCbCr:
+		if len(f.comps) != 3 || img.SubsampleRatio != f.subsampleRatio() {
+			return nil, fmt.Errorf("%w: unexpected component layout", ErrUnsupported)
+		}
+		p := &planes{}
+		p.add(img.Y, img.YStride, f.comps[0])
+		p.add(img.Cb, img.CStride, f.comps[1])
+		p.add(img.Cr, img.CStride, f.comps[2])
+		return p, nil
+	}
+	return nil, fmt.Errorf("%w: decodes to %T", ErrUnsupported, img)
+}
+
+// add appends a copy of a plane of the given component.
+func (p *planes) add(pix []uint8, stride int, comp component) {
+	plane := make([]uint8, comp.height*stride)
+	copy(plane, pix)
+	p.pix = append(p.pix, plane)
+	p.stride = append(p.stride, stride)
+	p.width = append(p.width, comp.width)
+	p.height = append(p.height, comp.height)
+}
+
+// edit returns the planes of img, which is reference after editing. Images
+// of the decoded type are copied; other images are converted at the pixels
+// where they differ from reference, averaging chroma over the pixels each
+// sample covers.
+func (p *planes) edit(reference, img image.Image) *planes {
+	edited := &planes{stride: p.stride, width: p.width, height: p.height}
+	for _, plane := range p.pix {
+		edited.pix = append(edited.pix, append([]uint8(nil), plane...))
+	}
+
+	switch img := img.(type) {
+	case *image.Gray:
+		if _, ok := reference.(*image.Gray); ok {
+			copy(edited.pix[0], img.Pix)
+			return edited
+		}
+	case *image.YCbCr:
+		if ref, ok := reference.(*image.YCbCr); ok && img.SubsampleRatio == ref.SubsampleRatio &&
+			img.YStride == ref.YStride && img.CStride == ref.CStride {
+			copy(edited.pix[0], img.Y)
+			copy(edited.pix[1], img.Cb)
+			copy(edited.pix[2], img.Cr)
+			return edited
+		}
+	}
+
+	bounds := img.Bounds()
+	if len(p.pix) == 1 {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if c := img.At(x, y); !sameColor(c, reference.At(x, y)) {
+					edited.pix[0][y*p.stride[0]+x] = color.GrayModel.Convert(c).(color.Gray).Y
+				}
+			}
+		}
+		return edited
+	}
+
+	// Luma per pixel; chroma samples covering changed pixels are
+	// recomputed from all the pixels they cover
+	ref := reference.(*image.YCbCr)
+	dirty := make(map[int]bool)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			if sameColor(c, ref.At(x, y)) {
+				continue
+			}
+			r, g, b, _ := c.RGBA()
+			yy, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			edited.pix[0][ref.YOffset(x, y)] = yy
+			dirty[ref.COffset(x, y)] = true
+		}
+	}
+	if len(dirty) == 0 {
+		return edited
+	}
+	sums := make(map[int][3]int)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := ref.COffset(x, y)
+			if !dirty[i] {
+				continue
+			}
+			r, g, b, _ := img.At(x, y).RGBA()
+			_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			sum := sums[i]
+			sums[i] = [3]int{sum[0] + int(cb), sum[1] + int(cr), sum[2] + 1}
+		}
+	}
+	for i, sum := range sums {
+		edited.pix[1][i] = uint8((sum[0] + sum[2]/2) / sum[2])
+		edited.pix[2][i] = uint8((sum[1] + sum[2]/2) / sum[2])
+	}
+	return edited
+}
+
+// sameColor reports whether two colors are identical at 8 bits per channel,
+// the precision of the decoded file.
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar>>8 == br>>8 && ag>>8 == bg>>8 && ab>>8 == bb>>8 && aa>>8 == ba>>8
+}
+
+// block returns the samples of block (bx, by) of component c, replicating
+// the last row and column into the padding beyond the plane.
+func (p *planes) block(c, bx, by int) *[64]float64 {
+	var samples [64]float64
+	for j := 0; j < 8; j++ {
+		y := min(by*8+j, p.height[c]-1)
+		for i := 0; i < 8; i++ {
+			x := min(bx*8+i, p.width[c]-1)
+			samples[j*8+i] = float64(p.pix[c][y*p.stride[c]+x])
+		}
+	}
+	return &samples
+}
+
+// blockEqual reports whether block (bx, by) of component c has the same
+// samples in p and q, ignoring the padding.
+func (p *planes) blockEqual(q *planes, c, bx, by int) bool {
+	for y := by * 8; y < min(by*8+8, p.height[c]); y++ {
+		row := y * p.stride[c]
+		for x := bx * 8; x < min(bx*8+8, p.width[c]); x++ {
+			if p.pix[c][row+x] != q.pix[c][row+x] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+package jpegpatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// createPhoto creates a textured color image.
+func createPhoto(width, height int, seed int64) *image.RGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(80 + 100*x/width + rng.Intn(30)),
+				G: uint8(60 + 120*y/height + rng.Intn(30)),
+				B: uint8(150 - 80*x/width + rng.Intn(30)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// encode encodes img as a JPEG with Go's encoder.
+func encode(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatalf("jpeg.Encode() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decode decodes JPEG data.
+func decode(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("jpeg.Decode() error: %v", err)
+	}
+	return img
+}
+
+// withRestarts re-encodes the scan of data with a restart marker every
+// interval MCUs.
+func withRestarts(t *testing.T, data []byte, interval int) []byte {
+	t.Helper()
+	f, err := parse(data)
+	if err != nil {
+		t.Fatalf("parse() error: %v", err)
+	}
+	if err := f.decodeScan(data); err != nil {
+		t.Fatalf("decodeScan() error: %v", err)
+	}
+	f.restart = interval
+	all := make([]bool, f.mcus)
+	for i := range all {
+		all[i] = true
+	}
+	scan, _, err := f.encodeScan(all)
+	if err != nil {
+		t.Fatalf("encodeScan() error: %v", err)
+	}
+
+	dri := []byte{0xFF, markerDRI, 0, 4, 0, 0}
+	binary.BigEndian.PutUint16(dri[4:], uint16(interval))
+	out := append([]byte{0xFF, markerSOI}, dri...)
+	out = append(out, data[2:f.scanStart]...)
+	out = append(out, scan...)
+	return append(out, data[f.scanEnd:]...)
+}
+
+// pixelsEqual reports whether a and b have the same pixels inside rect.
+func pixelsEqual(a, b image.Image, rect image.Rectangle) bool {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkPatch patches a square of the decoded source and verifies that the
+// patched file decodes to the source outside the MCUs covering the square
+// and close to the edit inside it.
+func checkPatch(t *testing.T, data []byte, mcu int, edit func(img draw.Image, rect image.Rectangle)) Stats {
+	t.Helper()
+	source := decode(t, data)
+	bounds := source.Bounds()
+	rect := image.Rect(bounds.Dx()-70, bounds.Dy()-60, bounds.Dx()-30, bounds.Dy()-20)
+
+	// Edit a copy of the decoded image in its own type
+	var edited draw.Image
+	switch src := source.(type) {
+	case *image.YCbCr:
+		c := *src
+		c.Y = append([]uint8(nil), src.Y...)
+		c.Cb = append([]uint8(nil), src.Cb...)
+		c.Cr = append([]uint8(nil), src.Cr...)
+		edited = &ycbcrImage{&c}
+	case *image.Gray:
+		c := *src
+		c.Pix = append([]uint8(nil), src.Pix...)
+		edited = &c
+	}
+	edit(edited, rect)
+
+	patched, stats, err := Patch(data, edited)
+	if err != nil {
+		t.Fatalf("Patch() error: %v", err)
+	}
+	result := decode(t, patched)
+
+	covered := image.Rect(rect.Min.X/mcu*mcu, rect.Min.Y/mcu*mcu,
+		(rect.Max.X+mcu-1)/mcu*mcu, (rect.Max.Y+mcu-1)/mcu*mcu)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if image.Pt(x, y).In(covered) {
+				continue
+			}
+			if result.At(x, y) != source.At(x, y) {
+				t.Fatalf("pixel (%d,%d) outside the patched MCUs changed", x, y)
+			}
+		}
+	}
+
+	var sum float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r1, g1, b1, _ := result.At(x, y).RGBA()
+			r2, g2, b2, _ := edited.At(x, y).RGBA()
+			sum += math.Abs(float64(r1>>8)-float64(r2>>8)) + math.Abs(float64(g1>>8)-float64(g2>>8)) +
+				math.Abs(float64(b1>>8)-float64(b2>>8))
+		}
+	}
+	if mean := sum / float64(3*rect.Dx()*rect.Dy()); mean > 4 {
+		t.Errorf("mean error %.2f inside the patched area", mean)
+	}
+	if pixelsEqual(result, source, rect) {
+		t.Error("patched area unchanged")
+	}
+	return stats
+}
+
+// ycbcrImage makes an *image.YCbCr settable for the tests.
+type ycbcrImage struct {
+	*image.YCbCr
+}
+
+func (m *ycbcrImage) Set(x, y int, c color.Color) {
+	r, g, b, _ := c.RGBA()
+	yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	m.Y[m.YOffset(x, y)] = yy
+	m.Cb[m.COffset(x, y)] = cb
+	m.Cr[m.COffset(x, y)] = cr
+}
+
+// fillSquare paints a gradient into rect.
+func fillSquare(img draw.Image, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			v := uint8(200 - 2*(x-rect.Min.X))
+			img.Set(x, y, color.RGBA{R: v, G: 220, B: 40, A: 255})
+		}
+	}
+}
+
+func TestPatch_YCbCr(t *testing.T) {
+	data := encode(t, createPhoto(333, 250, 1), 90)
+	stats := checkPatch(t, data, 16, fillSquare)
+
+	// 333x250 at 4:2:0 has 21x16 MCUs; the square touches 4x4 of them
+	if stats.MCUs != 21*16 {
+		t.Errorf("expected %d MCUs, got %d", 21*16, stats.MCUs)
+	}
+	if stats.Changed == 0 || stats.Changed > 16 || stats.Reencoded < stats.Changed || stats.Reencoded > stats.Changed+4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPatch_Gray(t *testing.T) {
+	photo := createPhoto(200, 120, 2)
+	gray := image.NewGray(photo.Bounds())
+	draw.Draw(gray, gray.Bounds(), photo, image.Point{}, draw.Src)
+	checkPatch(t, encode(t, gray, 75), 8, fillSquare)
+}
+
+func TestPatch_RestartIntervals(t *testing.T) {
+	data := encode(t, createPhoto(333, 250, 3), 85)
+	restarted := withRestarts(t, data, 5)
+
+	// Re-encoding all MCUs with restart markers keeps the decoded image
+	if !pixelsEqual(decode(t, restarted), decode(t, data), decode(t, data).Bounds()) {
+		t.Fatal("re-encoding with restart intervals changed the image")
+	}
+	checkPatch(t, restarted, 16, fillSquare)
+}
+
+func TestPatch_ConvertedImage(t *testing.T) {
+	data := encode(t, createPhoto(160, 160, 4), 90)
+	source := decode(t, data)
+
+	// An RGBA copy with an edited square
+	rgba := image.NewRGBA(source.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), source, image.Point{}, draw.Src)
+	fillSquare(rgba, image.Rect(40, 40, 60, 60))
+
+	patched, stats, err := Patch(data, rgba)
+	if err != nil {
+		t.Fatalf("Patch() error: %v", err)
+	}
+	if stats.Changed == 0 || stats.Changed > 9 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	result := decode(t, patched)
+	if !pixelsEqual(result, source, image.Rect(0, 0, 160, 32)) || !pixelsEqual(result, source, image.Rect(0, 80, 160, 160)) {
+		t.Error("pixels outside the patched MCUs changed")
+	}
+}
+
+func TestPatch_Unchanged(t *testing.T) {
+	data := encode(t, createPhoto(100, 80, 5), 90)
+	patched, stats, err := Patch(data, decode(t, data))
+	if err != nil {
+		t.Fatalf("Patch() error: %v", err)
+	}
+	if stats.Changed != 0 || stats.Reencoded != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if !bytes.Equal(patched, data) {
+		t.Error("expected an unchanged file")
+	}
+}
+
+func TestPatch_Unsupported(t *testing.T) {
+	data := encode(t, createPhoto(64, 64, 6), 90)
+	img := decode(t, data)
+
+	// Pretend the file is progressive
+	progressive := append([]byte(nil), data...)
+	i := bytes.Index(progressive, []byte{0xFF, markerSOF0})
+	progressive[i+1] = 0xC2
+	if _, _, err := Patch(progressive, img); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported for a progressive file, got %v", err)
+	}
+
+	if _, _, err := Patch(data, image.NewRGBA(image.Rect(0, 0, 10, 10))); err == nil {
+		t.Error("expected an error for mismatched bounds")
+	}
+	if _, _, err := Patch([]byte("not a jpeg"), img); err == nil {
+		t.Error("expected an error for invalid data")
+	}
+}
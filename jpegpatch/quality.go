@@ -0,0 +1,139 @@
+package jpegpatch
+
+import (
+	"fmt"
+	"image"
+)
+
+// DefaultQuality is the quality used by Encode without options, as in
+// image/jpeg.
+const DefaultQuality = 75
+
+// standardQuant holds the luma and chroma quantization tables of ITU T.81,
+// Annex K.1, in natural order. Encoders such as libjpeg and image/jpeg scale
+// them by a quality factor.
+var standardQuant = [2][64]int32{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// QuantTables returns the luma and chroma quantization tables for a quality
+// from 1 to 100, scaled from the standard tables like libjpeg and
+// image/jpeg do. Qualities outside the range are clamped.
+func QuantTables(quality int) [2][64]int32 {
+	quality = max(1, min(100, quality))
+	scale := int32(200 - 2*quality)
+	if quality < 50 {
+		scale = int32(5000 / quality)
+	}
+
+	var tables [2][64]int32
+	for t := range tables {
+		for i, q := range standardQuant[t] {
+			tables[t][i] = max(1, min(255, (q*scale+50)/100))
+		}
+	}
+	return tables
+}
+
+// Info describes the encoding parameters of a JPEG file.
+type Info struct {
+	// Quality is the quality (1 to 100) whose standard tables are closest
+	// to the file's; Standard reports whether they match exactly.
+	Quality  int
+	Standard bool
+
+	// Quant holds the luma and chroma quantization tables in natural
+	// order. The chroma table is zero for grayscale files.
+	Quant [2][64]int32
+
+	// Grayscale reports a single-component file. Subsample is the chroma
+	// subsampling of Y'CbCr files; uncommon sampling factors are reported
+	// as 4:2:0.
+	Grayscale bool
+	Subsample image.YCbCrSubsampleRatio
+
+	// Progressive reports a progressive file, which Patch cannot rewrite.
+	Progressive bool
+}
+
+// Inspect reads the quantization tables and chroma subsampling of a JPEG
+// file and estimates its quality. It accepts progressive files as well as
+// the files Patch supports.
+func Inspect(data []byte) (Info, error) {
+	f := &file{}
+	info := Info{}
+	frame := false
+	err := readMarkers(data, func(marker byte, segment []byte, _ int) error {
+		switch {
+		case marker == markerDQT:
+			return f.parseQuant(segment)
+		case marker >= markerSOF0 && marker <= 0xCF && marker != markerDHT && marker != 0xC8 && marker != 0xCC:
+			frame = true
+			info.Progressive = marker == 0xC2 || marker == 0xC6 || marker == 0xCA || marker == 0xCE
+			return f.parseFrame(segment)
+		case marker == markerSOS && !frame:
+			return fmt.Errorf("%w: scan before frame header", errFormat)
+		}
+		return nil
+	})
+	if err != nil {
+		return Info{}, err
+	}
+
+	info.Quant[0] = f.quant[f.comps[0].tq]
+	if len(f.comps) == 1 {
+		info.Grayscale = true
+	} else {
+		info.Quant[1] = f.quant[f.comps[1].tq]
+		info.Subsample = f.subsampleRatio()
+		if info.Subsample < 0 {
+			info.Subsample = image.YCbCrSubsampleRatio420
+		}
+	}
+	info.Quality, info.Standard = estimateQuality(info.Quant, info.Grayscale)
+	return info, nil
+}
+
+// estimateQuality returns the quality whose standard tables differ least
+// from quant, and whether they are identical.
+func estimateQuality(quant [2][64]int32, grayscale bool) (int, bool) {
+	tables := 2
+	if grayscale {
+		tables = 1
+	}
+
+	best, bestDiff := 0, int32(-1)
+	for quality := 1; quality <= 100; quality++ {
+		standard := QuantTables(quality)
+		var diff int32
+		for t := 0; t < tables; t++ {
+			for i := range quant[t] {
+				d := quant[t][i] - standard[t][i]
+				diff += max(d, -d)
+			}
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = quality, diff
+		}
+	}
+	return best, bestDiff == 0
+}
@@ -0,0 +1,371 @@
+package jpegpatch
+
+import (
+	"fmt"
+	"slices"
+)
+
+// huffman is a Huffman table of the file, for decoding (ITU T.81, F.2.2.3)
+// and encoding with the same codes.
+type huffman struct {
+	values  []byte
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+
+	// code and size hold the code of every symbol; size 0 marks symbols
+	// the table cannot encode.
+	code [256]uint16
+	size [256]uint8
+}
+
+// newHuffman builds a table from the number of codes of each length (1 to
+// 16 bits) and the symbols in code order.
+func newHuffman(counts [16]int, values []byte) (*huffman, error) {
+	h := &huffman{values: slices.Clone(values)}
+	code, k := int32(0), int32(0)
+	for length := 1; length <= 16; length++ {
+		n := int32(counts[length-1])
+		h.valPtr[length] = k
+		h.minCode[length] = code
+		h.maxCode[length] = -1
+		if n > 0 {
+			h.maxCode[length] = code + n - 1
+		}
+		for i := int32(0); i < n; i++ {
+			symbol := values[k+i]
+			h.code[symbol] = uint16(code + i)
+			h.size[symbol] = uint8(length)
+		}
+		code += n
+		k += n
+		if code > 1<<length {
+			return nil, fmt.Errorf("%w: bad Huffman table", errFormat)
+		}
+		code <<= 1
+	}
+	return h, nil
+}
+
+// bitReader reads the unstuffed entropy-coded data of a segment.
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+}
+
+func (r *bitReader) bit() (int32, error) {
+	if r.pos >= 8*len(r.data) {
+		return 0, fmt.Errorf("%w: truncated scan", errFormat)
+	}
+	b := int32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return b, nil
+}
+
+func (r *bitReader) bits(n int) (int32, error) {
+	var v int32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// decode reads one symbol coded with h.
+func (r *bitReader) decode(h *huffman) (byte, error) {
+	code, err := r.bit()
+	if err != nil {
+		return 0, err
+	}
+	for length := 1; length <= 16; length++ {
+		if code <= h.maxCode[length] {
+			return h.values[h.valPtr[length]+code-h.minCode[length]], nil
+		}
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+	}
+	return 0, fmt.Errorf("%w: bad Huffman code", errFormat)
+}
+
+// receive reads an s-bit magnitude category value and extends its sign.
+func (r *bitReader) receive(s int) (int32, error) {
+	v, err := r.bits(s)
+	if err != nil || s == 0 {
+		return 0, err
+	}
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v, nil
+}
+
+// decodeScan decodes the coefficients of every block and records where
+// every MCU lies in the entropy-coded data.
+func (f *file) decodeScan(data []byte) error {
+	f.segments = splitSegments(data[f.scanStart:f.scanEnd])
+	segments := 1
+	if f.restart > 0 {
+		segments = (f.mcus + f.restart - 1) / f.restart
+	}
+	if len(f.segments) < segments {
+		return fmt.Errorf("%w: %d restart intervals, expected %d", errFormat, len(f.segments), segments)
+	}
+
+	f.mcuBits = make([][2]int, f.mcus)
+	f.dcAfter = make([][]int32, f.mcus)
+	pred := make([]int32, len(f.comps))
+	var r *bitReader
+	for m := 0; m < f.mcus; m++ {
+		if segment, first := f.segmentOf(m); first {
+			r = &bitReader{data: f.segments[segment]}
+			clear(pred)
+		}
+
+		start := r.pos
+		var err error
+		f.forEachBlock(m, func(c, bx, by int) {
+			if err != nil {
+				return
+			}
+			comp := &f.comps[c]
+			err = r.decodeBlock(&comp.coefs[by*comp.blocksW+bx], &pred[c], f.dc[comp.td], f.ac[comp.ta])
+		})
+		if err != nil {
+			return err
+		}
+		f.mcuBits[m] = [2]int{start, r.pos}
+		f.dcAfter[m] = slices.Clone(pred)
+	}
+	return nil
+}
+
+// decodeBlock reads the coefficients of one block (ITU T.81, F.2.2).
+func (r *bitReader) decodeBlock(block *[64]int32, pred *int32, dc, ac *huffman) error {
+	s, err := r.decode(dc)
+	if err != nil {
+		return err
+	}
+	if s > 11 {
+		return fmt.Errorf("%w: bad DC category", errFormat)
+	}
+	diff, err := r.receive(int(s))
+	if err != nil {
+		return err
+	}
+	*pred += diff
+	block[0] = *pred
+
+	for k := 1; k < 64; k++ {
+		rs, err := r.decode(ac)
+		if err != nil {
+			return err
+		}
+		run, size := int(rs>>4), int(rs&0x0F)
+		if size == 0 {
+			if run != 15 {
+				break // End of block
+			}
+			k += 15 // Run of 16 zeros
+			continue
+		}
+		k += run
+		if k > 63 {
+			return fmt.Errorf("%w: coefficient index out of range", errFormat)
+		}
+		v, err := r.receive(size)
+		if err != nil {
+			return err
+		}
+		block[unzig[k]] = v
+	}
+	return nil
+}
+
+// splitSegments splits entropy-coded data at its restart markers and
+// removes the byte stuffing.
+func splitSegments(data []byte) [][]byte {
+	var segments [][]byte
+	var current []byte
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			current = append(current, data[i])
+			continue
+		}
+		switch next := data[i+1]; {
+		case next == 0x00:
+			current = append(current, 0xFF)
+			i++
+		case next >= markerRST0 && next <= markerRST7:
+			segments = append(segments, current)
+			current = nil
+			i++
+		default:
+			// Fill bytes
+		}
+	}
+	return append(segments, current)
+}
+
+// bitWriter writes entropy-coded data with byte stuffing.
+type bitWriter struct {
+	out  []byte
+	acc  uint32
+	bits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.bits += n
+	for w.bits >= 8 {
+		w.bits -= 8
+		b := byte(w.acc >> w.bits)
+		w.out = append(w.out, b)
+		if b == 0xFF {
+			w.out = append(w.out, 0x00)
+		}
+	}
+}
+
+// copyBits appends the bits [start, end) of data.
+func (w *bitWriter) copyBits(data []byte, start, end int) {
+	for pos := start; pos < end; {
+		// Whole bytes where aligned, single bits otherwise
+		if pos%8 == 0 && end-pos >= 8 {
+			w.write(uint32(data[pos/8]), 8)
+			pos += 8
+			continue
+		}
+		w.write(uint32(data[pos/8]>>(7-pos%8))&1, 1)
+		pos++
+	}
+}
+
+// pad fills the last byte with one bits, as required before a marker.
+func (w *bitWriter) pad() {
+	if w.bits > 0 {
+		w.write(1<<(8-w.bits)-1, 8-w.bits)
+	}
+}
+
+// encodeBlock writes the coefficients of one block with the given tables
+// (ITU T.81, F.1.2).
+func (w *bitWriter) encodeBlock(block *[64]int32, pred *int32, dc, ac *huffman) error {
+	diff := block[0] - *pred
+	*pred = block[0]
+	if err := w.emit(dc, byte(category(diff))); err != nil {
+		return err
+	}
+	w.magnitude(diff)
+
+	run := 0
+	for k := 1; k < 64; k++ {
+		v := block[unzig[k]]
+		if v == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			if err := w.emit(ac, 0xF0); err != nil {
+				return err
+			}
+		}
+		if err := w.emit(ac, byte(run<<4|category(v))); err != nil {
+			return err
+		}
+		w.magnitude(v)
+		run = 0
+	}
+	if run > 0 {
+		return w.emit(ac, 0x00)
+	}
+	return nil
+}
+
+// emit writes the code of a symbol.
+func (w *bitWriter) emit(h *huffman, symbol byte) error {
+	if h.size[symbol] == 0 {
+		return fmt.Errorf("%w: Huffman table has no code for symbol %#02x", ErrUnsupported, symbol)
+	}
+	w.write(uint32(h.code[symbol]), uint(h.size[symbol]))
+	return nil
+}
+
+// magnitude writes the low bits identifying v within its category.
+func (w *bitWriter) magnitude(v int32) {
+	n := category(v)
+	if v < 0 {
+		v--
+	}
+	w.write(uint32(v), uint(n))
+}
+
+// category returns the number of bits of the magnitude of v.
+func category(v int32) int {
+	if v < 0 {
+		v = -v
+	}
+	n := 0
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// encodeScan writes the entropy-coded data of the patched file. MCUs marked
+// in changed, and MCUs whose DC prediction differs from the file's, are
+// encoded from their coefficients; all others are copied bit for bit.
+func (f *file) encodeScan(changed []bool) ([]byte, Stats, error) {
+	w := &bitWriter{}
+	stats := Stats{MCUs: f.mcus}
+	pred := make([]int32, len(f.comps))
+	for m := 0; m < f.mcus; m++ {
+		segment, first := f.segmentOf(m)
+		if first {
+			if m > 0 {
+				w.pad()
+				w.out = append(w.out, 0xFF, byte(markerRST0+(segment-1)%8))
+			}
+			clear(pred)
+		}
+		if changed[m] {
+			stats.Changed++
+		} else if f.samePrediction(m, first, pred) {
+			bits := f.mcuBits[m]
+			w.copyBits(f.segments[segment], bits[0], bits[1])
+			copy(pred, f.dcAfter[m])
+			continue
+		}
+
+		stats.Reencoded++
+		var err error
+		f.forEachBlock(m, func(c, bx, by int) {
+			if err != nil {
+				return
+			}
+			comp := &f.comps[c]
+			err = w.encodeBlock(&comp.coefs[by*comp.blocksW+bx], &pred[c], f.dc[comp.td], f.ac[comp.ta])
+		})
+		if err != nil {
+			return nil, Stats{}, err
+		}
+	}
+	w.pad()
+	return w.out, stats, nil
+}
+
+// samePrediction reports whether pred is the DC prediction the file's own
+// coding of MCU m relies on, so that its bits can be copied.
+func (f *file) samePrediction(m int, first bool, pred []int32) bool {
+	for c := range pred {
+		if first && pred[c] != 0 || !first && pred[c] != f.dcAfter[m-1][c] {
+			return false
+		}
+	}
+	return true
+}
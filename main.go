@@ -6,6 +6,8 @@
 // Usage:
 //
 //	gemini-watermark-remover [options] <files|directories|globs>...
+//	gemini-watermark-remover calibrate [options]
+//	gemini-watermark-remover estimate [options] <files|directories|globs>...
 //
 // Examples:
 //
@@ -18,13 +20,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/draw"
 	"image/png"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gemini-watermark-remover/watermark"
@@ -40,9 +45,108 @@ var (
 
 	// quiet suppresses all output except errors
 	quiet bool
+
+	// force removes the watermark even when detection finds no evidence of it
+	force bool
+
+	// searchMode selects how the watermark position is determined:
+	// "fixed" uses the expected position, "local" searches around it and
+	// "full" scans the whole image for any number of watermarks
+	searchMode string
+
+	// searchRadius is the window size (in pixels) used by the local search
+	searchRadius int
+
+	// findThreshold is the minimum confidence for matches of the full search
+	findThreshold float64
+
+	// multiScale also searches for watermarks in resized images
+	multiScale bool
+
+	// fitBlend fits the watermark opacity and logo color to each image
+	// before removing it
+	fitBlend bool
+
+	// inpaintFallback fills pixels the reverse blend cannot restore
+	// reliably by inpainting
+	inpaintFallback bool
+
+	// regularization is the strength of the regularized inversion; 0
+	// inverts the blend exactly
+	regularization float64
+
+	// strategyName selects how watermarked pixels are restored: "reverse"
+	// inverts the blend, "inpaint" synthesizes them from their surroundings
+	strategyName string
+
+	// jpegPatch rewrites only the JPEG blocks covering the watermark instead
+	// of re-encoding the whole image
+	jpegPatch bool
+
+	// jpegQuality overrides the quality of re-encoded JPEG outputs; 0 keeps
+	// the quantization tables of the source
+	jpegQuality int
+
+	// profilePaths lists profile bundle files or directories to load in
+	// addition to the built-in watermark profiles
+	profilePaths stringList
+
+	// useProfiles restricts detection to the named profiles; empty uses
+	// every profile
+	useProfiles stringList
+
+	// alphaThreshold is the minimum alpha of the pixels that are restored
+	alphaThreshold float64
+
+	// maxAlpha is the largest alpha the blend is inverted with
+	maxAlpha float64
+
+	// clampName selects how pixels above maxAlpha are restored: "clamp"
+	// inverts them with maxAlpha, "skip" leaves them unchanged
+	clampName string
+
+	// logoColor overrides the logo color of the built-in profiles as
+	// "R,G,B"; empty keeps white
+	logoColor string
 )
 
+// stringList is a flag.Value that collects every occurrence of a repeatable
+// flag.
+type stringList []string
+
+// String returns the collected values separated by commas.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a value.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// errNoWatermark is returned by processImage when an image does not match the
+// watermark signature and was therefore left untouched.
+var errNoWatermark = errors.New("no watermark detected")
+
 func main() {
+	// Subcommands take their own flags
+	subcommands := map[string]func([]string) error{
+		"calibrate": runCalibrate,
+		"estimate":  runEstimate,
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				if !errors.Is(err, flag.ErrHelp) {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Define command-line flags with both short and long versions
 	flag.StringVar(&suffix, "s", "_clean", "Suffix to append to output filename")
 	flag.StringVar(&suffix, "suffix", "_clean", "Suffix to append to output filename")
@@ -50,13 +154,33 @@ func main() {
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose output")
 	flag.BoolVar(&quiet, "q", false, "Suppress all output except errors")
 	flag.BoolVar(&quiet, "quiet", false, "Suppress all output except errors")
+	flag.BoolVar(&force, "f", false, "Remove the watermark even if it is not detected")
+	flag.BoolVar(&force, "force", false, "Remove the watermark even if it is not detected")
+	flag.StringVar(&searchMode, "search", "fixed", "Watermark position search: fixed, local or full")
+	flag.IntVar(&searchRadius, "search-radius", 8, "Search window in pixels around the expected position (local search)")
+	flag.Float64Var(&findThreshold, "threshold", watermark.DefaultFindThreshold, "Minimum match confidence (full search)")
+	flag.BoolVar(&multiScale, "multiscale", false, "Also detect watermarks in resized images (fixed and local search)")
+	flag.BoolVar(&fitBlend, "fit", false, "Fit the watermark opacity and logo color to each image before removal")
+	flag.BoolVar(&inpaintFallback, "inpaint-fallback", false, "Inpaint saturated and high-alpha pixels the reverse blend cannot restore reliably")
+	flag.Float64Var(&regularization, "regularize", 0, "Regularized inversion strength; suppresses noise amplified under the logo (0 = exact)")
+	flag.StringVar(&strategyName, "strategy", "reverse", "Restoration strategy: reverse (invert the blend) or inpaint (synthesize texture)")
+	flag.BoolVar(&jpegPatch, "jpeg-patch", false, "Re-encode only the JPEG blocks covering the watermark, keeping the rest bit-identical")
+	flag.IntVar(&jpegQuality, "jpeg-quality", 0, "JPEG output quality (1-100); 0 matches the source's quantization tables")
+	flag.Var(&profilePaths, "profiles", "Profile bundle (JSON descriptor) or directory of bundles to load (repeatable)")
+	flag.Var(&useProfiles, "use-profile", "Only detect the named watermark profile (repeatable)")
+	flag.Float64Var(&alphaThreshold, "alpha-threshold", watermark.AlphaThreshold, "Minimum watermark alpha of the pixels to restore (positive, below --max-alpha)")
+	flag.Float64Var(&maxAlpha, "max-alpha", watermark.MaxAlpha, "Largest watermark alpha to invert the blend with (below 1)")
+	flag.StringVar(&clampName, "clamp", "clamp", "Pixels above --max-alpha: clamp (invert with --max-alpha) or skip (leave unchanged)")
+	flag.StringVar(&logoColor, "logo-color", "", "Logo color of the built-in profiles as R,G,B (default white)")
 
 	// Custom usage message
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Gemini Watermark Remover\n\n")
 		fmt.Fprintf(os.Stderr, "Removes the Gemini AI watermark from generated images using\n")
 		fmt.Fprintf(os.Stderr, "reverse alpha blending.\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <files|directories|globs>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <files|directories|globs>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s calibrate [options]  # Fit a profile to reference captures\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s estimate [options] <files|directories|globs>...  # Estimate a profile from watermarked images\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -67,6 +191,18 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s \"*.png\"                      # Process all PNG files (glob)\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s \"photos/*.jpg\" ./other/      # Mix glob and directory\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -v ./images/                 # Verbose mode\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f image.png                 # Skip detection, always remove\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --search local cropped.png   # Find a shifted watermark\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --search full collage.png    # Find watermarks anywhere\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --multiscale resized.png     # Handle downscaled/upscaled images\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --profiles ./variants/ a.png # Load extra watermark profiles\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --fit -v shifted.png         # Fit opacity and logo color per image\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --regularize 0.2 photo.jpg    # Suppress amplified JPEG noise\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --strategy inpaint noisy.jpg # Synthesize texture instead of inverting\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --jpeg-patch photo.jpg       # Leave JPEG blocks outside the watermark untouched\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --jpeg-quality 85 photo.jpg   # Re-encode JPEGs at a fixed quality\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --max-alpha 0.9 --clamp skip a.png # Leave nearly opaque logo pixels alone\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --use-profile gemini-96 a.png # Only look for the large watermark\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -77,13 +213,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := validateSearchFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if regularization < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --regularize %g (must not be negative)\n", regularization)
+		os.Exit(1)
+	}
+	if jpegQuality < 0 || jpegQuality > 100 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --jpeg-quality %d (must be 1-100, or 0 to match the source)\n", jpegQuality)
+		os.Exit(1)
+	}
+	if jpegQuality > 0 && jpegPatch {
+		fmt.Fprintf(os.Stderr, "Error: --jpeg-quality cannot be combined with --jpeg-patch, which keeps the source's tables\n")
+		os.Exit(1)
+	}
+	options, err := engineOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Initialize the watermark removal engine.
-	// This loads and pre-processes the reference watermark images.
-	engine, err := watermark.NewEngine()
+	// This loads and pre-processes the reference watermark images,
+	// including any external profile bundles.
+	engine, err := watermark.NewEngine(options...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing engine: %v\n", err)
 		os.Exit(1)
 	}
+	if verbose {
+		for _, profile := range engine.Profiles() {
+			fmt.Printf("Profile %s: %s, logo color %v\n", profile.Name, profile.Config(), profile.LogoColor)
+		}
+		fmt.Printf("Alpha limits: threshold %g, maximum %g (%s above)\n", engine.AlphaThreshold(), engine.MaxAlpha(), engine.ClampMode())
+	}
 
 	// Build list of files to process from all arguments
 	var files []string
@@ -135,12 +300,19 @@ func main() {
 		fmt.Printf("Found %d image(s) to process\n", len(files))
 	}
 
-	// Process each file and track success count
+	// Process each file and track success, skip and failure counts
 	successCount := 0
+	skippedCount := 0
+	failedCount := 0
 	for _, file := range files {
 		err := processImage(engine, file)
+		if errors.Is(err, errNoWatermark) {
+			skippedCount++
+			continue
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", file, err)
+			failedCount++
 			continue
 		}
 		successCount++
@@ -148,8 +320,64 @@ func main() {
 
 	// Print summary
 	if !quiet {
-		fmt.Printf("Successfully processed %d/%d image(s)\n", successCount, len(files))
+		fmt.Printf("Processed %d, skipped %d (no watermark), failed %d\n", successCount, skippedCount, failedCount)
+		if skippedCount > 0 {
+			fmt.Println("Use --force to process images without a detectable watermark")
+		}
+	}
+}
+
+// engineOptions converts the command-line flags into engine options. The
+// engine validates their ranges; engineOptions only parses the flags that
+// take names or lists.
+func engineOptions() ([]watermark.Option, error) {
+	strategy, err := watermark.ParseStrategy(strategyName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --strategy: %w", err)
+	}
+	clamp, err := watermark.ParseClampMode(clampName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --clamp: %w", err)
+	}
+
+	options := []watermark.Option{
+		watermark.WithProfilePaths(profilePaths...),
+		watermark.WithStrategy(strategy),
+		watermark.WithInpaintFallback(inpaintFallback),
+		watermark.WithRegularization(regularization),
+		watermark.WithAlphaThreshold(alphaThreshold),
+		watermark.WithMaxAlpha(maxAlpha),
+		watermark.WithClampMode(clamp),
 	}
+	if len(useProfiles) > 0 {
+		options = append(options, watermark.WithProfiles(useProfiles...))
+	}
+	if logoColor != "" {
+		color, err := parseLogoColor(logoColor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --logo-color: %w", err)
+		}
+		options = append(options, watermark.WithLogoColor(color))
+	}
+	return options, nil
+}
+
+// parseLogoColor parses a color given as "R,G,B" with channels on the
+// 0-255 scale.
+func parseLogoColor(value string) ([3]float64, error) {
+	var color [3]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return color, fmt.Errorf("%q is not R,G,B", value)
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || v < 0 || v > 255 {
+			return color, fmt.Errorf("%q is not a channel value in [0, 255]", part)
+		}
+		color[i] = v
+	}
+	return color, nil
 }
 
 // isGlobPattern checks if the input string contains glob metacharacters.
@@ -235,37 +463,85 @@ func findImageFiles(dir string) ([]string, error) {
 }
 
 // processImage loads an image, removes the watermark, and saves the result.
+// Images that do not match the watermark signature are left untouched and
+// errNoWatermark is returned, unless the force flag is set.
 // The output filename is the same as input with the suffix appended before
 // the extension (e.g., "photo.png" -> "photo_clean.png").
 //
 // The output format matches the input format:
 //   - PNG input produces PNG output (lossless)
-//   - JPEG input produces JPEG output (95% quality)
+//   - JPEG input produces JPEG output re-encoded with the source's
+//     quantization tables and chroma subsampling, or at --jpeg-quality if
+//     given; with --jpeg-patch only the blocks covering the watermark are
+//     re-encoded. Sources whose encoding cannot be read are written at
+//     quality 95 (see writeJPEG).
 func processImage(engine *watermark.Engine, inputPath string) error {
-	// Open the input file
-	file, err := os.Open(inputPath)
+	// Read the input file; JPEG patching needs the original bytes
+	data, err := os.ReadFile(inputPath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
 
 	// Decode the image. The format is automatically detected from the header.
 	// Supported formats: PNG, JPEG (registered via image/png and image/jpeg imports)
-	img, format, err := image.Decode(file)
+	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("failed to decode image: %w", err)
 	}
 
+	// Check that the image actually carries the watermark before touching it
+	detections := detectWatermarks(engine, img)
+
 	// In verbose mode, display watermark detection information
 	if verbose {
 		bounds := img.Bounds()
-		config, pos := watermark.GetWatermarkInfo(bounds.Dx(), bounds.Dy())
 		fmt.Printf("Processing: %s (%dx%d, format: %s)\n", inputPath, bounds.Dx(), bounds.Dy(), format)
-		fmt.Printf("  Watermark: %dx%d at position (%d, %d)\n", config.Size, config.Size, pos.Min.X, pos.Min.Y)
+		if len(detections) == 0 {
+			fmt.Printf("  Watermark: none found\n")
+		}
+		for _, detection := range detections {
+			printDetection(detection)
+		}
 	}
 
-	// Remove the watermark using reverse alpha blending
-	result := engine.RemoveWatermark(img)
+	if len(detections) == 0 || !detections[0].Detected {
+		if !force {
+			if !quiet {
+				confidence := 0.0
+				if len(detections) > 0 {
+					confidence = detections[0].Confidence
+				}
+				fmt.Printf("Skipping %s (no watermark detected, confidence %.2f)\n", inputPath, confidence)
+			}
+			return errNoWatermark
+		}
+
+		// A full search found nothing; fall back to the expected position
+		if len(detections) == 0 {
+			detections = []watermark.Detection{engine.Detect(img)}
+		}
+	}
+
+	// Adjust the blend parameters to the image if requested
+	if fitBlend {
+		for i := range detections {
+			detections[i] = engine.FitBlend(img, detections[i])
+			if fit := detections[i].Fit; verbose && fit != nil {
+				fmt.Printf("  Blend fit: gain %.3f, logo color (%.1f, %.1f, %.1f)\n",
+					fit.Gain, fit.LogoColor[0], fit.LogoColor[1], fit.LogoColor[2])
+			}
+		}
+	}
+
+	// Remove the watermark(s) using reverse alpha blending. The decoded
+	// image is not needed afterwards, so images that can be modified are
+	// restored in place instead of copied.
+	var result image.Image = img
+	if dst, ok := img.(draw.Image); ok {
+		engine.RemoveInPlace(dst, detections)
+	} else {
+		result = engine.RemoveAll(img, detections)
+	}
 
 	// Generate output path with suffix
 	outputPath := generateOutputPath(inputPath, suffix)
@@ -278,12 +554,15 @@ func processImage(engine *watermark.Engine, inputPath string) error {
 	defer outFile.Close()
 
 	// Encode in the same format as input to preserve quality characteristics.
-	// PNG remains lossless, JPEG uses high quality (95%).
+	// PNG remains lossless, JPEG keeps the source's tables and subsampling
+	// (or --jpeg-quality) or is patched in place.
+	// The result keeps the image type of the source (grayscale, paletted,
+	// alpha, 16-bit), so png.Encode writes the same color type and depth.
 	switch format {
 	case "png":
 		err = png.Encode(outFile, result)
 	case "jpeg":
-		err = jpeg.Encode(outFile, result, &jpeg.Options{Quality: 95})
+		err = writeJPEG(outFile, data, result)
 	default:
 		// Unknown format - default to PNG for safety (lossless)
 		err = png.Encode(outFile, result)
@@ -300,6 +579,64 @@ func processImage(engine *watermark.Engine, inputPath string) error {
 	return nil
 }
 
+// validateSearchFlags checks the values of the --search, --search-radius,
+// --threshold and --multiscale flags.
+func validateSearchFlags() error {
+	switch searchMode {
+	case "fixed", "local", "full":
+	default:
+		return fmt.Errorf("invalid --search mode %q (expected fixed, local or full)", searchMode)
+	}
+	if searchRadius < 0 {
+		return fmt.Errorf("invalid --search-radius %d (must not be negative)", searchRadius)
+	}
+	if findThreshold <= 0 || findThreshold > 1 {
+		return fmt.Errorf("invalid --threshold %g (must be in (0, 1])", findThreshold)
+	}
+	if multiScale && searchMode == "full" {
+		return fmt.Errorf("--multiscale cannot be combined with --search full")
+	}
+	return nil
+}
+
+// detectWatermarks runs the detection method selected by the --search flag.
+// Fixed and local searches return exactly one detection, which may have
+// Detected set to false; a full search returns only the matches it found.
+func detectWatermarks(engine *watermark.Engine, img image.Image) []watermark.Detection {
+	if multiScale {
+		// Resizing rounds the watermark position, so even the fixed mode
+		// needs a small search window
+		radius := 2
+		if searchMode == "local" {
+			radius = searchRadius
+		}
+		return []watermark.Detection{engine.DetectScaled(img, watermark.DefaultScales, radius)}
+	}
+
+	switch searchMode {
+	case "local":
+		return []watermark.Detection{engine.DetectNear(img, searchRadius)}
+	case "full":
+		return engine.FindAll(img, findThreshold)
+	default:
+		return []watermark.Detection{engine.Detect(img)}
+	}
+}
+
+// printDetection prints the details of a detection in verbose mode.
+func printDetection(detection watermark.Detection) {
+	config, pos := detection.Config, detection.Region
+	fmt.Printf("  Watermark: %s, %dx%d at position (%.1f, %.1f), scale %.3f, selected by %s\n",
+		detection.Profile, config.Size, config.Size,
+		float64(pos.Min.X)+detection.OffsetX, float64(pos.Min.Y)+detection.OffsetY,
+		detection.Scale, detection.Selection)
+	for _, score := range detection.Scores {
+		fmt.Printf("  Candidate %s (%s): confidence=%.3f at (%d, %d), scale %.3f\n",
+			score.Profile, score.Config, score.Confidence, score.Region.Min.X, score.Region.Min.Y, score.Scale)
+	}
+	fmt.Printf("  Detection: detected=%v, confidence=%.3f\n", detection.Detected, detection.Confidence)
+}
+
 // generateOutputPath creates the output filename by inserting a suffix
 // before the file extension.
 //
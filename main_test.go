@@ -1,12 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"gemini-watermark-remover/jpegpatch"
+	"gemini-watermark-remover/watermark"
 )
 
+// writeTestPNG writes a solid-color PNG to path for use as processImage input.
+func writeTestPNG(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 100, G: 150, B: 200, A: 255})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create test image: %v", err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+}
+
 func TestIsGlobPattern(t *testing.T) {
 	testCases := []struct {
 		input    string
@@ -299,3 +331,373 @@ func TestExpandGlob_SkipsDirectories(t *testing.T) {
 		t.Errorf("expandGlob returned %d files, expected 1 (should skip directory)", len(files))
 	}
 }
+
+func TestProcessImage_SkipsImageWithoutWatermark(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "plain.png")
+	writeTestPNG(t, inputPath, 200, 200)
+
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Save original flags and silence output
+	originalForce, originalQuiet, originalSuffix := force, quiet, suffix
+	force, quiet, suffix = false, true, "_clean"
+	defer func() { force, quiet, suffix = originalForce, originalQuiet, originalSuffix }()
+
+	err = processImage(engine, inputPath)
+	if !errors.Is(err, errNoWatermark) {
+		t.Fatalf("processImage on clean image: expected errNoWatermark, got %v", err)
+	}
+
+	outputPath := generateOutputPath(inputPath, suffix)
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("output file %s should not be written for a skipped image", outputPath)
+	}
+}
+
+func TestProcessImage_ForceProcessesImageWithoutWatermark(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "plain.png")
+	writeTestPNG(t, inputPath, 200, 200)
+
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Save original flags and silence output
+	originalForce, originalQuiet, originalSuffix := force, quiet, suffix
+	force, quiet, suffix = true, true, "_clean"
+	defer func() { force, quiet, suffix = originalForce, originalQuiet, originalSuffix }()
+
+	if err := processImage(engine, inputPath); err != nil {
+		t.Fatalf("processImage with force: unexpected error %v", err)
+	}
+
+	outputPath := generateOutputPath(inputPath, suffix)
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("output file %s should exist when forced: %v", outputPath, err)
+	}
+}
+
+func TestProcessImage_JPEGPatchKeepsOtherBlocks(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "photo.jpg")
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x / 2), G: uint8(y), B: 180, A: 255})
+		}
+	}
+	f, err := os.Create(inputPath)
+	if err != nil {
+		t.Fatalf("Failed to create test image: %v", err)
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	f.Close()
+
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Save original flags and silence output
+	originalForce, originalQuiet, originalSuffix, originalPatch := force, quiet, suffix, jpegPatch
+	force, quiet, suffix, jpegPatch = true, true, "_clean", true
+	defer func() { force, quiet, suffix, jpegPatch = originalForce, originalQuiet, originalSuffix, originalPatch }()
+
+	if err := processImage(engine, inputPath); err != nil {
+		t.Fatalf("processImage with --jpeg-patch: unexpected error %v", err)
+	}
+
+	decodeFile := func(path string) image.Image {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", path, err)
+		}
+		defer f.Close()
+		img, err := jpeg.Decode(f)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %v", path, err)
+		}
+		return img
+	}
+	source := decodeFile(inputPath)
+	result := decodeFile(generateOutputPath(inputPath, suffix))
+
+	// The watermark sits in the bottom-right corner; the MCUs above it
+	// must decode exactly as before
+	for y := 0; y < 160; y++ {
+		for x := 0; x < 320; x++ {
+			if source.At(x, y) != result.At(x, y) {
+				t.Fatalf("pixel (%d,%d) outside the watermark changed", x, y)
+			}
+		}
+	}
+}
+
+func TestProcessImage_Keeps16BitPNG(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "deep.png")
+	img := image.NewRGBA64(image.Rect(0, 0, 200, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{R: uint16(300 * x), G: uint16(250 * y), B: 40000, A: 0xFFFF})
+		}
+	}
+	f, err := os.Create(inputPath)
+	if err != nil {
+		t.Fatalf("Failed to create test image: %v", err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	f.Close()
+
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Save original flags and silence output
+	originalForce, originalQuiet, originalSuffix := force, quiet, suffix
+	force, quiet, suffix = true, true, "_clean"
+	defer func() { force, quiet, suffix = originalForce, originalQuiet, originalSuffix }()
+
+	if err := processImage(engine, inputPath); err != nil {
+		t.Fatalf("processImage: unexpected error %v", err)
+	}
+
+	out, err := os.Open(generateOutputPath(inputPath, suffix))
+	if err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	defer out.Close()
+	result, err := png.Decode(out)
+	if err != nil {
+		t.Fatalf("Failed to decode output: %v", err)
+	}
+	if _, ok := result.(*image.RGBA64); !ok {
+		t.Fatalf("expected a 16-bit PNG, decoded as %T", result)
+	}
+	if result.At(7, 9) != img.At(7, 9) {
+		t.Error("16-bit pixel outside the watermark changed")
+	}
+}
+
+func TestProcessImage_KeepsPNGColorType(t *testing.T) {
+	engine, err := watermark.NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Save original flags and silence output
+	originalForce, originalQuiet, originalSuffix := force, quiet, suffix
+	force, quiet, suffix = true, true, "_clean"
+	defer func() { force, quiet, suffix = originalForce, originalQuiet, originalSuffix }()
+
+	bounds := image.Rect(0, 0, 200, 200)
+	gray := image.NewGray(bounds)
+	paletted := image.NewPaletted(bounds, color.Palette{color.Black, color.White, color.RGBA{R: 200, G: 80, B: 40, A: 255}})
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			gray.SetGray(x, y, color.Gray{Y: uint8(x + y/4)})
+			paletted.SetColorIndex(x, y, uint8((x/10+y/10)%3))
+		}
+	}
+
+	for _, img := range []image.Image{gray, paletted} {
+		inputPath := filepath.Join(t.TempDir(), "input.png")
+		f, err := os.Create(inputPath)
+		if err != nil {
+			t.Fatalf("Failed to create test image: %v", err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatalf("Failed to encode test image: %v", err)
+		}
+		f.Close()
+
+		if err := processImage(engine, inputPath); err != nil {
+			t.Fatalf("processImage: unexpected error %v", err)
+		}
+		out, err := os.Open(generateOutputPath(inputPath, suffix))
+		if err != nil {
+			t.Fatalf("Failed to open output: %v", err)
+		}
+		result, err := png.Decode(out)
+		out.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode output: %v", err)
+		}
+		if got, want := fmt.Sprintf("%T", result), fmt.Sprintf("%T", img); got != want {
+			t.Errorf("output decoded as %s, expected %s", got, want)
+		}
+	}
+}
+
+func TestWriteJPEG_MatchesSource(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(2 * x), G: uint8(3 * y), B: 90, A: 255})
+		}
+	}
+	var source bytes.Buffer
+	options := &jpegpatch.Options{Quant: jpegpatch.QuantTables(60), Subsample: image.YCbCrSubsampleRatio422}
+	if err := jpegpatch.Encode(&source, img, options); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	originalQuality, originalQuiet := jpegQuality, quiet
+	defer func() { jpegQuality, quiet = originalQuality, originalQuiet }()
+	quiet = true
+
+	testCases := []struct {
+		override int
+		expected int
+	}{
+		{0, 60},  // Match the source
+		{85, 85}, // --jpeg-quality
+	}
+	for _, tc := range testCases {
+		jpegQuality = tc.override
+		var out bytes.Buffer
+		if err := writeJPEG(&out, source.Bytes(), img); err != nil {
+			t.Fatalf("writeJPEG() error: %v", err)
+		}
+		info, err := jpegpatch.Inspect(out.Bytes())
+		if err != nil {
+			t.Fatalf("Inspect() error: %v", err)
+		}
+		if info.Quality != tc.expected || info.Subsample != image.YCbCrSubsampleRatio422 {
+			t.Errorf("--jpeg-quality %d: output quality %d, %v", tc.override, info.Quality, info.Subsample)
+		}
+	}
+}
+
+func TestDescribeLayout(t *testing.T) {
+	if got := describeLayout(jpegpatch.Info{Subsample: image.YCbCrSubsampleRatio420}); got != "Y'CbCr 4:2:0" {
+		t.Errorf("describeLayout(4:2:0) = %q", got)
+	}
+	if got := describeLayout(jpegpatch.Info{Grayscale: true}); got != "grayscale" {
+		t.Errorf("describeLayout(gray) = %q", got)
+	}
+}
+
+func TestValidateSearchFlags(t *testing.T) {
+	testCases := []struct {
+		mode       string
+		radius     int
+		threshold  float64
+		multiScale bool
+		expected   bool // true if valid
+	}{
+		{"fixed", 8, 0.6, false, true},
+		{"local", 8, 0.6, false, true},
+		{"local", 0, 0.6, false, true},
+		{"full", 8, 0.6, false, true},
+		{"full", 8, 1, false, true},
+		{"fixed", 8, 0.6, true, true},
+		{"local", 8, 0.6, true, true},
+		{"full", 8, 0.6, true, false},
+		{"local", -1, 0.6, false, false},
+		{"full", 8, 0, false, false},
+		{"full", 8, 1.5, false, false},
+		{"everywhere", 8, 0.6, false, false},
+		{"", 8, 0.6, false, false},
+	}
+
+	// Save original flags
+	originalMode, originalRadius, originalThreshold, originalMultiScale := searchMode, searchRadius, findThreshold, multiScale
+	defer func() {
+		searchMode, searchRadius, findThreshold, multiScale = originalMode, originalRadius, originalThreshold, originalMultiScale
+	}()
+
+	for _, tc := range testCases {
+		searchMode, searchRadius, findThreshold, multiScale = tc.mode, tc.radius, tc.threshold, tc.multiScale
+		err := validateSearchFlags()
+		if (err == nil) != tc.expected {
+			t.Errorf("validateSearchFlags() with mode %q, radius %d, threshold %g, multiscale %v: error = %v, expected valid=%v",
+				tc.mode, tc.radius, tc.threshold, tc.multiScale, err, tc.expected)
+		}
+	}
+}
+
+func TestStringList(t *testing.T) {
+	var list stringList
+	for _, value := range []string{"profiles/", "extra.json"} {
+		if err := list.Set(value); err != nil {
+			t.Fatalf("Set(%q) error: %v", value, err)
+		}
+	}
+
+	if len(list) != 2 || list[0] != "profiles/" || list[1] != "extra.json" {
+		t.Errorf("unexpected values %v", []string(list))
+	}
+	if got := list.String(); got != "profiles/,extra.json" {
+		t.Errorf("String() = %q, expected %q", got, "profiles/,extra.json")
+	}
+}
+
+func TestParseLogoColor(t *testing.T) {
+	color, err := parseLogoColor("250, 248,240.5")
+	if err != nil {
+		t.Fatalf("parseLogoColor() error: %v", err)
+	}
+	if color != [3]float64{250, 248, 240.5} {
+		t.Errorf("parseLogoColor() = %v", color)
+	}
+
+	for _, value := range []string{"", "255,255", "255,255,255,255", "255,white,255", "255,256,255", "-1,0,0"} {
+		if _, err := parseLogoColor(value); err == nil {
+			t.Errorf("parseLogoColor(%q): expected an error", value)
+		}
+	}
+}
+
+func TestEngineOptions(t *testing.T) {
+	// Save original flags
+	originalStrategy, originalProfiles, originalThreshold, originalMax, originalClamp, originalColor :=
+		strategyName, useProfiles, alphaThreshold, maxAlpha, clampName, logoColor
+	defer func() {
+		strategyName, useProfiles, alphaThreshold, maxAlpha, clampName, logoColor =
+			originalStrategy, originalProfiles, originalThreshold, originalMax, originalClamp, originalColor
+	}()
+
+	profiles, err := watermark.DefaultProfiles()
+	if err != nil {
+		t.Fatalf("DefaultProfiles() error: %v", err)
+	}
+	strategyName, useProfiles, alphaThreshold, maxAlpha, clampName, logoColor =
+		"reverse", stringList{profiles[0].Name}, 0.01, 0.9, "skip", "240,240,240"
+	options, err := engineOptions()
+	if err != nil {
+		t.Fatalf("engineOptions() error: %v", err)
+	}
+	engine, err := watermark.NewEngine(options...)
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.AlphaThreshold() != 0.01 || engine.MaxAlpha() != 0.9 || engine.ClampMode() != watermark.SkipAboveMax {
+		t.Errorf("limits: threshold %g, maximum %g, clamp %v", engine.AlphaThreshold(), engine.MaxAlpha(), engine.ClampMode())
+	}
+	registered := engine.Profiles()
+	if len(registered) != 1 || registered[0].Name != profiles[0].Name {
+		t.Fatalf("registered %d profiles, expected only %s", len(registered), profiles[0].Name)
+	}
+	if registered[0].LogoColor != [3]float64{240, 240, 240} {
+		t.Errorf("logo color %v, expected 240,240,240", registered[0].LogoColor)
+	}
+
+	for _, tc := range []struct{ clamp, color string }{{"saturate", ""}, {"clamp", "white"}} {
+		clampName, logoColor = tc.clamp, tc.color
+		if _, err := engineOptions(); err == nil {
+			t.Errorf("engineOptions() with --clamp %q --logo-color %q: expected an error", tc.clamp, tc.color)
+		}
+	}
+}
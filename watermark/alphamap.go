@@ -58,3 +58,36 @@ func CalculateAlphaMap(img image.Image) []float32 {
 
 	return alphaMap
 }
+
+// CalculateAlphaMapForLogo extracts alpha values from a reference image of a
+// watermark with the given logo color on a pure black background.
+//
+// On black, each channel of a watermark pixel equals alpha * logo, so the
+// brightest channel divided by the brightest logo channel recovers alpha.
+// Unlike CalculateAlphaMap it reads the full 16-bit channel values, so 16-bit
+// references (as written by SaveProfile) keep their precision; for an 8-bit
+// reference and a white logo the result matches CalculateAlphaMap. Values are
+// clamped to [0.0, 1.0]; a black logo carries no alpha information and yields
+// zeros.
+func CalculateAlphaMapForLogo(img image.Image, logo [3]float64) []float32 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	alphaMap := make([]float32, width*height)
+
+	logoMax := max(logo[0], logo[1], logo[2])
+	if logoMax <= 0 {
+		return alphaMap
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			// Scale the 16-bit maximum to the [0, 255] range of the logo
+			maxChannel := float64(max(r, g, b)) / 257
+			alphaMap[y*width+x] = float32(clamp(maxChannel/logoMax, 0, 1))
+		}
+	}
+
+	return alphaMap
+}
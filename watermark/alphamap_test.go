@@ -3,6 +3,7 @@ package watermark
 import (
 	"image"
 	"image/color"
+	"math"
 	"testing"
 )
 
@@ -131,3 +132,31 @@ func TestCalculateAlphaMap_RowMajorOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestCalculateAlphaMapForLogo(t *testing.T) {
+	logo := [3]float64{200, 100, 50}
+
+	testCases := []struct {
+		c        color.RGBA
+		expected float32
+	}{
+		{color.RGBA{A: 255}, 0},
+		{color.RGBA{R: 100, G: 50, B: 25, A: 255}, 0.5},
+		{color.RGBA{R: 200, G: 100, B: 50, A: 255}, 1},
+		{color.RGBA{R: 255, G: 255, B: 255, A: 255}, 1}, // clamped
+	}
+
+	for _, tc := range testCases {
+		alphaMap := CalculateAlphaMapForLogo(createTestImage(2, 2, tc.c), logo)
+		if alphaMap[0] != tc.expected {
+			t.Errorf("color %v: expected alpha %f, got %f", tc.c, tc.expected, alphaMap[0])
+		}
+	}
+
+	// A white logo matches CalculateAlphaMap
+	gray := createTestImage(2, 2, color.RGBA{R: 90, G: 128, B: 40, A: 255})
+	white := CalculateAlphaMapForLogo(gray, [3]float64{255, 255, 255})
+	if reference := CalculateAlphaMap(gray); math.Abs(float64(white[0]-reference[0])) > 1e-6 {
+		t.Errorf("white logo: expected alpha %f, got %f", reference[0], white[0])
+	}
+}
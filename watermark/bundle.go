@@ -0,0 +1,223 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProfileDescriptor is the JSON descriptor of a profile bundle: a reference
+// PNG of the watermark on a black background plus the settings that cannot be
+// derived from it. A bundle for a 64px watermark with a warm logo looks like:
+//
+//	{
+//	    "name": "variant-64",
+//	    "reference": "variant-64.png",
+//	    "size": 64,
+//	    "margin": 40,
+//	    "logo_color": [255, 230, 160],
+//	    "selection": {"min_width": 1536, "min_height": 1536}
+//	}
+//
+// Reference paths are relative to the descriptor. Size is optional and, when
+// given, must match the reference image. LogoColor defaults to white.
+type ProfileDescriptor struct {
+	Name      string              `json:"name"`
+	Reference string              `json:"reference"`
+	Size      int                 `json:"size,omitempty"`
+	Margin    int                 `json:"margin"`
+	LogoColor *[3]float64         `json:"logo_color,omitempty"`
+	Selection SelectionDescriptor `json:"selection"`
+}
+
+// SelectionDescriptor is the JSON form of a SelectionRule.
+type SelectionDescriptor struct {
+	MinWidth  int `json:"min_width"`
+	MinHeight int `json:"min_height"`
+}
+
+// LoadProfile reads a profile bundle from the JSON descriptor at path and
+// returns the validated profile. Unknown descriptor fields are rejected to
+// catch typos early.
+func LoadProfile(path string) (Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to read profile descriptor: %w", err)
+	}
+
+	var descriptor ProfileDescriptor
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&descriptor); err != nil {
+		return Profile{}, fmt.Errorf("invalid profile descriptor %s: %w", path, err)
+	}
+
+	profile, err := descriptor.profile(filepath.Dir(path))
+	if err != nil {
+		return Profile{}, fmt.Errorf("invalid profile descriptor %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+// LoadProfiles loads profile bundles from path. A file is read as a single
+// descriptor; a directory is scanned (non-recursively) for *.json
+// descriptors, which are loaded in lexical order. The first invalid bundle
+// aborts loading.
+func LoadProfiles(path string) ([]Profile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access profile path: %w", err)
+	}
+
+	if !info.IsDir() {
+		profile, err := LoadProfile(path)
+		if err != nil {
+			return nil, err
+		}
+		return []Profile{profile}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan profile directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	profiles := make([]Profile, 0, len(names))
+	for _, name := range names {
+		profile, err := LoadProfile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// profile builds and validates the profile described by d. Relative
+// reference paths are resolved against dir.
+func (d ProfileDescriptor) profile(dir string) (Profile, error) {
+	if d.Reference == "" {
+		return Profile{}, fmt.Errorf("profile %q: no reference image given", d.Name)
+	}
+
+	referencePath := d.Reference
+	if !filepath.IsAbs(referencePath) {
+		referencePath = filepath.Join(dir, referencePath)
+	}
+	file, err := os.Open(referencePath)
+	if err != nil {
+		return Profile{}, fmt.Errorf("profile %q: failed to open reference image: %w", d.Name, err)
+	}
+	defer file.Close()
+
+	reference, err := png.Decode(file)
+	if err != nil {
+		return Profile{}, fmt.Errorf("profile %q: failed to decode reference image: %w", d.Name, err)
+	}
+
+	bounds := reference.Bounds()
+	if bounds.Dx() != bounds.Dy() {
+		return Profile{}, fmt.Errorf("profile %q: reference image must be square, got %dx%d",
+			d.Name, bounds.Dx(), bounds.Dy())
+	}
+	if d.Size != 0 && d.Size != bounds.Dx() {
+		return Profile{}, fmt.Errorf("profile %q: size %d does not match the %dx%d reference image",
+			d.Name, d.Size, bounds.Dx(), bounds.Dy())
+	}
+
+	logo := [3]float64{LogoValue, LogoValue, LogoValue}
+	if d.LogoColor != nil {
+		logo = *d.LogoColor
+	}
+
+	profile := Profile{
+		Name:      d.Name,
+		AlphaMap:  CalculateAlphaMapForLogo(reference, logo),
+		Size:      bounds.Dx(),
+		Margin:    d.Margin,
+		LogoColor: logo,
+		Rule:      SelectionRule{MinWidth: d.Selection.MinWidth, MinHeight: d.Selection.MinHeight},
+	}
+	return profile, profile.Validate()
+}
+
+// SaveProfile writes a profile as a bundle into dir: <name>.png holds the
+// watermark rendered on black as a 16-bit PNG, and <name>.json the descriptor
+// referring to it. It returns the path of the descriptor, which LoadProfile
+// and NewEngine accept. Existing files are overwritten.
+func SaveProfile(profile Profile, dir string) (string, error) {
+	if err := profile.Validate(); err != nil {
+		return "", err
+	}
+	if profile.Name != filepath.Base(profile.Name) || profile.Name == "." || profile.Name == ".." {
+		return "", fmt.Errorf("profile %q: name cannot be used as a file name", profile.Name)
+	}
+
+	// Render alpha * logo on black. 16 bits per channel keep the alpha map
+	// precise enough to survive the round trip through LoadProfile.
+	size := profile.Size
+	reference := image.NewNRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			alpha := float64(profile.AlphaMap[y*size+x])
+			channel := func(logo float64) uint16 {
+				return uint16(math.Round(clamp(alpha*logo*257, 0, 65535)))
+			}
+			reference.SetNRGBA64(x, y, color.NRGBA64{
+				R: channel(profile.LogoColor[0]),
+				G: channel(profile.LogoColor[1]),
+				B: channel(profile.LogoColor[2]),
+				A: 0xffff,
+			})
+		}
+	}
+
+	referenceName := profile.Name + ".png"
+	file, err := os.Create(filepath.Join(dir, referenceName))
+	if err != nil {
+		return "", fmt.Errorf("failed to create reference image: %w", err)
+	}
+	if err := png.Encode(file, reference); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to encode reference image: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write reference image: %w", err)
+	}
+
+	logo := profile.LogoColor
+	descriptor := ProfileDescriptor{
+		Name:      profile.Name,
+		Reference: referenceName,
+		Size:      size,
+		Margin:    profile.Margin,
+		LogoColor: &logo,
+		Selection: SelectionDescriptor{MinWidth: profile.Rule.MinWidth, MinHeight: profile.Rule.MinHeight},
+	}
+	data, err := json.MarshalIndent(descriptor, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode profile descriptor: %w", err)
+	}
+
+	path := filepath.Join(dir, profile.Name+".json")
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write profile descriptor: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,206 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBundle writes a reference PNG rendering alphaMap with the given logo
+// color on black, and a descriptor with the given JSON body, into dir.
+func writeBundle(t *testing.T, dir, name, descriptor string, alphaMap []float32, size int, logo [3]float64) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			alpha := float64(alphaMap[y*size+x])
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(alpha*logo[0] + 0.5),
+				G: uint8(alpha*logo[1] + 0.5),
+				B: uint8(alpha*logo[2] + 0.5),
+				A: 255,
+			})
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, name+".png"))
+	if err != nil {
+		t.Fatalf("Failed to create reference image: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode reference image: %v", err)
+	}
+
+	path := filepath.Join(dir, name+".json")
+	if err := os.WriteFile(path, []byte(descriptor), 0o644); err != nil {
+		t.Fatalf("Failed to write descriptor: %v", err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	base := testProfile(t, engine)
+	dir := t.TempDir()
+
+	path := writeBundle(t, dir, "warm-64", `{
+		"name": "warm-64",
+		"reference": "warm-64.png",
+		"size": 64,
+		"margin": 40,
+		"logo_color": [255, 230, 160],
+		"selection": {"min_width": 1536, "min_height": 1200}
+	}`, base.AlphaMap, base.Size, base.LogoColor)
+
+	profile, err := LoadProfile(path)
+	if err != nil {
+		t.Fatalf("LoadProfile() error: %v", err)
+	}
+
+	if profile.Name != "warm-64" || profile.Size != 64 || profile.Margin != 40 {
+		t.Errorf("unexpected profile %q: size %d, margin %d", profile.Name, profile.Size, profile.Margin)
+	}
+	if profile.LogoColor != base.LogoColor {
+		t.Errorf("expected logo color %v, got %v", base.LogoColor, profile.LogoColor)
+	}
+	if profile.Rule != (SelectionRule{MinWidth: 1536, MinHeight: 1200}) {
+		t.Errorf("unexpected selection rule %+v", profile.Rule)
+	}
+
+	// The alpha map survives the 8-bit round trip through the reference
+	for i, alpha := range profile.AlphaMap {
+		if math.Abs(float64(alpha-base.AlphaMap[i])) > 1.0/255 {
+			t.Fatalf("alpha %d: expected %f, got %f", i, base.AlphaMap[i], alpha)
+		}
+	}
+}
+
+func TestLoadProfile_DefaultsToWhiteLogo(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	base, _ := engine.Profile(ProfileGemini48)
+	dir := t.TempDir()
+
+	white := [3]float64{255, 255, 255}
+	path := writeBundle(t, dir, "white", `{"name": "white", "reference": "white.png", "margin": 32}`,
+		base.AlphaMap, base.Size, white)
+
+	profile, err := LoadProfile(path)
+	if err != nil {
+		t.Fatalf("LoadProfile() error: %v", err)
+	}
+	if profile.LogoColor != white {
+		t.Errorf("expected white logo, got %v", profile.LogoColor)
+	}
+	if profile.Size != 48 {
+		t.Errorf("expected size from reference image 48, got %d", profile.Size)
+	}
+}
+
+func TestLoadProfile_Errors(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	base, _ := engine.Profile(ProfileGemini48)
+	white := [3]float64{255, 255, 255}
+
+	testCases := []struct {
+		name       string
+		descriptor string
+		errMsg     string
+	}{
+		{"malformed", `{"name": `, "invalid profile descriptor"},
+		{"unknown field", `{"name": "x", "reference": "x.png", "marginn": 3}`, "unknown field"},
+		{"no reference", `{"name": "x", "margin": 32}`, "no reference"},
+		{"missing reference", `{"name": "x", "reference": "missing.png"}`, "failed to open"},
+		{"size mismatch", `{"name": "x", "reference": "x.png", "size": 96}`, "does not match"},
+		{"empty name", `{"reference": "x.png"}`, "name"},
+		{"logo out of range", `{"name": "x", "reference": "x.png", "logo_color": [300, 0, 0]}`, "logo color"},
+		{"negative margin", `{"name": "x", "reference": "x.png", "margin": -4}`, "margin"},
+	}
+
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		path := writeBundle(t, dir, "x", tc.descriptor, base.AlphaMap, base.Size, white)
+
+		_, err := LoadProfile(path)
+		if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.errMsg, err)
+		}
+	}
+}
+
+func TestLoadProfiles_Directory(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	base, _ := engine.Profile(ProfileGemini48)
+	white := [3]float64{255, 255, 255}
+	dir := t.TempDir()
+
+	writeBundle(t, dir, "b", `{"name": "second", "reference": "b.png", "margin": 10}`, base.AlphaMap, base.Size, white)
+	writeBundle(t, dir, "a", `{"name": "first", "reference": "a.png", "margin": 20}`, base.AlphaMap, base.Size, white)
+	if err := os.Mkdir(filepath.Join(dir, "nested.json"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	profiles, err := LoadProfiles(dir)
+	if err != nil {
+		t.Fatalf("LoadProfiles() error: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %d", len(profiles))
+	}
+	if profiles[0].Name != "first" || profiles[1].Name != "second" {
+		t.Errorf("expected profiles in file order [first second], got [%s %s]", profiles[0].Name, profiles[1].Name)
+	}
+
+	if _, err := LoadProfiles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for a missing path")
+	}
+}
+
+func TestNewEngine_LoadsProfileBundles(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	base := testProfile(t, engine)
+	dir := t.TempDir()
+	path := writeBundle(t, dir, "warm-64", `{
+		"name": "warm-64",
+		"reference": "warm-64.png",
+		"margin": 40,
+		"logo_color": [255, 230, 160]
+	}`, base.AlphaMap, base.Size, base.LogoColor)
+
+	custom, err := NewEngine(WithProfilePaths(path))
+	if err != nil {
+		t.Fatalf("NewEngine(%q) error: %v", path, err)
+	}
+	profiles := custom.Profiles()
+	if len(profiles) != 3 || profiles[2].Name != "warm-64" {
+		t.Fatalf("expected the bundle to be registered after the defaults, got %d profiles", len(profiles))
+	}
+
+	// A bundle may not shadow a built-in profile
+	duplicate := writeBundle(t, dir, "dup", `{"name": "gemini-48", "reference": "dup.png", "margin": 32}`,
+		base.AlphaMap, base.Size, base.LogoColor)
+	if _, err := NewEngine(WithProfilePaths(duplicate)); err == nil {
+		t.Error("expected error for a bundle reusing a built-in profile name")
+	}
+}
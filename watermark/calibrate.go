@@ -0,0 +1,249 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// calibrationIterations is the number of alternating least-squares rounds
+// Calibrate runs after its initial per-pixel estimate. The fit converges in
+// a few rounds on clean captures.
+const calibrationIterations = 5
+
+// Capture is a screenshot of the watermark drawn over a uniform background of
+// a known color, used by Calibrate.
+type Capture struct {
+	// Image holds the watermark region only: a square crop the size of the
+	// watermark.
+	Image image.Image
+
+	// Background is the color of the background under the watermark, per
+	// RGB channel in the range [0, 255].
+	Background [3]float64
+}
+
+// Calibration is the outcome of Calibrate.
+type Calibration struct {
+	// Profile is the fitted watermark profile.
+	Profile Profile
+
+	// RMSError and MaxError measure how well the fitted profile reproduces
+	// the captures: the root mean square and the largest absolute difference
+	// between a captured channel value and its prediction, in 8-bit levels.
+	// Values around 0.5 are the rounding floor of 8-bit captures.
+	RMSError float64
+	MaxError float64
+}
+
+// Calibrate fits a watermark profile to captures of the watermark over at
+// least two different known backgrounds, typically black and white.
+//
+// Each captured channel value follows the blend
+//
+//	captured = alpha * logo + (1 - alpha) * background
+//
+// with a per-pixel alpha and a logo color shared by all pixels. Calibrate
+// solves for both by least squares: a closed-form per-pixel estimate of
+// alpha and alpha * logo, followed by alternating refinements of the logo
+// color and the alpha map. Unlike CalculateAlphaMap it needs no assumption
+// about the logo color.
+func Calibrate(name string, captures []Capture, margin int, rule SelectionRule) (Calibration, error) {
+	if len(captures) < 2 {
+		return Calibration{}, errors.New("calibration needs captures over at least two backgrounds")
+	}
+
+	bounds := captures[0].Image.Bounds()
+	size := bounds.Dx()
+	if bounds.Dx() != bounds.Dy() {
+		return Calibration{}, fmt.Errorf("captures must be square, got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	distinct := false
+	for i, capture := range captures {
+		b := capture.Image.Bounds()
+		if b.Dx() != size || b.Dy() != size {
+			return Calibration{}, fmt.Errorf("capture %d is %dx%d, expected %dx%d", i+1, b.Dx(), b.Dy(), size, size)
+		}
+		for c, v := range capture.Background {
+			if v < 0 || v > 255 {
+				return Calibration{}, fmt.Errorf("capture %d: background channel %d value %f outside [0, 255]", i+1, c, v)
+			}
+		}
+		if capture.Background != captures[0].Background {
+			distinct = true
+		}
+	}
+	if !distinct {
+		return Calibration{}, errors.New("calibration needs captures over at least two different backgrounds")
+	}
+
+	// Read every capture once, in 8-bit units with 16-bit precision
+	pixels := size * size
+	samples := make([][]float64, len(captures))
+	for k, capture := range captures {
+		samples[k] = readCapture(capture.Image, size)
+	}
+
+	alpha := make([]float64, pixels)
+	logo := initialCalibration(samples, captures, alpha)
+	if logo == nil {
+		return Calibration{}, errors.New("captures contain no watermark")
+	}
+	for i := 0; i < calibrationIterations; i++ {
+		fitCalibrationAlpha(samples, captures, *logo, alpha)
+		if !fitCalibrationLogo(samples, captures, alpha, logo) {
+			return Calibration{}, errors.New("captures contain no watermark")
+		}
+	}
+	fitCalibrationAlpha(samples, captures, *logo, alpha)
+
+	// Measure the residual of the final model
+	var sumSq, maxErr float64
+	for k, capture := range captures {
+		for p := 0; p < pixels; p++ {
+			for c := 0; c < 3; c++ {
+				predicted := alpha[p]*logo[c] + (1-alpha[p])*capture.Background[c]
+				diff := math.Abs(samples[k][p*3+c] - predicted)
+				sumSq += diff * diff
+				maxErr = math.Max(maxErr, diff)
+			}
+		}
+	}
+
+	alphaMap := make([]float32, pixels)
+	for p, a := range alpha {
+		alphaMap[p] = float32(a)
+	}
+	profile := Profile{
+		Name:      name,
+		AlphaMap:  alphaMap,
+		Size:      size,
+		Margin:    margin,
+		LogoColor: *logo,
+		Rule:      rule,
+	}
+	if err := profile.Validate(); err != nil {
+		return Calibration{}, err
+	}
+
+	return Calibration{
+		Profile:  profile,
+		RMSError: math.Sqrt(sumSq / float64(len(captures)*pixels*3)),
+		MaxError: maxErr,
+	}, nil
+}
+
+// readCapture returns the RGB values of a size x size capture in row-major
+// order, three per pixel, scaled to [0, 255] without dropping the low byte.
+func readCapture(img image.Image, size int) []float64 {
+	bounds := img.Bounds()
+	values := make([]float64, size*size*3)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			i := (y*size + x) * 3
+			values[i] = float64(r) / 257
+			values[i+1] = float64(g) / 257
+			values[i+2] = float64(b) / 257
+		}
+	}
+	return values
+}
+
+// initialCalibration estimates alpha per pixel without knowing the logo
+// color, then derives the logo color from the estimates. It fills alpha and
+// returns the logo color, or nil if no pixel carries any watermark.
+//
+// For a fixed pixel, captured - background = alpha * (logo - background) is
+// linear in alpha and in the premultiplied logo alpha * logo. Eliminating the
+// latter by centering over the captures gives alpha in closed form.
+func initialCalibration(samples [][]float64, captures []Capture, alpha []float64) *[3]float64 {
+	n := float64(len(captures))
+	var meanBg [3]float64
+	for _, capture := range captures {
+		for c := range meanBg {
+			meanBg[c] += capture.Background[c] / n
+		}
+	}
+
+	var premultiplied, weight [3]float64
+	for p := range alpha {
+		var meanDiff [3]float64
+		for k, capture := range captures {
+			for c := range meanDiff {
+				meanDiff[c] += (samples[k][p*3+c] - capture.Background[c]) / n
+			}
+		}
+
+		var num, den float64
+		for k, capture := range captures {
+			for c := 0; c < 3; c++ {
+				diff := samples[k][p*3+c] - capture.Background[c] - meanDiff[c]
+				bg := capture.Background[c] - meanBg[c]
+				num -= diff * bg
+				den += bg * bg
+			}
+		}
+		a := clamp(num/den, 0, 1)
+		alpha[p] = a
+
+		// alpha * logo is the mean of captured - (1 - alpha) * background
+		for c := 0; c < 3; c++ {
+			premultiplied[c] += a * (meanDiff[c] + a*meanBg[c])
+			weight[c] += a * a
+		}
+	}
+
+	if weight[0] <= 1e-12 {
+		return nil
+	}
+	var logo [3]float64
+	for c := range logo {
+		logo[c] = clamp(premultiplied[c]/weight[c], 0, 255)
+	}
+	return &logo
+}
+
+// fitCalibrationAlpha updates alpha per pixel by least squares for a fixed
+// logo color.
+func fitCalibrationAlpha(samples [][]float64, captures []Capture, logo [3]float64, alpha []float64) {
+	for p := range alpha {
+		var num, den float64
+		for k, capture := range captures {
+			for c := 0; c < 3; c++ {
+				contrast := logo[c] - capture.Background[c]
+				num += (samples[k][p*3+c] - capture.Background[c]) * contrast
+				den += contrast * contrast
+			}
+		}
+		if den <= 1e-12 {
+			alpha[p] = 0
+			continue
+		}
+		alpha[p] = clamp(num/den, 0, 1)
+	}
+}
+
+// fitCalibrationLogo updates the logo color by least squares for a fixed
+// alpha map. It reports false if the alpha map is empty.
+func fitCalibrationLogo(samples [][]float64, captures []Capture, alpha []float64, logo *[3]float64) bool {
+	var num [3]float64
+	var den float64
+	for k, capture := range captures {
+		for p, a := range alpha {
+			for c := 0; c < 3; c++ {
+				num[c] += a * (samples[k][p*3+c] - (1-a)*capture.Background[c])
+			}
+			den += a * a
+		}
+	}
+	if den <= 1e-12 {
+		return false
+	}
+	for c := range logo {
+		logo[c] = clamp(num[c]/den, 0, 255)
+	}
+	return true
+}
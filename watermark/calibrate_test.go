@@ -0,0 +1,142 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+// renderCapture blends a profile's logo over a uniform background, rounded to
+// 8 bits like a screenshot.
+func renderCapture(profile Profile, background [3]float64) Capture {
+	size := profile.Size
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			alpha := float64(profile.AlphaMap[y*size+x])
+			channel := func(c int) uint8 {
+				return uint8(alpha*profile.LogoColor[c] + (1-alpha)*background[c] + 0.5)
+			}
+			img.SetRGBA(x, y, color.RGBA{R: channel(0), G: channel(1), B: channel(2), A: 255})
+		}
+	}
+	return Capture{Image: img, Background: background}
+}
+
+func TestCalibrate_RecoversProfile(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	truth := testProfile(t, engine)
+
+	testCases := []struct {
+		name        string
+		backgrounds [][3]float64
+	}{
+		{"black and white", [][3]float64{{0, 0, 0}, {255, 255, 255}}},
+		{"three backgrounds", [][3]float64{{0, 0, 0}, {128, 128, 128}, {40, 90, 200}}},
+	}
+
+	for _, tc := range testCases {
+		var captures []Capture
+		for _, background := range tc.backgrounds {
+			captures = append(captures, renderCapture(truth, background))
+		}
+
+		calibration, err := Calibrate("fitted", captures, 40, SelectionRule{MinWidth: 1536, MinHeight: 1536})
+		if err != nil {
+			t.Fatalf("%s: Calibrate() error: %v", tc.name, err)
+		}
+
+		profile := calibration.Profile
+		if profile.Name != "fitted" || profile.Size != truth.Size || profile.Margin != 40 {
+			t.Errorf("%s: unexpected profile %q: size %d, margin %d", tc.name, profile.Name, profile.Size, profile.Margin)
+		}
+		for c := range profile.LogoColor {
+			if math.Abs(profile.LogoColor[c]-truth.LogoColor[c]) > 2 {
+				t.Errorf("%s: logo channel %d: expected %.1f, got %.1f", tc.name, c, truth.LogoColor[c], profile.LogoColor[c])
+			}
+		}
+
+		var maxDiff float64
+		for i, alpha := range profile.AlphaMap {
+			maxDiff = math.Max(maxDiff, math.Abs(float64(alpha-truth.AlphaMap[i])))
+		}
+		if maxDiff > 0.01 {
+			t.Errorf("%s: alpha map differs by up to %.4f", tc.name, maxDiff)
+		}
+
+		// 8-bit rounding bounds the residual
+		if calibration.RMSError > 0.5 || calibration.MaxError > 1 {
+			t.Errorf("%s: unexpected fit error: rms %.3f, max %.3f", tc.name, calibration.RMSError, calibration.MaxError)
+		}
+	}
+}
+
+func TestCalibrate_Errors(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	truth := testProfile(t, engine)
+	black := renderCapture(truth, [3]float64{0, 0, 0})
+	white := renderCapture(truth, [3]float64{255, 255, 255})
+	blank := Capture{Image: image.NewRGBA(image.Rect(0, 0, 64, 64))}
+	blankWhite := Capture{Image: createTestImage(64, 64, color.White), Background: [3]float64{255, 255, 255}}
+
+	testCases := []struct {
+		name     string
+		captures []Capture
+		errMsg   string
+	}{
+		{"single capture", []Capture{black}, "at least two"},
+		{"same background", []Capture{black, black}, "two different"},
+		{"size mismatch", []Capture{black, {Image: image.NewRGBA(image.Rect(0, 0, 48, 48))}}, "expected 64x64"},
+		{"not square", []Capture{{Image: image.NewRGBA(image.Rect(0, 0, 64, 48))}, white}, "square"},
+		{"background out of range", []Capture{black, {Image: white.Image, Background: [3]float64{256, 0, 0}}}, "background"},
+		{"no watermark", []Capture{blank, blankWhite}, "no watermark"},
+	}
+
+	for _, tc := range testCases {
+		_, err := Calibrate("x", tc.captures, 32, SelectionRule{})
+		if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.errMsg, err)
+		}
+	}
+}
+
+func TestSaveProfile_RoundTrip(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	profile := testProfile(t, engine)
+	profile.Rule = SelectionRule{MinWidth: 2048, MinHeight: 1024}
+
+	path, err := SaveProfile(profile, t.TempDir())
+	if err != nil {
+		t.Fatalf("SaveProfile() error: %v", err)
+	}
+	loaded, err := LoadProfile(path)
+	if err != nil {
+		t.Fatalf("LoadProfile(%q) error: %v", path, err)
+	}
+
+	if loaded.Name != profile.Name || loaded.Config() != profile.Config() ||
+		loaded.LogoColor != profile.LogoColor || loaded.Rule != profile.Rule {
+		t.Errorf("round trip changed the profile: %+v", loaded.Config())
+	}
+	for i, alpha := range loaded.AlphaMap {
+		if math.Abs(float64(alpha-profile.AlphaMap[i])) > 1e-4 {
+			t.Fatalf("alpha %d: expected %f, got %f", i, profile.AlphaMap[i], alpha)
+		}
+	}
+
+	profile.Name = "../escape"
+	if _, err := SaveProfile(profile, t.TempDir()); err == nil {
+		t.Error("expected error for a profile name containing a path")
+	}
+}
@@ -0,0 +1,85 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Restorers work on straight (non-premultiplied) colors on the 0-255 scale of
+// Restoration with float precision, since the watermark is blended with the
+// straight color of semi-transparent pixels. Pixels are read at the full
+// precision of the image and unpremultiplied; setRestored premultiplies the
+// results again for premultiplied images, and 16-bit images are restored
+// into a 16-bit copy, so that nothing is truncated to 8 bits.
+
+// highDepth reports whether img stores more than 8 bits per channel.
+func highDepth(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model, color.Alpha16Model:
+		return true
+	}
+	return false
+}
+
+// rgbAt returns the straight (non-premultiplied) color of the pixel at
+// (x, y) on the 0-255 scale, with the full precision of img (1/257 steps
+// for 16-bit images). Fully transparent pixels read as black.
+func rgbAt(img image.Image, x, y int) [3]float64 {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		c := img.NRGBAAt(x, y)
+		return [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	case *image.NRGBA64:
+		c := img.NRGBA64At(x, y)
+		return [3]float64{float64(c.R) / 257, float64(c.G) / 257, float64(c.B) / 257}
+	}
+
+	r, g, b, a := rgba16At(img, x, y)
+	switch a {
+	case 0xFFFF:
+		return [3]float64{float64(r) / 257, float64(g) / 257, float64(b) / 257}
+	case 0:
+		return [3]float64{}
+	}
+	scale := 255 / float64(a)
+	return [3]float64{float64(r) * scale, float64(g) * scale, float64(b) * scale}
+}
+
+// rgba16At returns img.At(x, y).RGBA(). Pixels of the standard image types
+// are read without converting their color to a color.Color, which would
+// allocate.
+func rgba16At(img image.Image, x, y int) (r, g, b, a uint32) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return img.RGBAAt(x, y).RGBA()
+	case *image.NRGBA:
+		return img.NRGBAAt(x, y).RGBA()
+	case *image.RGBA64:
+		return img.RGBA64At(x, y).RGBA()
+	case *image.NRGBA64:
+		return img.NRGBA64At(x, y).RGBA()
+	case *image.Gray:
+		return img.GrayAt(x, y).RGBA()
+	case *image.Gray16:
+		return img.Gray16At(x, y).RGBA()
+	case *image.YCbCr:
+		return img.YCbCrAt(x, y).RGBA()
+	}
+	return img.At(x, y).RGBA()
+}
+
+// roundLevel rounds a value on the 0-255 scale to the nearest level img can
+// store: whole numbers for 8-bit images, multiples of 1/257 for 16-bit ones.
+func roundLevel(v float64, img image.Image) float64 {
+	if highDepth(img) {
+		return math.Round(v*257) / 257
+	}
+	return math.Round(v)
+}
+
+// to16 converts a value on the 0-255 scale to 16 bits, clamping and
+// rounding it.
+func to16(v float64) uint16 {
+	return uint16(math.Round(clamp(v, 0, 255) * 257))
+}
@@ -0,0 +1,229 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+// create16BitGradient creates a smooth gradient using the full 16-bit range,
+// with values between the 8-bit levels.
+func create16BitGradient(width, height int) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(20000 + 30000*x/width),
+				G: uint16(9000 + 41000*y/height),
+				B: uint16(31000 - 17000*x/width),
+				A: 0xFFFF,
+			})
+		}
+	}
+	return img
+}
+
+// applyWatermark16 blends a white watermark into a 16-bit image.
+func applyWatermark16(img draw.Image, region image.Rectangle, alphaMap []float32) {
+	size := region.Dx()
+	for i, alpha := range alphaMap {
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		r, g, b, _ := img.At(x, y).RGBA()
+		blend := func(v uint32) uint16 {
+			return uint16(math.Round(float64(alpha)*0xFFFF + (1-float64(alpha))*float64(v)))
+		}
+		img.Set(x, y, color.RGBA64{R: blend(r), G: blend(g), B: blend(b), A: 0xFFFF})
+	}
+}
+
+// meanError16 returns the mean absolute 16-bit channel difference between
+// two images over the watermarked pixels of region.
+func meanError16(a, b image.Image, region image.Rectangle, alphaMap []float32) float64 {
+	size := region.Dx()
+	var sum float64
+	n := 0
+	for i, alpha := range alphaMap {
+		if alpha < AlphaThreshold {
+			continue
+		}
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		r1, g1, b1, _ := a.At(x, y).RGBA()
+		r2, g2, b2, _ := b.At(x, y).RGBA()
+		sum += math.Abs(float64(r1)-float64(r2)) + math.Abs(float64(g1)-float64(g2)) + math.Abs(float64(b1)-float64(b2))
+		n += 3
+	}
+	return sum / float64(n)
+}
+
+func TestRemoveAll_16Bit(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 800, 600
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	original := create16BitGradient(width, height)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+
+	watermarked := create16BitGradient(width, height)
+	applyWatermark16(watermarked, region, profile.AlphaMap)
+
+	result, ok := engine.RemoveDetected(watermarked, detection).(*image.RGBA64)
+	if !ok {
+		t.Fatalf("expected an *image.RGBA64 result, got %T", engine.RemoveDetected(watermarked, detection))
+	}
+	deep := meanError16(result, original, region, profile.AlphaMap)
+
+	// The same image truncated to 8 bits loses the low bits of every pixel
+	// and amplifies the truncation error under the logo
+	rgba := image.NewRGBA(watermarked.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), watermarked, image.Point{}, draw.Src)
+	shallow := meanError16(engine.RemoveDetected(rgba, detection), original, region, profile.AlphaMap)
+
+	if deep > 20 || deep > shallow/10 {
+		t.Errorf("16-bit mean error %.1f (8-bit %.1f)", deep, shallow)
+	}
+
+	// Pixels outside the watermark are copied exactly
+	if result.RGBA64At(10, 10) != original.RGBA64At(10, 10) {
+		t.Error("pixel outside the watermark changed")
+	}
+}
+
+func TestRemoveAll_NRGBA64(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 640, 480
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	original := create16BitGradient(width, height)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+
+	watermarked := image.NewNRGBA64(original.Bounds())
+	draw.Draw(watermarked, watermarked.Bounds(), original, image.Point{}, draw.Src)
+	applyWatermark16(watermarked, region, profile.AlphaMap)
+
+	for _, restorer := range []Restorer{ReverseBlend{}, Hybrid{Primary: ReverseBlend{}, Fallback: DiffusionInpaint{}}} {
+		engine.SetRestorer(restorer)
+		result, ok := engine.RemoveDetected(watermarked, detection).(*image.NRGBA64)
+		if !ok {
+			t.Fatalf("%T: expected an *image.NRGBA64 result", restorer)
+		}
+		if mean := meanError16(result, original, region, profile.AlphaMap); mean > 20 {
+			t.Errorf("%T: mean error %.1f", restorer, mean)
+		}
+	}
+}
+
+func TestRoundLevel(t *testing.T) {
+	if got := roundLevel(100.6, image.NewRGBA(image.Rect(0, 0, 1, 1))); got != 101 {
+		t.Errorf("8-bit: roundLevel(100.6) = %v, expected 101", got)
+	}
+	if got := roundLevel(100.6, image.NewRGBA64(image.Rect(0, 0, 1, 1))); got != math.Round(100.6*257)/257 {
+		t.Errorf("16-bit: roundLevel(100.6) = %v, expected %v", got, math.Round(100.6*257)/257)
+	}
+}
+
+// createTransparentGradient creates a straight-alpha gradient whose opacity
+// varies from pixel to pixel, including fully transparent pixels.
+func createTransparentGradient(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := uint8(40 + (3*x+5*y)%216)
+			if (x+y)%17 == 0 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(200 - 120*x/width),
+				G: uint8(40 + 100*y/height),
+				B: uint8(90 + 60*x/width),
+				A: a,
+			})
+		}
+	}
+	return img
+}
+
+// applyWatermarkStraight blends a white watermark into the straight color of
+// an NRGBA image, keeping its alpha.
+func applyWatermarkStraight(img *image.NRGBA, region image.Rectangle, alphaMap []float32) {
+	size := region.Dx()
+	for i, alpha := range alphaMap {
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		c := img.NRGBAAt(x, y)
+		blend := func(v uint8) uint8 {
+			return uint8(math.Round(float64(alpha)*255 + (1-float64(alpha))*float64(v)))
+		}
+		img.SetNRGBA(x, y, color.NRGBA{R: blend(c.R), G: blend(c.G), B: blend(c.B), A: c.A})
+	}
+}
+
+func TestRemoveAll_TransparentImages(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 640, 480
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+	original := createTransparentGradient(width, height)
+	watermarked := createTransparentGradient(width, height)
+	applyWatermarkStraight(watermarked, region, profile.AlphaMap)
+
+	// Straight alpha: the result is an NRGBA image with the original colors
+	// and alpha
+	result, ok := engine.RemoveDetected(watermarked, detection).(*image.NRGBA)
+	if !ok {
+		t.Fatalf("expected an *image.NRGBA result")
+	}
+	var sum float64
+	n := 0
+	size := region.Dx()
+	for i, alpha := range profile.AlphaMap {
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		got, want := result.NRGBAAt(x, y), original.NRGBAAt(x, y)
+		if got.A != want.A {
+			t.Fatalf("alpha of (%d,%d) changed from %d to %d", x, y, want.A, got.A)
+		}
+		if alpha < AlphaThreshold || want.A == 0 {
+			continue
+		}
+		sum += math.Abs(float64(got.R)-float64(want.R)) + math.Abs(float64(got.G)-float64(want.G)) +
+			math.Abs(float64(got.B)-float64(want.B))
+		n += 3
+	}
+	if mean := sum / float64(n); mean > 1.5 {
+		t.Errorf("NRGBA: mean error %.2f", mean)
+	}
+
+	// Premultiplied alpha: the result stays premultiplied and matches the
+	// original within the precision lost by premultiplying
+	premultiplied := image.NewRGBA(watermarked.Bounds())
+	draw.Draw(premultiplied, premultiplied.Bounds(), watermarked, image.Point{}, draw.Src)
+	expected := image.NewRGBA(original.Bounds())
+	draw.Draw(expected, expected.Bounds(), original, image.Point{}, draw.Src)
+
+	restored, ok := engine.RemoveDetected(premultiplied, detection).(*image.RGBA)
+	if !ok {
+		t.Fatalf("expected an *image.RGBA result")
+	}
+	if mean := meanError16(restored, expected, region, profile.AlphaMap) / 257; mean > 1.5 {
+		t.Errorf("RGBA: mean error %.2f", mean)
+	}
+	for i := range profile.AlphaMap {
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		if expected.RGBAAt(x, y).A == 0 && restored.RGBAAt(x, y) != premultiplied.RGBAAt(x, y) {
+			t.Fatalf("fully transparent pixel (%d,%d) changed", x, y)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+// DetectionThreshold is the minimum confidence required for Detect to report
+// a watermark as present. Clean images typically score close to zero, while
+// genuine Gemini watermarks score well above 0.8 on all but the brightest
+// backgrounds.
+const DetectionThreshold = 0.5
+
+// selectionMargin is how much better another profile must score than the
+// one expected for the image dimensions before it is preferred.
+// It keeps the dimension rule authoritative when both fits are similar.
+const selectionMargin = 0.05
+
+// minSubPixelOffset is the smallest sub-pixel offset worth applying. Noise
+// makes the correlation peak slightly asymmetric even for watermarks on the
+// integer grid, and interpolating the alpha map for such tiny offsets would
+// only soften its edges.
+const minSubPixelOffset = 0.1
+
+// minCoverage is the fraction of the watermark that must lie inside the image
+// for a correlation score to be meaningful. Regions that are mostly clipped
+// by the image edge are reported with zero confidence.
+const minCoverage = 0.5
+
+// Selection records which rule chose the watermark profile of a Detection.
+type Selection int
+
+const (
+	// SelectedByDimensions means the profile whose selection rule matches
+	// the image dimensions was kept.
+	SelectedByDimensions Selection = iota
+
+	// SelectedByContent means another profile matched the image content
+	// noticeably better than the dimension rule's prediction.
+	SelectedByContent
+)
+
+// String returns "dimensions" or "content".
+func (s Selection) String() string {
+	if s == SelectedByContent {
+		return "content"
+	}
+	return "dimensions"
+}
+
+// CandidateScore is the best match found for a single profile.
+type CandidateScore struct {
+	Profile    string
+	Config     WatermarkConfig
+	Region     image.Rectangle
+	Scale      float64
+	OffsetX    float64
+	OffsetY    float64
+	Confidence float64
+}
+
+// Detection describes the outcome of looking for the watermark in an image.
+type Detection struct {
+	// Detected reports whether the watermark signature was found, i.e.
+	// whether Confidence reached DetectionThreshold.
+	Detected bool
+
+	// Profile is the name of the watermark profile that was evaluated.
+	// An empty name (for hand-built detections) selects the first
+	// registered profile with the same Config.
+	Profile string
+
+	// Config is the size and margin of the profile.
+	Config WatermarkConfig
+
+	// Region is the rectangle occupied by the watermark, in the coordinate
+	// space of the image (it accounts for a non-zero Bounds().Min).
+	// Its side is Config.Size multiplied by Scale, rounded to whole pixels.
+	Region image.Rectangle
+
+	// Scale is the size of the watermark relative to Config. It is 1.0
+	// unless a multi-scale search found the image was resized; a zero value
+	// is treated as 1.0.
+	Scale float64
+
+	// OffsetX and OffsetY refine Region to sub-pixel precision: the
+	// watermark's top-left corner lies at Region.Min + (OffsetX, OffsetY).
+	// Both are in [-0.5, 0.5] and are only non-zero after a position search;
+	// offsets below 0.1 pixel are reported as 0.
+	OffsetX float64
+	OffsetY float64
+
+	// Confidence is the normalized cross-correlation between the pixel
+	// brightness inside Region and the watermark's alpha map, in [0.0, 1.0].
+	// Negative correlations (darker where the logo should be brighter)
+	// are reported as 0.
+	Confidence float64
+
+	// Selection records whether Profile came from the dimension rule or
+	// from a better content match.
+	Selection Selection
+
+	// Scores holds the best match of every registered profile, in
+	// registration order.
+	Scores []CandidateScore
+
+	// Fit holds per-image blend parameters fitted by FitBlend, which
+	// removal uses instead of the profile's. It is nil when no fit was
+	// made.
+	Fit *BlendFit
+}
+
+// Detect checks whether the image carries the Gemini watermark.
+//
+// The watermark brightens each pixel in proportion to its alpha value, so the
+// brightness inside the watermark region of a watermarked image is strongly
+// correlated with the alpha map. Detect measures that correlation for every
+// registered profile at its expected position. The profile whose selection
+// rule matches the image dimensions is kept unless another profile is
+// detected with a clearly higher confidence, which handles non-square and
+// otherwise unusual resolutions. Unlike RemoveWatermark it never modifies
+// anything, which makes it suitable for sorting mixed folders.
+func (e *Engine) Detect(img image.Image) Detection {
+	return e.detect(img, 0, unitScale)
+}
+
+// DetectNear works like Detect but also searches a window of radius pixels
+// in each direction around the expected position of every profile. This
+// finds watermarks in images that were cropped or padded by a few pixels
+// after generation.
+//
+// The best integer position is refined to sub-pixel precision by fitting a
+// parabola through the neighboring correlation scores; the refinement is
+// kept only if it improves the match. Offsets below a tenth of a pixel are
+// dropped, so that watermarks on the pixel grid are removed with the alpha
+// map as is. A radius of 0 is equivalent to Detect.
+func (e *Engine) DetectNear(img image.Image, radius int) Detection {
+	if radius < 0 {
+		radius = 0
+	}
+	return e.detect(img, radius, unitScale)
+}
+
+// detect implements Detect, DetectNear and DetectScaled: every registered
+// profile is evaluated at every scale within radius pixels of its expected
+// position.
+func (e *Engine) detect(img image.Image, radius int, scales []float64) Detection {
+	s := getScratch()
+	defer s.release()
+	detection := e.detectWith(s, img, radius, scales)
+	detection.Scores = slices.Clone(detection.Scores)
+	return detection
+}
+
+// detectWith implements detect with the buffers of s. The Scores of the
+// returned Detection are stored in s and only valid until s is released.
+func (e *Engine) detectWith(s *scratch, img image.Image, radius int, scales []float64) Detection {
+	bounds := img.Bounds()
+	s.profiles = e.appendRegistered(s.profiles[:0])
+	profiles := s.profiles
+	if len(profiles) == 0 {
+		return Detection{Scale: 1}
+	}
+	expected := expectedProfile(profiles, bounds.Dx(), bounds.Dy())
+
+	s.scores = grow(s.scores, len(profiles))
+	scores := s.scores
+	best, fallback := 0, 0
+	for i, profile := range profiles {
+		scores[i] = locateScaled(s, img, profile, scales, radius)
+		if scores[i].Confidence > scores[best].Confidence {
+			best = i
+		}
+		if profile == expected {
+			fallback = i
+		}
+	}
+
+	// Start from the dimension rule at the original scale and only switch
+	// when the content clearly favors another candidate or scale.
+	chosen, selection := scores[fallback], SelectedByDimensions
+	if chosen.Scale != 1 {
+		region := CalculatePosition(bounds.Dx(), bounds.Dy(), expected.Config()).Add(bounds.Min)
+		chosen = locate(s, img, expected, 1, region, radius)
+	}
+	if winner := scores[best]; (winner.Profile != expected.Name || winner.Scale != 1) &&
+		winner.Confidence >= DetectionThreshold &&
+		winner.Confidence > chosen.Confidence+selectionMargin {
+		chosen, selection = winner, SelectedByContent
+	}
+
+	return Detection{
+		Detected:   chosen.Confidence >= DetectionThreshold,
+		Profile:    chosen.Profile,
+		Config:     chosen.Config,
+		Region:     chosen.Region,
+		Scale:      chosen.Scale,
+		OffsetX:    chosen.OffsetX,
+		OffsetY:    chosen.OffsetY,
+		Confidence: chosen.Confidence,
+		Selection:  selection,
+		Scores:     scores,
+	}
+}
+
+// locate finds the best match for a profile drawn at the given scale within
+// radius pixels of the expected region, using the buffers of s.
+func locate(s *scratch, img image.Image, profile *Profile, scale float64, expected image.Rectangle, radius int) CandidateScore {
+	alphaMap, _ := scaledAlphaMap(profile, scale, 0, 0)
+	plane := newLumaPlane(img, expected.Inset(-radius), s.luma)
+	s.luma = plane.pix
+
+	// Score every integer offset in the window. The expected position is
+	// the initial best so that it wins ties (e.g. on flat images).
+	side := 2*radius + 1
+	s.correlations = grow(s.correlations, side*side)
+	scores := s.correlations
+	best := CandidateScore{
+		Profile:    profile.Name,
+		Config:     profile.Config(),
+		Region:     expected,
+		Scale:      scale,
+		Confidence: -1,
+	}
+	bestX, bestY := radius, radius
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			region := expected.Add(image.Pt(dx, dy))
+			score := plane.correlate(region, alphaMap)
+			scores[(dy+radius)*side+dx+radius] = score
+
+			if score > best.Confidence || (dx == 0 && dy == 0 && score == best.Confidence) {
+				best.Region = region
+				best.Confidence = score
+				bestX, bestY = dx+radius, dy+radius
+			}
+		}
+	}
+	if best.Confidence <= 0 || radius == 0 {
+		best.Confidence = math.Max(best.Confidence, 0)
+		return best
+	}
+
+	// Refine to sub-pixel precision along each axis using the scores of
+	// the neighboring integer positions.
+	var offsetX, offsetY float64
+	if bestX > 0 && bestX < side-1 {
+		row := bestY * side
+		offsetX = parabolicPeak(scores[row+bestX-1], scores[row+bestX], scores[row+bestX+1])
+	}
+	if bestY > 0 && bestY < side-1 {
+		offsetY = parabolicPeak(scores[(bestY-1)*side+bestX], scores[bestY*side+bestX], scores[(bestY+1)*side+bestX])
+	}
+	if offsetX != 0 || offsetY != 0 {
+		shifted, _ := scaledAlphaMap(profile, scale, offsetX, offsetY)
+		if score := plane.correlate(best.Region, shifted); score > best.Confidence {
+			best.OffsetX = offsetX
+			best.OffsetY = offsetY
+			best.Confidence = score
+		}
+	}
+
+	return best
+}
+
+// parabolicPeak returns the offset of the vertex of the parabola through
+// (-1, left), (0, center) and (1, right), limited to [-0.5, 0.5]. It returns
+// 0 when center is not a local maximum or the offset is below
+// minSubPixelOffset.
+func parabolicPeak(left, center, right float64) float64 {
+	curvature := left - 2*center + right
+	if curvature >= 0 {
+		return 0
+	}
+	offset := clamp((left-right)/(2*curvature), -0.5, 0.5)
+	if math.Abs(offset) < minSubPixelOffset {
+		return 0
+	}
+	return offset
+}
+
+// detectionAlphaMap returns the alpha map of the profile to use for removing
+// the watermark described by a detection, resampled to its scale and
+// sub-pixel offset if necessary, together with the side length of the
+// returned map.
+func detectionAlphaMap(profile *Profile, detection Detection) ([]float32, int) {
+	scale := detection.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return scaledAlphaMap(profile, scale, detection.OffsetX, detection.OffsetY)
+}
+
+// lumaPlane caches the brightness of a rectangular part of an image so that
+// repeated correlations (e.g. during a position search) avoid re-reading
+// pixels through the image.Image interface.
+type lumaPlane struct {
+	rect image.Rectangle
+	pix  []float32
+}
+
+// newLumaPlane extracts the brightness of the pixels of img inside rect,
+// storing it in buf if it is large enough. The rectangle is clipped to the
+// image bounds.
+func newLumaPlane(img image.Image, rect image.Rectangle, buf []float32) lumaPlane {
+	rect = rect.Intersect(img.Bounds())
+	plane := lumaPlane{rect: rect, pix: grow(buf, rect.Dx()*rect.Dy())}
+
+	i := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			// Use the mean of the 8-bit channels as brightness. The white
+			// logo raises all three channels by the same amount.
+			r, g, b, _ := rgba16At(img, x, y)
+			plane.pix[i] = float32(r>>8+g>>8+b>>8) / 3
+			i++
+		}
+	}
+	return plane
+}
+
+// correlate computes the Pearson correlation between the alpha map and the
+// brightness of the pixels covered by region. The alpha map is laid out in
+// row-major order with region.Dx() values per row.
+//
+// Pixels of region that fall outside the plane are ignored. The result is
+// clamped to [0.0, 1.0]; flat regions (zero variance) yield 0.
+func (p *lumaPlane) correlate(region image.Rectangle, alphaMap []float32) float64 {
+	visible := region.Intersect(p.rect)
+	size := region.Dx()
+
+	if size == 0 || visible.Dx()*visible.Dy() < int(minCoverage*float64(size*region.Dy())) {
+		return 0
+	}
+
+	stride := p.rect.Dx()
+	var n, sumA, sumI, sumAA, sumII, sumAI float64
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		row := (y - p.rect.Min.Y) * stride
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			alpha := float64(alphaMap[(y-region.Min.Y)*size+(x-region.Min.X)])
+			brightness := float64(p.pix[row+x-p.rect.Min.X])
+
+			n++
+			sumA += alpha
+			sumI += brightness
+			sumAA += alpha * alpha
+			sumII += brightness * brightness
+			sumAI += alpha * brightness
+		}
+	}
+
+	cov := sumAI - sumA*sumI/n
+	varA := sumAA - sumA*sumA/n
+	varI := sumII - sumI*sumI/n
+
+	// A flat region (or a flat alpha map) carries no evidence either way.
+	if varA <= 1e-9 || varI <= 1e-9 {
+		return 0
+	}
+
+	return clamp(cov/math.Sqrt(varA*varI), 0, 1)
+}
@@ -0,0 +1,379 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// createNoiseImage creates a textured test image: a mid-gray background with
+// deterministic per-pixel noise so correlation tests have something to chew on.
+func createNoiseImage(width, height int, seed int64) *image.RGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(80 + rng.Intn(60))
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v + 10, B: v + 20, A: 255})
+		}
+	}
+	return img
+}
+
+// applyWatermark blends a white logo into img over region using the given
+// alpha map, mimicking how Gemini applies its watermark.
+func applyWatermark(img *image.RGBA, region image.Rectangle, alphaMap []float32) {
+	size := region.Dx()
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			alpha := float64(alphaMap[(y-region.Min.Y)*size+(x-region.Min.X)])
+			c := img.RGBAAt(x, y)
+			blend := func(v uint8) uint8 {
+				return uint8(alpha*LogoValue + (1-alpha)*float64(v) + 0.5)
+			}
+			img.SetRGBA(x, y, color.RGBA{R: blend(c.R), G: blend(c.G), B: blend(c.B), A: c.A})
+		}
+	}
+}
+
+// shiftAlphaMap returns a copy of a size x size alpha map translated by
+// (dx, dy) pixels using bilinear interpolation. Samples that fall outside the
+// original map are treated as fully transparent.
+func shiftAlphaMap(alphaMap []float32, size int, dx, dy float64) []float32 {
+	shifted, _ := resampleAlphaMap(alphaMap, size, 1, dx, dy)
+	return shifted
+}
+
+func TestDetect_WatermarkedImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	testCases := []struct {
+		width, height int
+		expectedSize  int
+	}{
+		{800, 600, 48},
+		{1024, 1024, 48},
+		{1200, 1200, 96},
+	}
+
+	for _, tc := range testCases {
+		img := createNoiseImage(tc.width, tc.height, 1)
+		config, region := GetWatermarkInfo(tc.width, tc.height)
+		applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+		detection := engine.Detect(img)
+
+		if !detection.Detected {
+			t.Errorf("dimensions %dx%d: watermark not detected (confidence %.3f)",
+				tc.width, tc.height, detection.Confidence)
+		}
+		if detection.Config.Size != tc.expectedSize {
+			t.Errorf("dimensions %dx%d: expected size %d, got %d",
+				tc.width, tc.height, tc.expectedSize, detection.Config.Size)
+		}
+		if detection.Region != region {
+			t.Errorf("dimensions %dx%d: expected region %v, got %v",
+				tc.width, tc.height, region, detection.Region)
+		}
+		if detection.Confidence < 0.9 {
+			t.Errorf("dimensions %dx%d: expected confidence >= 0.9, got %.3f",
+				tc.width, tc.height, detection.Confidence)
+		}
+	}
+}
+
+func TestDetect_CleanImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	img := createNoiseImage(800, 600, 2)
+	detection := engine.Detect(img)
+
+	if detection.Detected {
+		t.Errorf("clean image reported as watermarked (confidence %.3f)", detection.Confidence)
+	}
+	if detection.Confidence >= DetectionThreshold {
+		t.Errorf("clean image confidence %.3f should be below threshold %.3f",
+			detection.Confidence, DetectionThreshold)
+	}
+}
+
+func TestDetect_SolidImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// A flat region carries no evidence, so confidence must be exactly zero
+	img := createTestImage(200, 200, color.RGBA{R: 100, G: 150, B: 200, A: 255})
+	detection := engine.Detect(img)
+
+	if detection.Detected || detection.Confidence != 0 {
+		t.Errorf("solid image: expected no detection with zero confidence, got %v (%.3f)",
+			detection.Detected, detection.Confidence)
+	}
+}
+
+func TestDetect_NonZeroOrigin(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Sub-images keep the parent's coordinate space
+	parent := createNoiseImage(900, 700, 3)
+	sub := parent.SubImage(image.Rect(100, 100, 900, 700)).(*image.RGBA)
+	config, region := GetWatermarkInfo(800, 600)
+	region = region.Add(image.Pt(100, 100))
+	applyWatermark(sub, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.Detect(sub)
+
+	if !detection.Detected {
+		t.Errorf("watermark in sub-image not detected (confidence %.3f)", detection.Confidence)
+	}
+	if detection.Region != region {
+		t.Errorf("expected region %v, got %v", region, detection.Region)
+	}
+}
+
+func TestDetect_TinyImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// The watermark region lies almost entirely outside a 40x40 image
+	img := createNoiseImage(40, 40, 4)
+	detection := engine.Detect(img)
+
+	if detection.Detected || detection.Confidence != 0 {
+		t.Errorf("tiny image: expected no detection with zero confidence, got %v (%.3f)",
+			detection.Detected, detection.Confidence)
+	}
+}
+
+func TestDetect_PrefersBetterFittingCandidate(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	testCases := []struct {
+		width, height int
+		actual        WatermarkConfig
+	}{
+		// Non-square outputs where the dimension rule predicts 48px
+		{1024, 1536, WatermarkConfig{Size: 96, Margin: 64}},
+		{896, 1280, WatermarkConfig{Size: 96, Margin: 64}},
+		// Large image that nevertheless carries the small watermark
+		{1200, 1200, WatermarkConfig{Size: 48, Margin: 32}},
+	}
+
+	for _, tc := range testCases {
+		img := createNoiseImage(tc.width, tc.height, 5)
+		region := CalculatePosition(tc.width, tc.height, tc.actual)
+		applyWatermark(img, region, engine.profileByConfig(tc.actual).AlphaMap)
+
+		detection := engine.Detect(img)
+
+		if detection.Config != tc.actual {
+			t.Errorf("dimensions %dx%d: expected config %v, got %v",
+				tc.width, tc.height, tc.actual, detection.Config)
+		}
+		if detection.Selection != SelectedByContent {
+			t.Errorf("dimensions %dx%d: expected selection by content, got %v",
+				tc.width, tc.height, detection.Selection)
+		}
+		if detection.Region != region {
+			t.Errorf("dimensions %dx%d: expected region %v, got %v",
+				tc.width, tc.height, region, detection.Region)
+		}
+		if len(detection.Scores) != len(engine.Profiles()) {
+			t.Errorf("dimensions %dx%d: expected %d scores, got %d",
+				tc.width, tc.height, len(engine.Profiles()), len(detection.Scores))
+		}
+	}
+}
+
+func TestDetect_KeepsDimensionRuleWithoutWatermark(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	img := createNoiseImage(1024, 1536, 6)
+	detection := engine.Detect(img)
+
+	if detection.Config != DetectConfig(1024, 1536) {
+		t.Errorf("expected dimension rule config %v, got %v", DetectConfig(1024, 1536), detection.Config)
+	}
+	if detection.Selection != SelectedByDimensions {
+		t.Errorf("expected selection by dimensions, got %v", detection.Selection)
+	}
+}
+
+func TestDetectNear_CroppedImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Watermark applied to an 800x600 image that was then cropped by 5px on
+	// the right and 3px at the bottom, moving it closer to the edges
+	config, region := GetWatermarkInfo(800, 600)
+	img := createNoiseImage(800, 600, 8)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+	cropped := img.SubImage(image.Rect(0, 0, 795, 597)).(*image.RGBA)
+
+	if detection := engine.Detect(cropped); detection.Region == region {
+		t.Fatalf("fixed detection unexpectedly found the shifted watermark")
+	}
+
+	detection := engine.DetectNear(cropped, 8)
+
+	if !detection.Detected {
+		t.Errorf("cropped image: watermark not detected (confidence %.3f)", detection.Confidence)
+	}
+	if detection.Region != region {
+		t.Errorf("cropped image: expected region %v, got %v", region, detection.Region)
+	}
+	if math.Abs(detection.OffsetX) > 0.1 || math.Abs(detection.OffsetY) > 0.1 {
+		t.Errorf("cropped image: expected negligible sub-pixel offset, got (%.2f, %.2f)",
+			detection.OffsetX, detection.OffsetY)
+	}
+}
+
+func TestDetectNear_PaddedImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// An 800x600 image padded to 806x604 keeps the watermark where it was
+	config, region := GetWatermarkInfo(800, 600)
+	img := createNoiseImage(806, 604, 9)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.DetectNear(img, 8)
+
+	if !detection.Detected {
+		t.Errorf("padded image: watermark not detected (confidence %.3f)", detection.Confidence)
+	}
+	if detection.Region != region {
+		t.Errorf("padded image: expected region %v, got %v", region, detection.Region)
+	}
+}
+
+func TestDetectNear_OutsideRadius(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	config, region := GetWatermarkInfo(800, 600)
+	img := createNoiseImage(800, 600, 10)
+	applyWatermark(img, region.Add(image.Pt(-20, -20)), engine.profileByConfig(config).AlphaMap)
+
+	if detection := engine.DetectNear(img, 4); detection.Detected {
+		t.Errorf("watermark 20px away should not be found with radius 4 (confidence %.3f)",
+			detection.Confidence)
+	}
+}
+
+func TestDetectNear_SubPixelOffset(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Apply a watermark shifted by a fraction of a pixel
+	config, region := GetWatermarkInfo(800, 600)
+	const offsetX, offsetY = 0.4, -0.3
+	img := createNoiseImage(800, 600, 11)
+	applyWatermark(img, region, shiftAlphaMap(engine.profileByConfig(config).AlphaMap, config.Size, offsetX, offsetY))
+
+	detection := engine.DetectNear(img, 4)
+
+	if detection.Region != region {
+		t.Fatalf("expected region %v, got %v", region, detection.Region)
+	}
+	if math.Abs(detection.OffsetX-offsetX) > 0.25 || math.Abs(detection.OffsetY-offsetY) > 0.25 {
+		t.Errorf("expected offset near (%.2f, %.2f), got (%.2f, %.2f)",
+			offsetX, offsetY, detection.OffsetX, detection.OffsetY)
+	}
+}
+
+func TestDetectNear_IgnoresTinyOffsets(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Watermarks on the pixel grid, or shifted by less than
+	// minSubPixelOffset, keep the unshifted alpha map
+	config, region := GetWatermarkInfo(800, 600)
+	for i, offset := range []float64{0, 0.05} {
+		img := createNoiseImage(800, 600, int64(20+i))
+		applyWatermark(img, region, shiftAlphaMap(engine.profileByConfig(config).AlphaMap, config.Size, offset, -offset))
+
+		detection := engine.DetectNear(img, 4)
+
+		if detection.Region != region {
+			t.Fatalf("offset %.2f: expected region %v, got %v", offset, region, detection.Region)
+		}
+		if detection.OffsetX != 0 || detection.OffsetY != 0 {
+			t.Errorf("offset %.2f: expected no sub-pixel offset, got (%.3f, %.3f)",
+				offset, detection.OffsetX, detection.OffsetY)
+		}
+	}
+}
+
+func TestParabolicPeak(t *testing.T) {
+	testCases := []struct {
+		left, center, right float64
+		expected            float64
+	}{
+		{0.5, 1.0, 0.5, 0},     // Symmetric peak
+		{0.8, 1.0, 0.4, -0.25}, // Peak pulled toward the left
+		{0.4, 1.0, 0.8, 0.25},  // Peak pulled toward the right
+		{1.0, 0.5, 1.0, 0},     // Not a maximum
+		{0.0, 0.0, 0.0, 0},     // Flat
+		{0.98, 1.0, 0.975, 0},  // Offset too small to matter
+	}
+
+	for _, tc := range testCases {
+		result := parabolicPeak(tc.left, tc.center, tc.right)
+		if math.Abs(result-tc.expected) > 1e-9 {
+			t.Errorf("parabolicPeak(%.1f, %.1f, %.1f) = %f, expected %f",
+				tc.left, tc.center, tc.right, result, tc.expected)
+		}
+	}
+}
+
+func TestShiftAlphaMap(t *testing.T) {
+	alphaMap := []float32{
+		0, 0, 0,
+		0, 1, 0,
+		0, 0, 0,
+	}
+
+	// Integer shift moves the peak
+	shifted := shiftAlphaMap(alphaMap, 3, 1, 0)
+	if shifted[1*3+2] != 1 || shifted[1*3+1] != 0 {
+		t.Errorf("shift by (1, 0): got %v", shifted)
+	}
+
+	// Half-pixel shift splits the peak between two pixels
+	shifted = shiftAlphaMap(alphaMap, 3, 0, 0.5)
+	if shifted[1*3+1] != 0.5 || shifted[2*3+1] != 0.5 {
+		t.Errorf("shift by (0, 0.5): got %v", shifted)
+	}
+}
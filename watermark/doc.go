@@ -22,12 +22,119 @@
 //
 //	original = (watermarked - alpha * 255) / (1 - alpha)
 //
+// The inversion amplifies noise by 1 / (1 - alpha) and cannot recover
+// saturated pixels. Engine.SetInpaintFallback enables a fallback that fills
+// such pixels from their neighbors by diffusion inpainting, blended with the
+// reverse blend according to how reliable it is. Engine.SetRegularization
+// instead damps the amplified noise, shrinking heavily amplified pixels
+// towards their local mean (see RegularizedBlend).
+//
+// Decoded JPEGs (*image.YCbCr) are restored without converting them to RGB.
+// The blend is inverted per luma pixel and per chroma sample, using the mean
+// alpha of the pixels a subsampled chroma sample covers, and the JPEG block
+// boundaries inside the watermark are smoothed where the inversion amplified
+// quantization steps.
+//
+// 16-bit images (*image.RGBA64, *image.NRGBA64, *image.Gray16) are restored
+// at full precision into a 16-bit result, since truncating them to 8 bits
+// first would let the inversion amplify the truncation error. Pixels of
+// semi-transparent images are restored on their straight color, which is
+// what the watermark was blended with, and keep their alpha. In general the
+// result has the type of the input: grayscale, paletted (re-quantized to
+// the same palette), Y'CbCr, straight-alpha and 16-bit images are restored
+// on a copy of their own type.
+//
+// Alternatively, Engine.SetStrategy(StrategyInpaint) discards every pixel
+// covered by the alpha map and synthesizes it by PatchMatch exemplar
+// inpainting from the texture around the watermark. This trades the exact
+// recovery of the reverse blend for robustness against recompression.
+//
+// Both are implementations of the Restorer interface, which computes the
+// pixels under a watermark from the image, the region, the alpha map and the
+// profile. ReverseBlend, DiffusionInpaint and PatchMatchInpaint are the
+// built-in restorers; Hybrid combines two of them per pixel, keeping the
+// primary result where it is trusted. Engine.SetRestorer plugs in any other
+// algorithm:
+//
+//	engine.SetRestorer(watermark.Hybrid{
+//	    Primary:  watermark.ReverseBlend{},
+//	    Fallback: watermark.PatchMatchInpaint{},
+//	})
+//
 // # Watermark Detection
 //
 // The watermark size and position depend on the image dimensions:
 //   - Images larger than 1024x1024: 96x96 watermark, 64px from edges
 //   - Smaller images: 48x48 watermark, 32px from edges
 //
+// Because some resolutions (for example 1024x1536) do not follow this rule,
+// Detect evaluates every registered profile against the image content and
+// reports which one matched best in Detection.Profile and Detection.Selection.
+//
+// Images that were cropped or padded after generation have their watermark a
+// few pixels away from the expected position. Engine.DetectNear searches a
+// window around it, refines the match to sub-pixel precision and returns a
+// Detection that Engine.RemoveDetected can use directly:
+//
+//	detection := engine.DetectNear(img, 8)
+//	cleaned := engine.RemoveDetected(img, detection)
+//
+// When a Gemini image was pasted into a screenshot, collage or slide, the
+// watermark can be anywhere. Engine.FindAll scans the whole image and returns
+// every match, which Engine.RemoveAll removes in one pass:
+//
+//	detections := engine.FindAll(img, watermark.DefaultFindThreshold)
+//	cleaned := engine.RemoveAll(img, detections)
+//
+// Images that were resized after generation carry a watermark of a different
+// size. Engine.DetectScaled resamples the alpha maps to a range of scales
+// (DefaultScales) and reports the best fitting one in Detection.Scale;
+// removal then uses the resampled map.
+//
+// If the overlay's opacity or color shifted slightly, or the image went
+// through color management, Engine.FitBlend fits a per-image opacity scale
+// and logo color and records them in Detection.Fit for removal:
+//
+//	detection := engine.FitBlend(img, engine.Detect(img))
+//	cleaned := engine.RemoveDetected(img, detection)
+//
+// Engine.Detect checks whether an image actually carries the watermark by
+// correlating the brightness of the expected region with the alpha map. The
+// returned Detection holds the evaluated configuration, the region and a
+// confidence score in [0.0, 1.0]:
+//
+//	detection := engine.Detect(img)
+//	if detection.Detected {
+//	    fmt.Printf("watermark at %v (confidence %.2f)\n", detection.Region, detection.Confidence)
+//	}
+//
+// # Watermark Profiles
+//
+// A Profile describes one watermark variant: its alpha map, logo color, size,
+// margin and a SelectionRule naming the image dimensions it is expected on.
+// NewEngine registers the built-in profiles gemini-48 and gemini-96 (see
+// DefaultProfiles). New variants are supported by registering another
+// profile instead of changing the engine:
+//
+//	profile, err := watermark.NewProfile("custom-64", reference, 40, watermark.SelectionRule{})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	if err := engine.RegisterProfile(profile); err != nil {
+//	    log.Fatal(err)
+//	}
+//
+// Profiles can also be shipped as bundles on disk: a reference PNG and a JSON
+// descriptor (see ProfileDescriptor). NewEngine loads the bundles found at the
+// given paths after the built-in profiles:
+//
+//	engine, err := watermark.NewEngine(watermark.WithProfilePaths("./profiles"))
+//
+// Calibrate measures a profile from captures of the watermark over known
+// backgrounds, without assuming a white logo, and SaveProfile writes the
+// result as a bundle. When only watermarked images are available, an
+// Estimator derives the profile from the statistics of many of them.
+//
 // # Usage
 //
 // Basic usage:
@@ -43,6 +150,22 @@
 //	// Remove watermark
 //	cleaned := engine.RemoveWatermark(img)
 //
+// RemoveWatermark and RemoveAll return a full copy of the image. For large
+// images, RemoveOverlay returns an Overlay that serves the original pixels
+// and restores only the surroundings of the watermarks into small patches,
+// and RemoveInPlace restores an image that may be modified in place:
+//
+//	detections := []watermark.Detection{engine.Detect(img)}
+//	cleaned := engine.RemoveOverlay(img, detections)
+//
+// Services that process many images reuse their buffers with RemoveInto,
+// which writes into a caller-supplied destination and, for the common image
+// types, does not allocate. One Engine can be shared by any number of
+// goroutines:
+//
+//	dst := image.NewRGBA(img.Bounds())
+//	result, err := engine.RemoveInto(dst, img)
+//
 // # Reference Images
 //
 // The package embeds reference images (bg_48.png and bg_96.png) that contain
@@ -3,8 +3,8 @@ package watermark
 import (
 	"fmt"
 	"image"
-	"image/color"
 	"image/draw"
+	"sync"
 )
 
 // Algorithm constants for watermark removal.
@@ -13,15 +13,19 @@ const (
 	// AlphaThreshold is the minimum alpha value to process.
 	// Pixels with alpha below this are considered transparent and skipped.
 	// This avoids unnecessary processing and potential numerical issues.
+	// Engines may use another threshold (see WithAlphaThreshold).
 	AlphaThreshold = 0.002
 
 	// MaxAlpha is the maximum alpha value allowed during processing.
 	// Values above this are clamped to prevent division by near-zero
 	// in the reverse blending formula (1 - alpha would be too small).
+	// Engines may use another maximum (see WithMaxAlpha and
+	// WithClampMode).
 	MaxAlpha = 0.99
 
 	// LogoValue is the color value of the Gemini watermark logo.
-	// The logo is white, so all RGB channels are 255.
+	// The logo is white, so all RGB channels are 255. Engines may use
+	// another color for the built-in profiles (see WithLogoColor).
 	LogoValue = 255.0
 )
 
@@ -35,46 +39,175 @@ type WatermarkConfig struct {
 	Margin int
 }
 
+// String returns a short human-readable description such as "48x48, 32px margin".
+func (c WatermarkConfig) String() string {
+	return fmt.Sprintf("%dx%d, %dpx margin", c.Size, c.Size, c.Margin)
+}
+
 // Engine handles watermark removal with pre-computed alpha maps.
 // Create an Engine once and reuse it for multiple images to avoid
 // recalculating alpha maps.
+//
+// The engine keeps a registry of watermark profiles. NewEngine registers the
+// built-in Gemini profiles; RegisterProfile adds further variants.
+//
+// An Engine is safe for concurrent use by multiple goroutines, so a single
+// engine can serve a whole process. Detection and removal only read the
+// engine: registered profiles are never modified, and each call takes its
+// own scratch buffers from an internal pool. RegisterProfile and the setters
+// may run concurrently with them; a call in progress may observe the change
+// for the detections it has not processed yet. The images passed to a call
+// must not be modified while it runs, and concurrent calls must not write to
+// the same destination image.
 type Engine struct {
-	// alphaMap48 contains alpha values for the 48x48 watermark.
-	// Each value is in the range [0.0, 1.0].
-	alphaMap48 []float32
+	// mu guards profiles and the settings below.
+	mu sync.RWMutex
+
+	// profiles holds the registered watermark profiles in registration
+	// order. Registered profiles are never modified.
+	profiles []*Profile
+
+	// inpaintFallback fills unreliable reverse-blend results by inpainting
+	// (see SetInpaintFallback).
+	inpaintFallback bool
+
+	// regularization is the strength of the regularized inversion (see
+	// SetRegularization).
+	regularization float64
+
+	// strategy selects how watermarked pixels are restored (see
+	// SetStrategy).
+	strategy Strategy
+
+	// restorer, if set, overrides the restorer selected by strategy and
+	// inpaintFallback (see SetRestorer).
+	restorer Restorer
 
-	// alphaMap96 contains alpha values for the 96x96 watermark.
-	// Each value is in the range [0.0, 1.0].
-	alphaMap96 []float32
+	// inverse holds the inverse tables precomputed for the registered
+	// profiles whose alpha maps allow them (see newInverseTable).
+	inverse map[*Profile]*inverseTable
+
+	// alphaThreshold, maxAlpha and clamp limit the alpha the watermark is
+	// inverted with (see WithAlphaThreshold, WithMaxAlpha and
+	// WithClampMode). They are set by NewEngine and never change, so they
+	// are read without the lock; zero values select the defaults.
+	alphaThreshold float64
+	maxAlpha       float64
+	clamp          ClampMode
 }
 
-// NewEngine creates a new watermark removal engine.
-// It loads the embedded reference images and pre-computes the alpha maps.
-// Returns an error if the reference images cannot be loaded.
-func NewEngine() (*Engine, error) {
-	// Load and calculate alpha map for 48x48 watermark (used for smaller images)
-	img48, err := LoadReferenceImage(48)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load 48px reference: %w", err)
+// NewEngine creates a new watermark removal engine configured by opts.
+// It loads the embedded reference images and registers the default profiles
+// with their pre-computed alpha maps and inverse tables (see DefaultProfiles
+// and RegisterProfile), followed by the profile bundles of WithProfilePaths
+// (see LoadProfiles), keeping only those selected by WithProfiles.
+// Returns an error if an option is out of range, if a reference image or
+// bundle cannot be loaded, or if a bundle reuses the name of another
+// profile.
+func NewEngine(opts ...Option) (*Engine, error) {
+	config := newEngineConfig(opts)
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
-	alphaMap48 := CalculateAlphaMap(img48)
 
-	// Load and calculate alpha map for 96x96 watermark (used for larger images)
-	img96, err := LoadReferenceImage(96)
+	profiles, err := DefaultProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if config.logoColor != nil {
+		for i := range profiles {
+			profiles[i].LogoColor = *config.logoColor
+		}
+	}
+	for _, path := range config.profilePaths {
+		loaded, err := LoadProfiles(path)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, loaded...)
+	}
+	profiles, err = config.selectProfiles(profiles)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load 96px reference: %w", err)
+		return nil, err
 	}
-	alphaMap96 := CalculateAlphaMap(img96)
 
-	return &Engine{
-		alphaMap48: alphaMap48,
-		alphaMap96: alphaMap96,
-	}, nil
+	engine := &Engine{
+		inpaintFallback: config.inpaintFallback,
+		regularization:  config.regularization,
+		strategy:        config.strategy,
+		restorer:        config.restorer,
+		alphaThreshold:  config.alphaThreshold,
+		maxAlpha:        config.maxAlpha,
+		clamp:           config.clamp,
+	}
+	for _, profile := range profiles {
+		if err := engine.RegisterProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+// AlphaThreshold returns the minimum alpha of the pixels the engine
+// restores (see WithAlphaThreshold).
+func (e *Engine) AlphaThreshold() float64 {
+	threshold, _ := e.alphaLimits()
+	return threshold
+}
+
+// MaxAlpha returns the largest alpha the engine inverts the blend with (see
+// WithMaxAlpha).
+func (e *Engine) MaxAlpha() float64 {
+	_, maxAlpha := e.alphaLimits()
+	return maxAlpha
+}
+
+// ClampMode returns how the engine restores pixels above the maximum alpha
+// (see WithClampMode).
+func (e *Engine) ClampMode() ClampMode {
+	return e.clamp
+}
+
+// alphaLimits returns the engine's alpha threshold and maximum alpha.
+func (e *Engine) alphaLimits() (threshold, maxAlpha float64) {
+	return defaultLimits(e.alphaThreshold, e.maxAlpha)
+}
+
+// limitAlpha returns the alpha to invert the blend with for an alpha map
+// value, under the engine's limits: 0 (skip the pixel) below the threshold
+// or, with SkipAboveMax, above the maximum alpha; the maximum alpha above
+// it with ClampToMax.
+func (e *Engine) limitAlpha(alpha float32) float32 {
+	threshold, maxAlpha := e.alphaLimits()
+	switch {
+	case float64(alpha) < threshold:
+		return 0
+	case float64(alpha) <= maxAlpha:
+		return alpha
+	case e.clamp == SkipAboveMax:
+		return 0
+	}
+	return float32(maxAlpha)
+}
+
+// limitAlphaMap applies limitAlpha to an alpha map. It returns the map
+// itself with ClampToMax, as restorers apply the threshold and clamp to the
+// maximum alpha on their own (see Profile.AlphaThreshold).
+func (e *Engine) limitAlphaMap(alphaMap []float32) []float32 {
+	if e.clamp == ClampToMax {
+		return alphaMap
+	}
+	limited := make([]float32, len(alphaMap))
+	for i, alpha := range alphaMap {
+		limited[i] = e.limitAlpha(alpha)
+	}
+	return limited
 }
 
 // DetectConfig determines the watermark configuration based on image dimensions.
 // Gemini uses a larger watermark (96x96) for images where both dimensions
 // exceed 1024 pixels, and a smaller one (48x48) for everything else.
+// This is the rule encoded by the selection rules of DefaultProfiles.
 func DetectConfig(width, height int) WatermarkConfig {
 	if width > 1024 && height > 1024 {
 		return WatermarkConfig{Size: 96, Margin: 64}
@@ -93,103 +226,137 @@ func CalculatePosition(imgWidth, imgHeight int, config WatermarkConfig) image.Re
 }
 
 // RemoveWatermark removes the Gemini watermark from an image.
-// It automatically detects the appropriate watermark size based on
-// the image dimensions and applies reverse alpha blending to restore
-// the original pixels.
+// It evaluates every registered profile against the image content
+// (see Detect), picks the best fit and applies reverse alpha
+// blending to restore the original pixels. When no profile matches,
+// the one expected for the image dimensions is used.
 //
 // The function returns a new image with the watermark removed.
 // The original image is not modified.
 func (e *Engine) RemoveWatermark(img image.Image) image.Image {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	// Create a new RGBA image and copy the source into it.
-	// We work on a copy to avoid modifying the original.
-	result := image.NewRGBA(bounds)
-	draw.Draw(result, bounds, img, bounds.Min, draw.Src)
-
-	// Detect watermark configuration based on image size
-	config := DetectConfig(width, height)
-	position := CalculatePosition(width, height, config)
-
-	// Select the appropriate pre-computed alpha map
-	var alphaMap []float32
-	if config.Size == 96 {
-		alphaMap = e.alphaMap96
-	} else {
-		alphaMap = e.alphaMap48
-	}
-
-	// Process each pixel in the watermark region.
-	// Apply the reverse alpha blending formula to recover original colors.
-	for row := 0; row < config.Size; row++ {
-		for col := 0; col < config.Size; col++ {
-			// Calculate image coordinates for this watermark pixel
-			imgX := position.Min.X + col
-			imgY := position.Min.Y + row
-
-			// Skip pixels outside image bounds (edge cases)
-			if imgX < 0 || imgY < 0 || imgX >= width || imgY >= height {
-				continue
-			}
-
-			// Get alpha value from pre-computed map
-			alphaIdx := row*config.Size + col
-			alpha := alphaMap[alphaIdx]
-
-			// Skip nearly-transparent pixels (no watermark effect here)
-			if alpha < AlphaThreshold {
-				continue
-			}
-
-			// Clamp alpha to prevent division by values too close to zero.
-			// When alpha approaches 1.0, (1 - alpha) approaches 0, causing
-			// numerical instability in the division.
-			if alpha > MaxAlpha {
-				alpha = MaxAlpha
-			}
-
-			// Pre-compute (1 - alpha) for the reverse blending formula
-			oneMinusAlpha := 1.0 - float64(alpha)
-
-			// Get the current (watermarked) pixel values.
-			// RGBA() returns values in [0, 65535], so we shift to get [0, 255].
-			r, g, b, a := result.At(imgX, imgY).RGBA()
-			watermarkedR := float64(r >> 8)
-			watermarkedG := float64(g >> 8)
-			watermarkedB := float64(b >> 8)
-
-			// Apply reverse alpha blending formula:
-			// original = (watermarked - alpha * logo) / (1 - alpha)
-			//
-			// This inverts the formula Gemini used to apply the watermark:
-			// watermarked = alpha * logo + (1 - alpha) * original
-			alphaF := float64(alpha)
-			originalR := (watermarkedR - alphaF*LogoValue) / oneMinusAlpha
-			originalG := (watermarkedG - alphaF*LogoValue) / oneMinusAlpha
-			originalB := (watermarkedB - alphaF*LogoValue) / oneMinusAlpha
-
-			// Clamp results to valid 8-bit range [0, 255].
-			// Values can go out of range due to JPEG compression artifacts
-			// or slight variations in the watermark application.
-			originalR = clamp(originalR, 0, 255)
-			originalG = clamp(originalG, 0, 255)
-			originalB = clamp(originalB, 0, 255)
-
-			// Write the restored pixel back to the result image
-			result.SetRGBA(imgX, imgY, color.RGBA{
-				R: uint8(originalR),
-				G: uint8(originalG),
-				B: uint8(originalB),
-				A: uint8(a >> 8), // Preserve original alpha
-			})
+	return e.RemoveDetected(img, e.Detect(img))
+}
+
+// RemoveDetected removes the watermark described by a previous call to
+// Detect. This lets callers inspect the detection result (and decide whether
+// to proceed) without running detection twice.
+//
+// The function returns a new image with the watermark removed.
+// The original image is not modified.
+func (e *Engine) RemoveDetected(img image.Image, detection Detection) image.Image {
+	return e.RemoveAll(img, []Detection{detection})
+}
+
+// RemoveAll removes every watermark in detections, typically the result of
+// FindAll, from a single copy of the image.
+//
+// Y'CbCr images (decoded JPEGs) restored with the default ReverseBlend are
+// processed in Y'CbCr space, taking chroma subsampling into account, and
+// deblocked inside the watermark (see removeYCbCr). Other restorers work on
+// an RGBA copy whose restored pixels are converted back (see mergeYCbCr), so
+// the result is an *image.YCbCr with the same subsampling either way.
+//
+// Other images are restored on a copy of their own type (see
+// newResultImage), keeping their color model: grayscale images stay
+// grayscale, paletted images keep their palette (restored pixels take the
+// nearest palette color), straight and premultiplied alpha and 16-bit depth
+// are preserved. Semi-transparent pixels are restored on their straight
+// color and keep their alpha.
+//
+// The function returns a new image with the watermarks removed.
+// The original image is not modified.
+func (e *Engine) RemoveAll(img image.Image, detections []Detection) image.Image {
+	if src, ok := img.(*image.YCbCr); ok {
+		if _, exact := e.Restorer().(ReverseBlend); exact {
+			return e.removeYCbCr(src, detections)
 		}
+		working := image.NewRGBA(src.Rect)
+		draw.Draw(working, src.Rect, src, src.Rect.Min, draw.Src)
+		var areas []image.Rectangle
+		for _, detection := range detections {
+			areas = append(areas, e.restore(working, detection))
+		}
+		return mergeYCbCr(src, working, areas)
+	}
+
+	// Work on a copy to avoid modifying the original
+	result := newResultImage(img)
+	for _, detection := range detections {
+		e.restore(result, detection)
 	}
 
 	return result
 }
 
+// restore replaces in place the pixels of result covered by the detected
+// watermark with the values computed by the engine's Restorer, and returns
+// the area of result it may have changed.
+func (e *Engine) restore(result draw.Image, detection Detection) image.Rectangle {
+	// The default restorer works on the Pix slices of 8-bit images directly
+	if area, ok := e.restoreTable(result, detection); ok {
+		return area
+	}
+	bounds := result.Bounds()
+
+	// Detections referring to an unknown profile have nothing to reverse
+	region, alphaMap, profile, ok := e.restoreInputs(detection)
+	if !ok {
+		return image.Rectangle{}
+	}
+	size := region.Dx()
+	threshold, _ := profile.alphaLimits()
+
+	restoration := e.Restorer().Restore(result, region, alphaMap, profile)
+	checkRestoration(restoration, alphaMap)
+
+	// Write the restored pixels back, keeping the original alpha
+	for i, alpha := range alphaMap {
+		x, y := region.Min.X+i%size, region.Min.Y+i/size
+		if float64(alpha) < threshold || !image.Pt(x, y).In(bounds) {
+			continue
+		}
+
+		// Results are clamped to the valid range [0, 255].
+		// Values can go out of range due to JPEG compression artifacts
+		// or slight variations in the watermark application.
+		setRestored(result, x, y, restoration.Pixels[i])
+	}
+	return region.Intersect(bounds)
+}
+
+// restoreInputs returns what a restorer needs for the detected watermark:
+// the region it covers, its alpha map (resampled to the scale and sub-pixel
+// position found by a search, scaled by a fitted gain and without the pixels
+// SkipAboveMax skips) and its profile (with a fitted logo color and the
+// engine's alpha limits). ok is false if the detection refers to an unknown
+// profile.
+func (e *Engine) restoreInputs(detection Detection) (region image.Rectangle, alphaMap []float32, profile Profile, ok bool) {
+	registered := e.profileFor(detection)
+	if registered == nil {
+		return image.Rectangle{}, nil, Profile{}, false
+	}
+	profile = *registered
+	profile.AlphaThreshold, profile.MaxAlpha = e.alphaLimits()
+
+	// Select the profile's pre-computed alpha map, resampled to the
+	// scale and sub-pixel position found by a search
+	alphaMap, size := detectionAlphaMap(registered, detection)
+	region = image.Rect(detection.Region.Min.X, detection.Region.Min.Y,
+		detection.Region.Min.X+size, detection.Region.Min.Y+size)
+
+	// Apply per-image corrections fitted by FitBlend
+	if detection.Fit != nil {
+		gain := float32(detection.Fit.Gain)
+		scaled := make([]float32, len(alphaMap))
+		for i, alpha := range alphaMap {
+			scaled[i] = alpha * gain
+		}
+		alphaMap = scaled
+		profile.LogoColor = detection.Fit.LogoColor
+	}
+	return region, e.limitAlphaMap(alphaMap), profile, true
+}
+
 // GetWatermarkInfo returns information about the watermark configuration
 // and position for a given image size. Useful for debugging or displaying
 // information to the user.
@@ -3,6 +3,8 @@ package watermark
 import (
 	"image"
 	"image/color"
+	"image/draw"
+	"reflect"
 	"testing"
 )
 
@@ -185,12 +187,19 @@ func TestNewEngine(t *testing.T) {
 		t.Fatal("NewEngine() returned nil engine")
 	}
 
-	// Verify alpha maps are populated
-	if len(engine.alphaMap48) != 48*48 {
-		t.Errorf("expected alphaMap48 length %d, got %d", 48*48, len(engine.alphaMap48))
-	}
-	if len(engine.alphaMap96) != 96*96 {
-		t.Errorf("expected alphaMap96 length %d, got %d", 96*96, len(engine.alphaMap96))
+	// Verify the default profiles are registered with their alpha maps
+	for _, tc := range []struct {
+		name string
+		size int
+	}{{ProfileGemini48, 48}, {ProfileGemini96, 96}} {
+		profile, ok := engine.Profile(tc.name)
+		if !ok {
+			t.Errorf("expected profile %q to be registered", tc.name)
+			continue
+		}
+		if len(profile.AlphaMap) != tc.size*tc.size {
+			t.Errorf("profile %q: expected alpha map length %d, got %d", tc.name, tc.size*tc.size, len(profile.AlphaMap))
+		}
 	}
 }
 
@@ -278,3 +287,214 @@ func TestConstants(t *testing.T) {
 		t.Errorf("LogoValue should be 255.0 (white), got %f", LogoValue)
 	}
 }
+
+func TestRemoveWatermark_RestoresOriginalPixels(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// The 96px watermark on a 1024x1536 image is only found by content matching
+	width, height := 1024, 1536
+	config := WatermarkConfig{Size: 96, Margin: 64}
+	region := CalculatePosition(width, height, config)
+
+	original := createNoiseImage(width, height, 7)
+	img := createNoiseImage(width, height, 7)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	result := engine.RemoveWatermark(img)
+
+	// Reverse blending amplifies 8-bit rounding by up to 1/(1-alpha)
+	const tolerance = 3
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			r, g, b, _ := result.At(x, y).RGBA()
+			want := original.RGBAAt(x, y)
+			if absDiff(uint8(r>>8), want.R) > tolerance ||
+				absDiff(uint8(g>>8), want.G) > tolerance ||
+				absDiff(uint8(b>>8), want.B) > tolerance {
+				t.Fatalf("pixel (%d,%d): got (%d,%d,%d), expected (%d,%d,%d)",
+					x, y, r>>8, g>>8, b>>8, want.R, want.G, want.B)
+			}
+		}
+	}
+}
+
+// absDiff returns the absolute difference between two 8-bit values.
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestRemoveDetected_CroppedImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Crop a watermarked 800x600 image so the watermark is off its expected spot
+	config, region := GetWatermarkInfo(800, 600)
+	original := createNoiseImage(800, 600, 12)
+	img := createNoiseImage(800, 600, 12)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+	cropped := img.SubImage(image.Rect(0, 0, 796, 598))
+
+	result := engine.RemoveDetected(cropped, engine.DetectNear(cropped, 8))
+
+	const tolerance = 3
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			r, g, b, _ := result.At(x, y).RGBA()
+			want := original.RGBAAt(x, y)
+			if absDiff(uint8(r>>8), want.R) > tolerance ||
+				absDiff(uint8(g>>8), want.G) > tolerance ||
+				absDiff(uint8(b>>8), want.B) > tolerance {
+				t.Fatalf("pixel (%d,%d): got (%d,%d,%d), expected (%d,%d,%d)",
+					x, y, r>>8, g>>8, b>>8, want.R, want.G, want.B)
+			}
+		}
+	}
+}
+
+// genericReverseBlend is ReverseBlend without the inverse table fast path.
+var genericReverseBlend = RestorerFunc(ReverseBlend{}.Restore)
+
+// watermarkedInputs returns a watermarked noise image of width x height
+// converted to several image types, with the detection of its watermark.
+func watermarkedInputs(engine *Engine, width, height int) (inputs map[string]image.Image, detection Detection) {
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	detection = Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+
+	rgba := createNoiseImage(width, height, 5)
+	applyWatermark(rgba, region, profile.AlphaMap)
+	nrgba := image.NewNRGBA(rgba.Rect)
+	draw.Draw(nrgba, nrgba.Rect, rgba, image.Point{}, draw.Src)
+	gray := image.NewGray(rgba.Rect)
+	draw.Draw(gray, gray.Rect, rgba, image.Point{}, draw.Src)
+
+	inputs = map[string]image.Image{
+		"RGBA":  rgba,
+		"NRGBA": nrgba,
+		"Gray":  gray,
+		"YCbCr": toYCbCr(rgba, image.YCbCrSubsampleRatio420),
+	}
+	return inputs, detection
+}
+
+func TestRemoveDetected_InverseTableMatchesGeneric(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	generic, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	generic.SetRestorer(genericReverseBlend)
+
+	inputs, detection := watermarkedInputs(engine, 800, 600)
+	delete(inputs, "YCbCr")
+
+	// Semi-transparent and fully transparent pixels, in both alpha kinds
+	transparent := createTransparentGradient(800, 600)
+	applyWatermarkStraight(transparent, detection.Region, engine.profileByConfig(detection.Config).AlphaMap)
+	inputs["NRGBA transparent"] = transparent
+	premultiplied := image.NewRGBA(transparent.Rect)
+	draw.Draw(premultiplied, premultiplied.Rect, transparent, image.Point{}, draw.Src)
+	inputs["RGBA transparent"] = premultiplied
+
+	// A watermark partly outside a cropped image
+	inputs["RGBA cropped"] = inputs["RGBA"].(*image.RGBA).SubImage(image.Rect(0, 0, 780, 590))
+
+	for name, img := range inputs {
+		if _, ok := engine.restoreTable(newResultImage(img), detection); !ok {
+			t.Errorf("%s: inverse table not used", name)
+		}
+		if got, want := engine.RemoveDetected(img, detection), generic.RemoveDetected(img, detection); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: inverse table result differs from the generic reverse blend", name)
+		}
+	}
+
+	// Resampled alpha maps take the generic path
+	shifted := detection
+	shifted.OffsetX = 0.5
+	if _, ok := engine.restoreTable(newResultImage(inputs["RGBA"]), shifted); ok {
+		t.Error("inverse table used for a shifted watermark")
+	}
+
+	// Alpha maps with levels other than k/255 have no table
+	if newInverseTable(&Profile{AlphaMap: []float32{0.5}}, engine.limitAlpha) != nil {
+		t.Error("expected no inverse table for alpha 0.5")
+	}
+}
+
+func BenchmarkRemoveDetected(b *testing.B) {
+	engine, err := NewEngine()
+	if err != nil {
+		b.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// "default" is ReverseBlend, restored with the inverse tables (or in
+	// Y'CbCr space for YCbCr images); "generic" is the same reverse blend
+	// through the Restorer interface
+	restorers := []struct {
+		name     string
+		restorer Restorer
+	}{{"default", ReverseBlend{}}, {"generic", genericReverseBlend}}
+
+	for _, size := range []struct {
+		name          string
+		width, height int
+	}{{"48px", 800, 600}, {"96px", 1600, 1200}} {
+		inputs, detection := watermarkedInputs(engine, size.width, size.height)
+		for _, kind := range []string{"RGBA", "NRGBA", "Gray", "YCbCr"} {
+			for _, r := range restorers {
+				b.Run(size.name+"/"+kind+"/"+r.name, func(b *testing.B) {
+					engine.SetRestorer(r.restorer)
+					b.ReportAllocs()
+					for b.Loop() {
+						engine.RemoveDetected(inputs[kind], detection)
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkRestore measures the restoration alone, on a result image copied
+// once before the timed loop, so that the copy RemoveDetected makes does not
+// hide the speed of the inverse tables.
+func BenchmarkRestore(b *testing.B) {
+	engine, err := NewEngine()
+	if err != nil {
+		b.Fatalf("NewEngine() error: %v", err)
+	}
+	restorers := []struct {
+		name     string
+		restorer Restorer
+	}{{"default", ReverseBlend{}}, {"generic", genericReverseBlend}}
+
+	for _, size := range []struct {
+		name          string
+		width, height int
+	}{{"48px", 800, 600}, {"96px", 1600, 1200}} {
+		inputs, detection := watermarkedInputs(engine, size.width, size.height)
+		for _, kind := range []string{"RGBA", "NRGBA", "Gray"} {
+			for _, r := range restorers {
+				b.Run(size.name+"/"+kind+"/"+r.name, func(b *testing.B) {
+					engine.SetRestorer(r.restorer)
+					result := newResultImage(inputs[kind])
+					b.ReportAllocs()
+					b.ResetTimer()
+					for range b.N {
+						engine.restore(result, detection)
+					}
+				})
+			}
+		}
+	}
+}
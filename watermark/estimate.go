@@ -0,0 +1,181 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// MinEstimationImages is the smallest number of images Estimator accepts.
+// The estimate improves with the number of images; several hundred give an
+// alpha map close to a calibrated one.
+const MinEstimationImages = 10
+
+// estimationRing is the width of the band around the watermark region, as a
+// fraction of the watermark size, whose pixels describe the statistics of
+// unwatermarked content.
+const estimationRing = 0.5
+
+// Quantiles whose distance measures the spread of pixel values across images.
+const (
+	lowQuantile  = 0.1
+	highQuantile = 0.9
+)
+
+// Estimator derives a watermark profile from many watermarked images instead
+// of a capture on a known background.
+//
+// For a fixed pixel, the watermark maps every underlying value v to
+// alpha * logo + (1 - alpha) * v. This affine map preserves quantiles, so
+// across many different images the spread of watermarked values at that
+// pixel is (1 - alpha) times the spread of unwatermarked content, and their
+// median is shifted towards the logo color. The unwatermarked statistics
+// come from a band of pixels around the watermark region, which assumes the
+// images are diverse enough that content statistics do not depend on the
+// exact position.
+//
+// Values are accumulated in per-pixel histograms, so memory use does not
+// grow with the number of images. An Estimator is not safe for concurrent
+// use.
+type Estimator struct {
+	config WatermarkConfig
+	count  int
+
+	// pixels holds a 256-bin histogram per channel for each watermark
+	// pixel in row-major order; ring holds one per channel for the band
+	// around the region.
+	pixels [][3][256]uint32
+	ring   [3][256]uint64
+}
+
+// NewEstimator creates an estimator for watermarks of the given size and
+// margin, placed as CalculatePosition describes.
+func NewEstimator(config WatermarkConfig) (*Estimator, error) {
+	if config.Size <= 0 || config.Margin < 0 {
+		return nil, fmt.Errorf("invalid watermark configuration %s", config)
+	}
+	return &Estimator{
+		config: config,
+		pixels: make([][3][256]uint32, config.Size*config.Size),
+	}, nil
+}
+
+// Add accumulates the watermark region of a watermarked image and the band
+// around it. The image must be large enough to contain the region.
+func (e *Estimator) Add(img image.Image) error {
+	bounds := img.Bounds()
+	region := CalculatePosition(bounds.Dx(), bounds.Dy(), e.config).Add(bounds.Min)
+	if !region.In(bounds) {
+		return fmt.Errorf("image %dx%d is too small for a %s watermark", bounds.Dx(), bounds.Dy(), e.config)
+	}
+
+	band := region.Inset(-int(float64(e.config.Size)*estimationRing + 0.5)).Intersect(bounds)
+	for y := band.Min.Y; y < band.Max.Y; y++ {
+		for x := band.Min.X; x < band.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			values := [3]uint32{r >> 8, g >> 8, b >> 8}
+
+			if image.Pt(x, y).In(region) {
+				histograms := &e.pixels[(y-region.Min.Y)*e.config.Size+(x-region.Min.X)]
+				for c, v := range values {
+					histograms[c][v]++
+				}
+				continue
+			}
+			for c, v := range values {
+				e.ring[c][v]++
+			}
+		}
+	}
+
+	e.count++
+	return nil
+}
+
+// Count returns the number of images added so far.
+func (e *Estimator) Count() int {
+	return e.count
+}
+
+// Estimate returns the profile derived from the images added so far. The
+// logo color is the least-squares fit of the per-pixel median shifts.
+func (e *Estimator) Estimate(name string, rule SelectionRule) (Profile, error) {
+	if e.count < MinEstimationImages {
+		return Profile{}, fmt.Errorf("estimation needs at least %d images, got %d", MinEstimationImages, e.count)
+	}
+
+	var refMedian, refSpread [3]float64
+	for c := range e.ring {
+		refMedian[c] = histogramQuantile(e.ring[c][:], 0.5)
+		refSpread[c] = histogramQuantile(e.ring[c][:], highQuantile) - histogramQuantile(e.ring[c][:], lowQuantile)
+	}
+	if refSpread[0]+refSpread[1]+refSpread[2] <= 1 {
+		return Profile{}, errors.New("images are too uniform around the watermark to estimate it")
+	}
+
+	// Alpha from the loss of spread, averaged over the channels weighted
+	// by their reference spread (a flat channel carries no information).
+	alphaMap := make([]float32, len(e.pixels))
+	medians := make([][3]float64, len(e.pixels))
+	for i := range e.pixels {
+		var sum, weight float64
+		for c := range e.pixels[i] {
+			histogram := e.pixels[i][c][:]
+			spread := histogramQuantile(histogram, highQuantile) - histogramQuantile(histogram, lowQuantile)
+			medians[i][c] = histogramQuantile(histogram, 0.5)
+			sum += refSpread[c] - spread
+			weight += refSpread[c]
+		}
+		alphaMap[i] = float32(clamp(sum/weight, 0, 1))
+	}
+
+	// The median moves from the reference median towards the logo:
+	// median - (1 - alpha) * refMedian = alpha * logo
+	var logo [3]float64
+	for c := range logo {
+		var num, den float64
+		for i, alpha := range alphaMap {
+			a := float64(alpha)
+			num += a * (medians[i][c] - (1-a)*refMedian[c])
+			den += a * a
+		}
+		if den <= 1e-12 {
+			return Profile{}, errors.New("no watermark found in the images")
+		}
+		logo[c] = clamp(num/den, 0, 255)
+	}
+
+	profile := Profile{
+		Name:      name,
+		AlphaMap:  alphaMap,
+		Size:      e.config.Size,
+		Margin:    e.config.Margin,
+		LogoColor: logo,
+		Rule:      rule,
+	}
+	return profile, profile.Validate()
+}
+
+// histogramQuantile returns the q-quantile of the values counted in an 8-bit
+// histogram. Each integer value is treated as spread evenly over
+// [v - 0.5, v + 0.5), which avoids snapping the result to whole levels.
+func histogramQuantile[T uint32 | uint64](histogram []T, q float64) float64 {
+	var total float64
+	for _, n := range histogram {
+		total += float64(n)
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := q * total
+	var cumulative float64
+	for v, n := range histogram {
+		count := float64(n)
+		if count > 0 && cumulative+count >= target {
+			return float64(v) - 0.5 + (target-cumulative)/count
+		}
+		cumulative += count
+	}
+	return float64(len(histogram) - 1)
+}
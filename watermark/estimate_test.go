@@ -0,0 +1,146 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// createVariedImage creates a test image with a random base color and
+// per-pixel noise, so that a set of them covers the whole value range.
+func createVariedImage(width, height int, rng *rand.Rand) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	base := [3]int{rng.Intn(220), rng.Intn(220), rng.Intn(220)}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := rng.Intn(36)
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(base[0] + noise),
+				G: uint8(base[1] + noise),
+				B: uint8(base[2] + noise),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+func TestEstimator_RecoversAlphaMap(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	truth, _ := engine.Profile(ProfileGemini48)
+
+	estimator, err := NewEstimator(truth.Config())
+	if err != nil {
+		t.Fatalf("NewEstimator() error: %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 400; i++ {
+		img := createVariedImage(200, 160, rng)
+		applyWatermark(img, CalculatePosition(200, 160, truth.Config()), truth.AlphaMap)
+		if err := estimator.Add(img); err != nil {
+			t.Fatalf("Add() error: %v", err)
+		}
+	}
+	if estimator.Count() != 400 {
+		t.Errorf("expected count 400, got %d", estimator.Count())
+	}
+
+	profile, err := estimator.Estimate("estimated", SelectionRule{})
+	if err != nil {
+		t.Fatalf("Estimate() error: %v", err)
+	}
+	if profile.Config() != truth.Config() {
+		t.Errorf("expected configuration %v, got %v", truth.Config(), profile.Config())
+	}
+
+	var sumSq float64
+	for i, alpha := range profile.AlphaMap {
+		diff := float64(alpha - truth.AlphaMap[i])
+		sumSq += diff * diff
+	}
+	if rms := math.Sqrt(sumSq / float64(len(profile.AlphaMap))); rms > 0.02 {
+		t.Errorf("alpha map rms error %.4f exceeds 0.02", rms)
+	}
+	for c, v := range profile.LogoColor {
+		if math.Abs(v-LogoValue) > 10 {
+			t.Errorf("logo channel %d: expected ~%.0f, got %.1f", c, LogoValue, v)
+		}
+	}
+
+	// The estimated profile detects the watermark like the built-in one
+	custom := &Engine{}
+	if err := custom.RegisterProfile(profile); err != nil {
+		t.Fatalf("RegisterProfile() error: %v", err)
+	}
+	img := createNoiseImage(800, 600, 9)
+	applyWatermark(img, CalculatePosition(800, 600, truth.Config()), truth.AlphaMap)
+	if detection := custom.Detect(img); !detection.Detected || detection.Profile != "estimated" {
+		t.Errorf("estimated profile did not detect the watermark (confidence %.3f)", detection.Confidence)
+	}
+}
+
+func TestEstimator_Errors(t *testing.T) {
+	if _, err := NewEstimator(WatermarkConfig{Size: 0, Margin: 32}); err == nil {
+		t.Error("expected error for a zero watermark size")
+	}
+
+	estimator, err := NewEstimator(WatermarkConfig{Size: 48, Margin: 32})
+	if err != nil {
+		t.Fatalf("NewEstimator() error: %v", err)
+	}
+	if err := estimator.Add(image.NewRGBA(image.Rect(0, 0, 60, 60))); err == nil {
+		t.Error("expected error for an image smaller than the watermark region")
+	}
+
+	for i := 0; i < MinEstimationImages-1; i++ {
+		if err := estimator.Add(createNoiseImage(200, 200, int64(i))); err != nil {
+			t.Fatalf("Add() error: %v", err)
+		}
+	}
+	if _, err := estimator.Estimate("x", SelectionRule{}); err == nil {
+		t.Errorf("expected error with fewer than %d images", MinEstimationImages)
+	}
+
+	// Uniform content carries no information about the watermark
+	flat, _ := NewEstimator(WatermarkConfig{Size: 48, Margin: 32})
+	for i := 0; i < MinEstimationImages; i++ {
+		if err := flat.Add(createTestImage(200, 200, color.Gray{Y: 100})); err != nil {
+			t.Fatalf("Add() error: %v", err)
+		}
+	}
+	if _, err := flat.Estimate("x", SelectionRule{}); err == nil {
+		t.Error("expected error for uniform images")
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	histogram := make([]uint32, 256)
+	histogram[10] = 50
+	histogram[20] = 50
+
+	testCases := []struct {
+		q        float64
+		expected float64
+	}{
+		{0, 9.5},
+		{0.25, 10},
+		{0.5, 10.5},
+		{0.75, 20},
+		{1, 20.5},
+	}
+
+	for _, tc := range testCases {
+		if got := histogramQuantile(histogram, tc.q); math.Abs(got-tc.expected) > 1e-9 {
+			t.Errorf("quantile %.2f: expected %.2f, got %.2f", tc.q, tc.expected, got)
+		}
+	}
+	if got := histogramQuantile(make([]uint64, 256), 0.5); got != 0 {
+		t.Errorf("empty histogram: expected 0, got %f", got)
+	}
+}
@@ -0,0 +1,255 @@
+package watermark
+
+import (
+	"image"
+	"math"
+)
+
+// Gain range and step of the blend fit. Gemini's overlay opacity has been
+// observed to vary by a few percent; the range leaves room for color-managed
+// or re-encoded images.
+const (
+	minFitGain  = 0.7
+	maxFitGain  = 1.3
+	fitGainStep = 0.02
+)
+
+// minFitTexture is the mean squared difference between adjacent pixels
+// (in 8-bit levels) the lightly watermarked part of the region must show for
+// the gain to be fitted. On flatter backgrounds the gain and the logo color
+// trade off against each other and the gain is left at 1.
+const minFitTexture = 4.0
+
+// BlendFit holds per-image corrections of a profile's blend parameters,
+// fitted by Engine.FitBlend.
+type BlendFit struct {
+	// Gain scales the profile's alpha map: the watermark was applied with
+	// opacity Gain * alpha.
+	Gain float64
+
+	// LogoColor replaces the profile's logo color, per RGB channel in the
+	// range [0, 255].
+	LogoColor [3]float64
+}
+
+// FitBlend fits the opacity scale and the per-channel logo color of the
+// watermark described by detection to the image, and returns the detection
+// with Fit set. RemoveDetected and RemoveAll then invert the blend with the
+// fitted parameters instead of the profile's.
+//
+// This compensates for small changes of Gemini's overlay opacity or color,
+// and for color management applied after generation, which otherwise leave
+// residual edges along the logo outline. Two conditions determine the
+// parameters:
+//   - For a given gain, the logo color is the least-squares choice that
+//     leaves no trace of the alpha map's edges in the gradients of the
+//     restored pixels.
+//   - A wrong gain damps or amplifies the underlying texture in proportion to
+//     alpha. The gain is the one for which the texture energy of the
+//     restored pixels no longer correlates with alpha, interpolated between
+//     the steps of a grid.
+//
+// Backgrounds without enough texture keep a gain of 1. If the detection
+// refers to an unknown profile, it is returned unchanged.
+func (e *Engine) FitBlend(img image.Image, detection Detection) Detection {
+	samples := e.blendSamples(img, detection)
+	if samples == nil {
+		return detection
+	}
+
+	gain := 1.0
+	if samples.texture() >= minFitTexture {
+		gain = samples.fitGain()
+	}
+
+	detection.Fit = &BlendFit{Gain: gain, LogoColor: samples.fitLogo(gain)}
+	return detection
+}
+
+// blendSamples reads the samples of the detected watermark the blend fit
+// works on, under the engine's alpha limits, or returns nil if the
+// detection refers to an unknown profile.
+func (e *Engine) blendSamples(img image.Image, detection Detection) *fitSamples {
+	profile := e.profileFor(detection)
+	if profile == nil {
+		return nil
+	}
+	alphaMap, size := detectionAlphaMap(profile, detection)
+	threshold, maxAlpha := e.alphaLimits()
+	return newFitSamples(img, detection.Region, alphaMap, size, profile.LogoColor, threshold, maxAlpha)
+}
+
+// fitSamples holds the watermark region of an image prepared for the blend
+// fit: the alpha value and the RGB values of each pixel, and the pairs of
+// horizontally or vertically adjacent pixels whose difference enters the
+// gradient energy.
+type fitSamples struct {
+	alpha  []float64
+	values [][3]float64
+	pairs  [][2]int
+
+	// fallback is the logo color used when the samples carry no
+	// information about it (e.g. a fully clipped region).
+	fallback [3]float64
+
+	// threshold is the engine's alpha threshold, below which pixels are
+	// considered untouched by the watermark.
+	threshold float64
+}
+
+// newFitSamples reads the pixels of img covered by region, skipping pixels
+// outside the image and pixels whose alpha would be clamped to maxAlpha
+// under the largest gain tried.
+func newFitSamples(img image.Image, region image.Rectangle, alphaMap []float32, size int, fallback [3]float64, threshold, maxAlpha float64) *fitSamples {
+	bounds := img.Bounds()
+	s := &fitSamples{fallback: fallback, threshold: threshold}
+
+	index := make([]int, size*size)
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			i := row*size + col
+			index[i] = -1
+
+			x, y := region.Min.X+col, region.Min.Y+row
+			alpha := float64(alphaMap[i])
+			if !image.Pt(x, y).In(bounds) || alpha*maxFitGain >= maxAlpha {
+				continue
+			}
+
+			index[i] = len(s.alpha)
+			s.alpha = append(s.alpha, alpha)
+			s.values = append(s.values, rgbAt(img, x, y))
+		}
+	}
+
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			i := index[row*size+col]
+			if i < 0 {
+				continue
+			}
+			if col+1 < size && index[row*size+col+1] >= 0 {
+				s.pairs = append(s.pairs, [2]int{i, index[row*size+col+1]})
+			}
+			if row+1 < size && index[(row+1)*size+col] >= 0 {
+				s.pairs = append(s.pairs, [2]int{i, index[(row+1)*size+col]})
+			}
+		}
+	}
+	return s
+}
+
+// fitLogo returns, for a fixed gain, the logo color whose restoration
+// leaves the least correlation between the restored gradients and the
+// gradients of the alpha map.
+//
+// With opacity a = gain * alpha, the restored value (v - a * logo) / (1 - a)
+// is affine in the logo color: base - logo * weight. Minimizing
+// sum((d base - logo * d weight)^2) over adjacent pairs makes the restored
+// gradients orthogonal to d weight, and is solved in closed form per channel.
+func (s *fitSamples) fitLogo(gain float64) [3]float64 {
+	base, weight := s.restoreTerms(gain)
+
+	var logo [3]float64
+	for c := 0; c < 3; c++ {
+		var bw, ww float64
+		for _, pair := range s.pairs {
+			db := base[pair[0]][c] - base[pair[1]][c]
+			dw := weight[pair[0]] - weight[pair[1]]
+			bw += db * dw
+			ww += dw * dw
+		}
+		if ww <= 1e-12 {
+			logo[c] = s.fallback[c]
+			continue
+		}
+		logo[c] = clamp(bw/ww, 0, 255)
+	}
+	return logo
+}
+
+// fitGain returns the gain closest to 1 at which the texture imbalance
+// changes sign, or 1 if it does not change sign within the search range.
+func (s *fitSamples) fitGain() float64 {
+	steps := int(math.Round((maxFitGain-minFitGain)/fitGainStep)) + 1
+	imbalance := make([]float64, steps)
+	for i := range imbalance {
+		imbalance[i] = s.imbalance(minFitGain + float64(i)*fitGainStep)
+	}
+
+	best, bestDistance := 1.0, math.Inf(1)
+	for i := 0; i+1 < steps; i++ {
+		lo, hi := imbalance[i], imbalance[i+1]
+		if lo > 0 || hi < 0 || lo == hi {
+			continue
+		}
+		gain := minFitGain + (float64(i)+lo/(lo-hi))*fitGainStep
+		if distance := math.Abs(gain - 1); distance < bestDistance {
+			best, bestDistance = gain, distance
+		}
+	}
+	return best
+}
+
+// imbalance measures how the texture energy of the pixels restored with the
+// given gain (and the matching logo color) varies with alpha: the sum of the
+// squared differences of adjacent restored pixels, weighted by the pair's
+// alpha relative to the mean. It is negative when texture under the logo is
+// damped (gain too low) and positive when it is amplified (gain too high).
+func (s *fitSamples) imbalance(gain float64) float64 {
+	logo := s.fitLogo(gain)
+	base, weight := s.restoreTerms(gain)
+
+	var meanAlpha float64
+	for _, pair := range s.pairs {
+		meanAlpha += (s.alpha[pair[0]] + s.alpha[pair[1]]) / 2
+	}
+	meanAlpha /= float64(len(s.pairs))
+
+	var sum float64
+	for _, pair := range s.pairs {
+		var energy float64
+		for c := 0; c < 3; c++ {
+			d := base[pair[0]][c] - logo[c]*weight[pair[0]] - base[pair[1]][c] + logo[c]*weight[pair[1]]
+			energy += d * d
+		}
+		sum += ((s.alpha[pair[0]]+s.alpha[pair[1]])/2 - meanAlpha) * energy
+	}
+	return sum
+}
+
+// texture returns the mean squared difference of adjacent pixels, per
+// channel, among the pairs whose alpha is below the threshold.
+func (s *fitSamples) texture() float64 {
+	var sum float64
+	n := 0
+	for _, pair := range s.pairs {
+		if s.alpha[pair[0]] >= s.threshold || s.alpha[pair[1]] >= s.threshold {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			d := s.values[pair[0]][c] - s.values[pair[1]][c]
+			sum += d * d
+		}
+		n += 3
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// restoreTerms splits the restored value of every sample for the given gain
+// into base - logo * weight.
+func (s *fitSamples) restoreTerms(gain float64) ([][3]float64, []float64) {
+	base := make([][3]float64, len(s.alpha))
+	weight := make([]float64, len(s.alpha))
+	for i, alpha := range s.alpha {
+		a := gain * alpha
+		weight[i] = a / (1 - a)
+		for c := 0; c < 3; c++ {
+			base[i][c] = s.values[i][c] / (1 - a)
+		}
+	}
+	return base, weight
+}
@@ -0,0 +1,123 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// applyBlend blends a logo of the given color into img over region with the
+// alpha map scaled by gain.
+func applyBlend(img *image.RGBA, region image.Rectangle, alphaMap []float32, gain float64, logo [3]float64) {
+	size := region.Dx()
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			alpha := gain * float64(alphaMap[(y-region.Min.Y)*size+(x-region.Min.X)])
+			c := img.RGBAAt(x, y)
+			blend := func(v uint8, l float64) uint8 {
+				return uint8(alpha*l + (1-alpha)*float64(v) + 0.5)
+			}
+			img.SetRGBA(x, y, color.RGBA{R: blend(c.R, logo[0]), G: blend(c.G, logo[1]), B: blend(c.B, logo[2]), A: c.A})
+		}
+	}
+}
+
+// meanRegionError returns the mean absolute channel difference between two
+// images inside region.
+func meanRegionError(a image.Image, b *image.RGBA, region image.Rectangle) float64 {
+	var sum float64
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			r, g, bl, _ := a.At(x, y).RGBA()
+			want := b.RGBAAt(x, y)
+			sum += math.Abs(float64(r>>8)-float64(want.R)) +
+				math.Abs(float64(g>>8)-float64(want.G)) +
+				math.Abs(float64(bl>>8)-float64(want.B))
+		}
+	}
+	return sum / float64(region.Dx()*region.Dy()*3)
+}
+
+func TestFitBlend_RecoversShiftedParameters(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	testCases := []struct {
+		gain float64
+		logo [3]float64
+	}{
+		{1, [3]float64{255, 255, 255}},
+		{0.9, [3]float64{255, 255, 255}},
+		{1.1, [3]float64{240, 248, 255}},
+		{0.85, [3]float64{250, 235, 220}},
+	}
+
+	width, height := 800, 600
+	for _, tc := range testCases {
+		config, region := GetWatermarkInfo(width, height)
+		original := createNoiseImage(width, height, 21)
+		img := createNoiseImage(width, height, 21)
+		applyBlend(img, region, engine.profileByConfig(config).AlphaMap, tc.gain, tc.logo)
+
+		detection := engine.Detect(img)
+		fitted := engine.FitBlend(img, detection)
+		if fitted.Fit == nil {
+			t.Fatalf("gain %.2f: FitBlend() did not set Fit", tc.gain)
+		}
+
+		if math.Abs(fitted.Fit.Gain-tc.gain) > 0.03 {
+			t.Errorf("gain %.2f: fitted gain %.3f", tc.gain, fitted.Fit.Gain)
+		}
+		for c := range tc.logo {
+			if math.Abs(fitted.Fit.LogoColor[c]-tc.logo[c]) > 6 {
+				t.Errorf("gain %.2f: logo channel %d: expected %.0f, got %.1f",
+					tc.gain, c, tc.logo[c], fitted.Fit.LogoColor[c])
+			}
+		}
+
+		// Shifted parameters are restored better with the fit, and the
+		// fit stays within rounding error otherwise
+		plain := meanRegionError(engine.RemoveDetected(img, detection), original, region)
+		corrected := meanRegionError(engine.RemoveDetected(img, fitted), original, region)
+		shifted := tc.gain != 1 || tc.logo != [3]float64{255, 255, 255}
+		if corrected > 1 || (shifted && corrected >= plain) {
+			t.Errorf("gain %.2f: mean error %.3f with fit, %.3f without", tc.gain, corrected, plain)
+		}
+	}
+}
+
+func TestFitBlend_FlatBackgroundKeepsUnitGain(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 800, 600
+	config, region := GetWatermarkInfo(width, height)
+	original := createTestImage(width, height, color.RGBA{R: 60, G: 70, B: 80, A: 255})
+	img := createTestImage(width, height, color.RGBA{R: 60, G: 70, B: 80, A: 255})
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	fitted := engine.FitBlend(img, engine.Detect(img))
+	if fitted.Fit == nil || fitted.Fit.Gain != 1 {
+		t.Fatalf("expected unit gain on a flat background, got %+v", fitted.Fit)
+	}
+	if err := meanRegionError(engine.RemoveDetected(img, fitted), original, region); err > 1 {
+		t.Errorf("mean error %.3f after fitted removal", err)
+	}
+}
+
+func TestFitBlend_UnknownProfile(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	detection := Detection{Profile: "missing"}
+	if fitted := engine.FitBlend(createNoiseImage(100, 100, 1), detection); fitted.Fit != nil {
+		t.Error("expected no fit for an unknown profile")
+	}
+}
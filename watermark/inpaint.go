@@ -0,0 +1,221 @@
+package watermark
+
+import (
+	"image"
+	"math"
+)
+
+// Noise amplification limits of the reverse blend. It multiplies noise by
+// 1 / (1 - alpha): restorations amplified up to reliableAmplification are
+// trusted fully, those amplified by unreliableAmplification or more are
+// replaced by inpainting, and confidence falls linearly in between.
+const (
+	reliableAmplification   = 2.5 // alpha = 0.6
+	unreliableAmplification = 10  // alpha = 0.9
+)
+
+// clipSoftness is how far (in 8-bit levels) a restored value may fall
+// outside [0, 255] before the pixel is considered unreliable. Smaller
+// overshoots reduce the confidence proportionally.
+const clipSoftness = 16.0
+
+// Diffusion inpainting parameters: the successive over-relaxation factor,
+// the iteration limit and the largest per-iteration change (in 8-bit levels)
+// at which the solution counts as converged.
+const (
+	diffusionRelaxation = 1.8
+	diffusionIterations = 500
+	diffusionTolerance  = 0.01
+)
+
+// SetInpaintFallback enables or disables the inpainting fallback of the
+// reverse blend. When enabled, pixels whose restoration is unreliable are
+// filled from their neighbors by diffusion inpainting and blended with the
+// reverse-blend result according to a confidence weight (see
+// blendConfidence), i.e. the engine restores with a Hybrid of ReverseBlend
+// and DiffusionInpaint. It is disabled by default and has no effect with
+// StrategyInpaint or a restorer set by SetRestorer.
+func (e *Engine) SetInpaintFallback(enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.inpaintFallback = enabled
+}
+
+// InpaintFallback reports whether the inpainting fallback is enabled.
+func (e *Engine) InpaintFallback() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.inpaintFallback
+}
+
+// DiffusionInpaint is a Restorer that discards the pixels covered by the
+// alpha map and fills them from their surroundings by harmonic
+// interpolation (see inpaintDiffusion). On its own it suits small, smooth
+// areas; it is mainly used as the Fallback of a Hybrid.
+type DiffusionInpaint struct{}
+
+// Restore implements Restorer.
+func (DiffusionInpaint) Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+	threshold, _ := profile.alphaLimits()
+	points, indices := holePixels(img.Bounds(), region, alphaMap, threshold)
+	restoration := Restoration{Pixels: make([][3]float64, len(alphaMap))}
+	for k, v := range inpaintDiffusion(img, points) {
+		for c := range v {
+			restoration.Pixels[indices[k]][c] = roundLevel(v[c], img)
+		}
+	}
+	return restoration
+}
+
+// blendConfidence returns how far the reverse blend of a pixel can be
+// trusted, in [0.0, 1.0]. alpha is the opacity before clamping to maxAlpha,
+// watermarked the 8-bit input and restored the unclamped reverse-blend result.
+//
+// Confidence drops with the noise amplification 1 / (1 - alpha), is zero
+// where alpha had to be clamped or an input channel is saturated (its true
+// value is lost), and drops where the restoration overshoots the valid range.
+func blendConfidence(alpha, maxAlpha float64, watermarked, restored [3]float64) float64 {
+	if alpha > maxAlpha {
+		return 0
+	}
+	for _, v := range watermarked {
+		if v <= 0 || v >= 255 {
+			return 0
+		}
+	}
+
+	amplification := 1 / (1 - alpha)
+	confidence := clamp((unreliableAmplification-amplification)/(unreliableAmplification-reliableAmplification), 0, 1)
+
+	var overshoot float64
+	for _, v := range restored {
+		overshoot = math.Max(overshoot, math.Max(v-255, -v))
+	}
+	return confidence * clamp(1-overshoot/clipSoftness, 0, 1)
+}
+
+// inpaintDiffusion fills the given pixels of img from their surroundings by
+// harmonic interpolation: each filled pixel ends up as the average of its
+// four neighbors, the smoothest surface matching the known pixels around
+// the hole. Pixels outside the image are ignored.
+//
+// It returns the filled RGB values in the order of points; img is not
+// modified.
+func inpaintDiffusion(img image.Image, points []image.Point) [][3]float64 {
+	if len(points) == 0 {
+		return nil
+	}
+
+	// Work on the bounding box of the hole plus a one-pixel border of
+	// known pixels.
+	rect := image.Rectangle{Min: points[0], Max: points[0].Add(image.Pt(1, 1))}
+	for _, p := range points[1:] {
+		rect = rect.Union(image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+	}
+	rect = rect.Inset(-1).Intersect(img.Bounds())
+
+	width, height := rect.Dx(), rect.Dy()
+	values := make([][3]float64, width*height)
+	unknown := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values[y*width+x] = rgbAt(img, rect.Min.X+x, rect.Min.Y+y)
+		}
+	}
+	for _, p := range points {
+		if p.In(rect) {
+			unknown[(p.Y-rect.Min.Y)*width+p.X-rect.Min.X] = true
+		}
+	}
+
+	neighbors := func(i int, visit func(j int)) {
+		x, y := i%width, i/width
+		if x > 0 {
+			visit(i - 1)
+		}
+		if x < width-1 {
+			visit(i + 1)
+		}
+		if y > 0 {
+			visit(i - width)
+		}
+		if y < height-1 {
+			visit(i + width)
+		}
+	}
+
+	// Initialize the hole from the outside in (each pixel takes the mean of
+	// its already known neighbors), which gives the relaxation a good
+	// starting point.
+	filled := make([]bool, width*height)
+	for i := range filled {
+		filled[i] = !unknown[i]
+	}
+	for remaining := true; remaining; {
+		remaining = false
+		var layer []int
+		for i := range values {
+			if filled[i] {
+				continue
+			}
+			var sum [3]float64
+			n := 0
+			neighbors(i, func(j int) {
+				if filled[j] {
+					for c := range sum {
+						sum[c] += values[j][c]
+					}
+					n++
+				}
+			})
+			if n == 0 {
+				remaining = true
+				continue
+			}
+			for c := range sum {
+				values[i][c] = sum[c] / float64(n)
+			}
+			layer = append(layer, i)
+		}
+		if len(layer) == 0 {
+			break // No known pixels at all
+		}
+		for _, i := range layer {
+			filled[i] = true
+		}
+	}
+
+	// Relax towards the harmonic solution
+	for iteration := 0; iteration < diffusionIterations; iteration++ {
+		var maxChange float64
+		for i := range values {
+			if !unknown[i] {
+				continue
+			}
+			var sum [3]float64
+			n := 0
+			neighbors(i, func(j int) {
+				for c := range sum {
+					sum[c] += values[j][c]
+				}
+				n++
+			})
+			for c := range sum {
+				change := diffusionRelaxation * (sum[c]/float64(n) - values[i][c])
+				values[i][c] += change
+				maxChange = math.Max(maxChange, math.Abs(change))
+			}
+		}
+		if maxChange < diffusionTolerance {
+			break
+		}
+	}
+
+	result := make([][3]float64, len(points))
+	for k, p := range points {
+		if p.In(rect) {
+			result[k] = values[(p.Y-rect.Min.Y)*width+p.X-rect.Min.X]
+		}
+	}
+	return result
+}
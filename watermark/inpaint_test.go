@@ -0,0 +1,167 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// createRampImage creates a smooth horizontal gradient from 40 to 200.
+func createRampImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(40 + 160*x/(width-1))
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+// strongProfile returns a 48px profile whose alpha map peaks at 0.95, so that
+// the reverse blend amplifies noise up to 20x.
+func strongProfile(t *testing.T, engine *Engine) Profile {
+	t.Helper()
+	base, _ := engine.Profile(ProfileGemini48)
+	alphaMap := make([]float32, len(base.AlphaMap))
+	for i, alpha := range base.AlphaMap {
+		alphaMap[i] = float32(math.Min(float64(alpha)*1.9, 0.95))
+	}
+	return Profile{
+		Name:      "strong-48",
+		AlphaMap:  alphaMap,
+		Size:      48,
+		Margin:    32,
+		LogoColor: [3]float64{255, 255, 255},
+	}
+}
+
+func TestInpaintDiffusion_ReproducesLinearRamp(t *testing.T) {
+	img := createRampImage(100, 60)
+	var hole []image.Point
+	for y := 20; y < 40; y++ {
+		for x := 30; x < 70; x++ {
+			hole = append(hole, image.Pt(x, y))
+		}
+	}
+
+	// Destroy the hole; harmonic interpolation restores a linear ramp
+	damaged := image.NewRGBA(img.Bounds())
+	copy(damaged.Pix, img.Pix)
+	for _, p := range hole {
+		damaged.SetRGBA(p.X, p.Y, color.RGBA{R: 255, A: 255})
+	}
+
+	filled := inpaintDiffusion(damaged, hole)
+	for i, p := range hole {
+		want := float64(img.RGBAAt(p.X, p.Y).R)
+		for c, v := range filled[i] {
+			if math.Abs(v-want) > 1 {
+				t.Fatalf("pixel (%d,%d) channel %d: expected %.0f, got %.2f", p.X, p.Y, c, want, v)
+			}
+		}
+	}
+
+	if inpaintDiffusion(damaged, nil) != nil {
+		t.Error("expected nil for an empty hole")
+	}
+}
+
+func TestBlendConfidence(t *testing.T) {
+	mid := [3]float64{128, 128, 128}
+
+	testCases := []struct {
+		name        string
+		alpha       float64
+		watermarked [3]float64
+		restored    [3]float64
+		expected    float64
+	}{
+		{"low alpha", 0.3, mid, mid, 1},
+		{"reliable limit", 0.6, mid, mid, 1},
+		{"halfway", 1 - 1/6.25, mid, mid, 0.5},
+		{"unreliable", 0.9, mid, mid, 0},
+		{"clamped alpha", 0.995, mid, mid, 0},
+		{"saturated input", 0.3, [3]float64{255, 128, 128}, mid, 0},
+		{"overshoot", 0.3, mid, [3]float64{128, 263, 128}, 0.5},
+		{"large undershoot", 0.3, mid, [3]float64{-20, 128, 128}, 0},
+	}
+
+	for _, tc := range testCases {
+		if got := blendConfidence(tc.alpha, MaxAlpha, tc.watermarked, tc.restored); math.Abs(got-tc.expected) > 1e-9 {
+			t.Errorf("%s: expected confidence %.3f, got %.3f", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestInpaintFallback_ReducesAmplifiedNoise(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.InpaintFallback() {
+		t.Fatal("expected the inpainting fallback to be disabled by default")
+	}
+	profile := strongProfile(t, engine)
+	if err := engine.RegisterProfile(profile); err != nil {
+		t.Fatalf("RegisterProfile() error: %v", err)
+	}
+
+	width, height := 800, 600
+	region := CalculatePosition(width, height, profile.Config())
+	original := createRampImage(width, height)
+	img := createRampImage(width, height)
+	applyWatermark(img, region, profile.AlphaMap)
+
+	// Compression-like noise on top of the watermark
+	rng := rand.New(rand.NewSource(3))
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			noise := func(v uint8) uint8 {
+				return uint8(clamp(float64(v)+float64(rng.Intn(7)-3), 0, 254))
+			}
+			img.SetRGBA(x, y, color.RGBA{R: noise(c.R), G: noise(c.G), B: noise(c.B), A: 255})
+		}
+	}
+
+	detection := Detection{Profile: profile.Name, Config: profile.Config(), Region: region, Scale: 1}
+	plain := meanRegionError(engine.RemoveDetected(img, detection), original, region)
+
+	engine.SetInpaintFallback(true)
+	if !engine.InpaintFallback() {
+		t.Fatal("expected the inpainting fallback to be enabled")
+	}
+	inpainted := meanRegionError(engine.RemoveDetected(img, detection), original, region)
+
+	if inpainted >= plain*0.75 {
+		t.Errorf("expected the fallback to reduce the error clearly: %.3f with, %.3f without", inpainted, plain)
+	}
+}
+
+func TestInpaintFallback_KeepsReliablePixels(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Gemini's alpha stays below the reliable limit, so on a background
+	// without saturated pixels the fallback changes nothing
+	width, height := 800, 600
+	config, region := GetWatermarkInfo(width, height)
+	img := createNoiseImage(width, height, 4)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.Detect(img)
+	plain := engine.RemoveDetected(img, detection).(*image.RGBA)
+	engine.SetInpaintFallback(true)
+	fallback := engine.RemoveDetected(img, detection).(*image.RGBA)
+
+	for i := range plain.Pix {
+		if plain.Pix[i] != fallback.Pix[i] {
+			t.Fatalf("byte %d differs: %d without fallback, %d with", i, plain.Pix[i], fallback.Pix[i])
+		}
+	}
+}
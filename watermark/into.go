@@ -0,0 +1,92 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// Result describes the watermark removed by RemoveInto.
+type Result struct {
+	// Detection is the watermark that was removed, as found by Detect.
+	// Its Scores are not filled in, so that RemoveInto does not allocate.
+	Detection Detection
+
+	// Changed is the area of the destination the restoration may have
+	// changed. The rest of the source's bounds holds a copy of the source.
+	Changed image.Rectangle
+}
+
+// RemoveInto removes the Gemini watermark from src like RemoveWatermark, but
+// writes the result into dst instead of a new image. dst must contain the
+// bounds of src and only that area of dst is written; it may be src itself
+// to remove the watermark in place. Pixels are converted to the color model
+// of dst, and restored with the precision it can store (see RemoveAll).
+//
+// RemoveInto is meant for loops that process many images: detection works
+// in scratch buffers kept in an internal pool and restoration works on dst
+// directly, so that with the default ReverseBlend restorer a call does not
+// allocate once the pool is warm, for a src of type *image.RGBA,
+// *image.NRGBA, *image.Gray or *image.YCbCr and a dst of type *image.RGBA,
+// *image.NRGBA or *image.Gray with the same bounds. Other restorers work
+// too but may allocate, and so do destinations of other types, which are
+// restored on a copy of the watermark's surroundings that is drawn back
+// into dst (see RemoveInPlace).
+//
+// An error is returned if dst is too small or no profile is registered;
+// dst is not modified then.
+func (e *Engine) RemoveInto(dst draw.Image, src image.Image) (Result, error) {
+	bounds := src.Bounds()
+	if !bounds.In(dst.Bounds()) {
+		return Result{}, fmt.Errorf("destination bounds %v do not contain source bounds %v", dst.Bounds(), bounds)
+	}
+
+	s := getScratch()
+	defer s.release()
+	detection := e.detectWith(s, src, 0, unitScale)
+	detection.Scores = nil
+	if detection.Profile == "" {
+		return Result{}, errors.New("no watermark profile is registered")
+	}
+
+	// Restorers must not see the parts of dst outside the source bounds
+	target := dst
+	if dst.Bounds() != bounds {
+		if sub, ok := cropImage(dst, bounds).(draw.Image); ok {
+			target = sub
+		}
+	}
+	copyImage(target, src)
+	if !restorable(target) {
+		return Result{Detection: detection, Changed: e.RemoveInPlace(target, []Detection{detection})}, nil
+	}
+	return Result{Detection: detection, Changed: e.restore(target, detection)}, nil
+}
+
+// copyImage copies src into the same area of dst. Images of the same 8-bit
+// standard type are copied row by row; others are converted by draw.Draw.
+func copyImage(dst draw.Image, src image.Image) {
+	r := src.Bounds()
+	if r.Empty() {
+		return
+	}
+	switch d := dst.(type) {
+	case *image.RGBA:
+		if s, ok := src.(*image.RGBA); ok {
+			copyRows(d.Pix[d.PixOffset(r.Min.X, r.Min.Y):], d.Stride, s.Pix, s.Stride, 4*r.Dx(), r.Dy())
+			return
+		}
+	case *image.NRGBA:
+		if s, ok := src.(*image.NRGBA); ok {
+			copyRows(d.Pix[d.PixOffset(r.Min.X, r.Min.Y):], d.Stride, s.Pix, s.Stride, 4*r.Dx(), r.Dy())
+			return
+		}
+	case *image.Gray:
+		if s, ok := src.(*image.Gray); ok {
+			copyRows(d.Pix[d.PixOffset(r.Min.X, r.Min.Y):], d.Stride, s.Pix, s.Stride, r.Dx(), r.Dy())
+			return
+		}
+	}
+	draw.Draw(dst, r, src, r.Min, draw.Src)
+}
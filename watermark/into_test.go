@@ -0,0 +1,219 @@
+package watermark
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+	"testing"
+)
+
+func TestRemoveInto(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	inputs, detection := watermarkedInputs(engine, 800, 600)
+
+	for _, name := range []string{"RGBA", "NRGBA", "Gray"} {
+		src := inputs[name]
+		var dst draw.Image
+		switch name {
+		case "RGBA":
+			dst = image.NewRGBA(src.Bounds())
+		case "NRGBA":
+			dst = image.NewNRGBA(src.Bounds())
+		case "Gray":
+			dst = image.NewGray(src.Bounds())
+		}
+		result, err := engine.RemoveInto(dst, src)
+		if err != nil {
+			t.Fatalf("%s: RemoveInto() error: %v", name, err)
+		}
+		if result.Detection.Region != detection.Region || !result.Detection.Detected || result.Detection.Scores != nil {
+			t.Errorf("%s: unexpected detection %+v", name, result.Detection)
+		}
+		if result.Changed != detection.Region {
+			t.Errorf("%s: changed area %v, expected %v", name, result.Changed, detection.Region)
+		}
+		if !samePixels(dst, engine.RemoveWatermark(src)) {
+			t.Errorf("%s: result differs from RemoveWatermark", name)
+		}
+	}
+
+	// Y'CbCr sources are converted to the destination's model and
+	// restored there
+	rgba := image.NewRGBA(inputs["YCbCr"].Bounds())
+	result, err := engine.RemoveInto(rgba, inputs["YCbCr"])
+	if err != nil {
+		t.Fatalf("YCbCr: RemoveInto() error: %v", err)
+	}
+	converted := image.NewRGBA(rgba.Rect)
+	draw.Draw(converted, converted.Rect, inputs["YCbCr"], image.Point{}, draw.Src)
+	if !samePixels(rgba, engine.RemoveDetected(converted, result.Detection)) {
+		t.Error("YCbCr: result differs from RemoveDetected on the converted image")
+	}
+}
+
+func TestRemoveInto_Destinations(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	inputs, _ := watermarkedInputs(engine, 800, 600)
+	src := inputs["RGBA"].(*image.RGBA)
+	expected := engine.RemoveWatermark(src)
+
+	// In place
+	inPlace := image.NewRGBA(src.Rect)
+	copy(inPlace.Pix, src.Pix)
+	if _, err := engine.RemoveInto(inPlace, inPlace); err != nil {
+		t.Fatalf("in place: RemoveInto() error: %v", err)
+	}
+	if !samePixels(inPlace, expected) {
+		t.Error("in place: result differs from RemoveWatermark")
+	}
+
+	// A larger destination keeps its pixels outside the source bounds
+	larger := image.NewRGBA(image.Rect(-10, -10, 820, 620))
+	draw.Draw(larger, larger.Rect, image.White, image.Point{}, draw.Src)
+	if _, err := engine.RemoveInto(larger, src); err != nil {
+		t.Fatalf("larger: RemoveInto() error: %v", err)
+	}
+	if !samePixels(larger.SubImage(src.Rect), expected) {
+		t.Error("larger: result differs from RemoveWatermark")
+	}
+	for _, p := range []image.Point{{-5, -5}, {810, 610}} {
+		if c := larger.RGBAAt(p.X, p.Y); c.R != 0xFF || c.A != 0xFF {
+			t.Errorf("larger: pixel %v outside the source changed to %v", p, c)
+		}
+	}
+
+	// Destinations of other types are restored on a copy and drawn back
+	cmyk := image.NewCMYK(src.Rect)
+	result, err := engine.RemoveInto(cmyk, src)
+	if err != nil {
+		t.Fatalf("CMYK: RemoveInto() error: %v", err)
+	}
+	if result.Changed != result.Detection.Region {
+		t.Errorf("CMYK: changed area %v, expected %v", result.Changed, result.Detection.Region)
+	}
+	converted := image.NewCMYK(src.Rect)
+	draw.Draw(converted, converted.Rect, src, image.Point{}, draw.Src)
+	want := image.NewCMYK(src.Rect)
+	copy(want.Pix, converted.Pix)
+	region := result.Detection.Region
+	draw.Draw(want, region, engine.RemoveDetected(converted, result.Detection), region.Min, draw.Src)
+	if !samePixels(cmyk, want) {
+		t.Error("CMYK: result differs from RemoveDetected on the converted image")
+	}
+	if samePixels(cmyk, converted) {
+		t.Error("CMYK: watermark not removed")
+	}
+
+	// A smaller destination is an error and is left alone
+	smaller := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	if _, err := engine.RemoveInto(smaller, src); err == nil {
+		t.Error("expected an error for a destination smaller than the source")
+	}
+	if !samePixels(smaller, image.NewRGBA(smaller.Rect)) {
+		t.Error("smaller destination was modified")
+	}
+}
+
+func TestRemoveInto_NoAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	inputs, _ := watermarkedInputs(engine, 800, 600)
+
+	for name, src := range inputs {
+		dst := newResultImage(src)
+		if name == "YCbCr" {
+			dst = image.NewRGBA(src.Bounds())
+		}
+		allocs := testing.AllocsPerRun(20, func() {
+			if _, err := engine.RemoveInto(dst, src); err != nil {
+				t.Fatalf("%s: RemoveInto() error: %v", name, err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per call", name, allocs)
+		}
+	}
+}
+
+func TestRemoveInto_Concurrent(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	small, _ := watermarkedInputs(engine, 800, 600)
+	large, _ := watermarkedInputs(engine, 1600, 1200)
+	sources := []image.Image{small["RGBA"], large["NRGBA"], small["Gray"], large["RGBA"]}
+	expected := make([]image.Image, len(sources))
+	for i, src := range sources {
+		expected[i] = engine.RemoveWatermark(src)
+	}
+
+	// One engine shared by goroutines that each own their destination
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 3; k++ {
+				i := (g + k) % len(sources)
+				dst := newResultImage(sources[i])
+				if _, err := engine.RemoveInto(dst, sources[i]); err != nil {
+					t.Errorf("RemoveInto() error: %v", err)
+					return
+				}
+				if !samePixels(dst, expected[i]) {
+					t.Errorf("source %d: concurrent result differs", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkRemoveInto(b *testing.B) {
+	engine, err := NewEngine()
+	if err != nil {
+		b.Fatalf("NewEngine() error: %v", err)
+	}
+
+	for _, size := range []struct {
+		name          string
+		width, height int
+	}{{"48px", 800, 600}, {"96px", 1600, 1200}} {
+		inputs, _ := watermarkedInputs(engine, size.width, size.height)
+		for _, kind := range []string{"RGBA", "NRGBA", "Gray", "YCbCr"} {
+			src := inputs[kind]
+			b.Run(size.name+"/"+kind, func(b *testing.B) {
+				dst := newResultImage(src)
+				if kind == "YCbCr" {
+					dst = image.NewRGBA(src.Bounds())
+				}
+				b.ReportAllocs()
+				for b.Loop() {
+					engine.RemoveInto(dst, src)
+				}
+			})
+		}
+		b.Run(size.name+"/RGBA/parallel", func(b *testing.B) {
+			src := inputs["RGBA"]
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				dst := newResultImage(src)
+				for pb.Next() {
+					engine.RemoveInto(dst, src)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package watermark
+
+import (
+	"image"
+	"math"
+)
+
+// inverseTable holds the reverse blend of a profile precomputed for every
+// 8-bit channel value, so that the default ReverseBlend can restore 8-bit
+// images by table lookups on their Pix slices instead of reading and writing
+// each pixel through the image.Image interface with float64 math.
+//
+// Alpha maps derived from 8-bit reference images only contain the 256
+// levels k/255. levels has one table per level present in the map (nil for
+// the others and for levels the engine skips), alpha holds the alpha each
+// level is inverted with under the engine's alpha limits, and level gives
+// the level of each pixel of the map.
+type inverseTable struct {
+	level  []uint8
+	levels [256]*levelTable
+	alpha  [256]float32
+}
+
+// levelTable maps a watermarked 8-bit channel value to its restored value
+// for the red, green and blue channels and, in the last entry, to the luma
+// of a restored gray pixel. Entries match what setRestored stores for the
+// ReverseBlend result exactly.
+type levelTable [4][256]uint8
+
+// newInverseTable precomputes the reverse blend of profile, with the alpha
+// of each level mapped by limit (see Engine.limitAlpha). It returns nil if
+// the alpha map has levels other than k/255, such as maps loaded from a
+// bundle or calibrated on a photo.
+func newInverseTable(profile *Profile, limit func(float32) float32) *inverseTable {
+	table := &inverseTable{level: make([]uint8, len(profile.AlphaMap))}
+	for i, alpha := range profile.AlphaMap {
+		k := math.Round(float64(alpha) * 255)
+		if k < 0 || k > 255 || float32(k)/255.0 != alpha {
+			return nil
+		}
+		level := uint8(k)
+		table.level[i] = level
+		if table.levels[level] != nil {
+			continue
+		}
+		if alpha := limit(alpha); alpha > 0 {
+			table.alpha[level] = alpha
+			table.levels[level] = newLevelTable(alpha, profile.LogoColor)
+		}
+	}
+	return table
+}
+
+// newLevelTable computes the restored values of every channel value at one
+// alpha level, already limited to the engine's maximum alpha.
+func newLevelTable(alpha float32, logo [3]float64) *levelTable {
+	var table levelTable
+	for v := range 256 {
+		original := reverseBlend([3]float64{float64(v), float64(v), float64(v)}, alpha, logo)
+		for c := range 3 {
+			table[c][v] = uint8(clamp(original[c], 0, 255))
+		}
+		table[3][v] = uint8(clamp(luma(original), 0, 255))
+	}
+	return &table
+}
+
+// restoreTable restores the detected watermark in place with the profile's
+// inverse table, if the engine's restorer is exactly ReverseBlend, the
+// detection uses the profile's own alpha map unchanged (no scale, sub-pixel
+// offset or fitted blend) and result is an *image.RGBA, *image.NRGBA or
+// *image.Gray. It returns the area it may have changed, and false if the
+// generic path must be used. The result is identical to the generic path's.
+func (e *Engine) restoreTable(result image.Image, detection Detection) (image.Rectangle, bool) {
+	if _, exact := e.Restorer().(ReverseBlend); !exact {
+		return image.Rectangle{}, false
+	}
+	if (detection.Scale != 0 && detection.Scale != 1) || detection.OffsetX != 0 || detection.OffsetY != 0 || detection.Fit != nil {
+		return image.Rectangle{}, false
+	}
+	registered := e.profileFor(detection)
+	if registered == nil {
+		return image.Rectangle{}, false
+	}
+	e.mu.RLock()
+	table := e.inverse[registered]
+	e.mu.RUnlock()
+	if table == nil {
+		return image.Rectangle{}, false
+	}
+
+	size := registered.Size
+	region := image.Rect(detection.Region.Min.X, detection.Region.Min.Y,
+		detection.Region.Min.X+size, detection.Region.Min.Y+size)
+	area := region.Intersect(result.Bounds())
+
+	switch img := result.(type) {
+	case *image.RGBA:
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			i := (y-region.Min.Y)*size + area.Min.X - region.Min.X
+			o := img.PixOffset(area.Min.X, y)
+			for x := area.Min.X; x < area.Max.X; x, i, o = x+1, i+1, o+4 {
+				levels := table.levels[table.level[i]]
+				if levels == nil {
+					continue
+				}
+				p := img.Pix[o : o+4 : o+4]
+				switch p[3] {
+				case 0xFF:
+					p[0], p[1], p[2] = levels[0][p[0]], levels[1][p[1]], levels[2][p[2]]
+				case 0:
+				default:
+					// Semi-transparent pixels are restored on their
+					// straight color, which the table does not cover
+					alpha := table.alpha[table.level[i]]
+					setRestored(img, x, y, reverseBlend(rgbAt(img, x, y), alpha, registered.LogoColor))
+				}
+			}
+		}
+	case *image.NRGBA:
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			i := (y-region.Min.Y)*size + area.Min.X - region.Min.X
+			o := img.PixOffset(area.Min.X, y)
+			for x := area.Min.X; x < area.Max.X; x, i, o = x+1, i+1, o+4 {
+				levels := table.levels[table.level[i]]
+				p := img.Pix[o : o+4 : o+4]
+				if levels == nil || p[3] == 0 {
+					continue
+				}
+				p[0], p[1], p[2] = levels[0][p[0]], levels[1][p[1]], levels[2][p[2]]
+			}
+		}
+	case *image.Gray:
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			i := (y-region.Min.Y)*size + area.Min.X - region.Min.X
+			o := img.PixOffset(area.Min.X, y)
+			for x := area.Min.X; x < area.Max.X; x, i, o = x+1, i+1, o+1 {
+				if levels := table.levels[table.level[i]]; levels != nil {
+					img.Pix[o] = levels[3][img.Pix[o]]
+				}
+			}
+		}
+	default:
+		return image.Rectangle{}, false
+	}
+	return area, true
+}
@@ -0,0 +1,205 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ClampMode selects how pixels whose alpha exceeds the engine's maximum
+// alpha (see WithMaxAlpha) are restored.
+type ClampMode int
+
+const (
+	// ClampToMax inverts the blend with alpha clamped to the maximum,
+	// which bounds the noise amplification but leaves a trace of the logo.
+	// It is the default.
+	ClampToMax ClampMode = iota
+
+	// SkipAboveMax leaves such pixels unchanged.
+	SkipAboveMax
+)
+
+// String returns the name of the clamp mode as accepted by ParseClampMode.
+func (m ClampMode) String() string {
+	switch m {
+	case ClampToMax:
+		return "clamp"
+	case SkipAboveMax:
+		return "skip"
+	}
+	return fmt.Sprintf("ClampMode(%d)", int(m))
+}
+
+// ParseClampMode returns the clamp mode with the given name ("clamp" or
+// "skip").
+func ParseClampMode(name string) (ClampMode, error) {
+	for _, m := range []ClampMode{ClampToMax, SkipAboveMax} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown clamp mode %q (want clamp or skip)", name)
+}
+
+// Option configures an Engine created by NewEngine. Options are applied in
+// order, so a later option overrides an earlier one of the same kind, and
+// validated together when the engine is created.
+type Option func(*engineConfig)
+
+// engineConfig collects the settings of the options passed to NewEngine.
+type engineConfig struct {
+	profilePaths    []string
+	profiles        []string
+	logoColor       *[3]float64
+	alphaThreshold  float64
+	maxAlpha        float64
+	clamp           ClampMode
+	restorer        Restorer
+	strategy        Strategy
+	inpaintFallback bool
+	regularization  float64
+}
+
+// WithProfilePaths loads the profile bundles found at paths (see
+// LoadProfiles) and registers them after the built-in profiles.
+func WithProfilePaths(paths ...string) Option {
+	return func(c *engineConfig) {
+		c.profilePaths = append(c.profilePaths, paths...)
+	}
+}
+
+// WithProfiles registers only the named profiles, among the built-in
+// profiles and those loaded by WithProfilePaths, so that detection does not
+// consider the others. Naming a profile that does not exist is an error.
+func WithProfiles(names ...string) Option {
+	return func(c *engineConfig) {
+		c.profiles = append([]string{}, names...)
+	}
+}
+
+// WithLogoColor sets the logo color of the built-in profiles, per RGB
+// channel on the 0-255 scale, for watermarks whose logo is not pure white.
+// Their alpha maps are unchanged. Profiles loaded from bundles keep their
+// own logo color.
+func WithLogoColor(color [3]float64) Option {
+	return func(c *engineConfig) {
+		c.logoColor = &color
+	}
+}
+
+// WithAlphaThreshold sets the minimum alpha of the pixels the engine
+// restores, AlphaThreshold by default. Pixels below it are considered
+// untouched by the watermark. It must be positive and below the maximum
+// alpha.
+func WithAlphaThreshold(threshold float64) Option {
+	return func(c *engineConfig) {
+		c.alphaThreshold = threshold
+	}
+}
+
+// WithMaxAlpha sets the largest alpha the engine inverts the blend with,
+// MaxAlpha by default; see WithClampMode for the pixels above it. Lower
+// values limit the noise amplification of nearly opaque pixels, higher
+// values restore more of them exactly. It must be above the alpha
+// threshold and below 1.
+func WithMaxAlpha(maxAlpha float64) Option {
+	return func(c *engineConfig) {
+		c.maxAlpha = maxAlpha
+	}
+}
+
+// WithClampMode selects how pixels whose alpha exceeds the maximum alpha
+// are restored. The default is ClampToMax.
+func WithClampMode(mode ClampMode) Option {
+	return func(c *engineConfig) {
+		c.clamp = mode
+	}
+}
+
+// WithRestorer sets the restorer of the engine (see SetRestorer).
+func WithRestorer(restorer Restorer) Option {
+	return func(c *engineConfig) {
+		c.restorer = restorer
+	}
+}
+
+// WithStrategy sets the restoration strategy of the engine (see
+// SetStrategy).
+func WithStrategy(strategy Strategy) Option {
+	return func(c *engineConfig) {
+		c.strategy = strategy
+	}
+}
+
+// WithInpaintFallback enables or disables the inpainting fallback (see
+// SetInpaintFallback).
+func WithInpaintFallback(enabled bool) Option {
+	return func(c *engineConfig) {
+		c.inpaintFallback = enabled
+	}
+}
+
+// WithRegularization sets the strength of the regularized inversion (see
+// SetRegularization). Unlike the setter, negative values are an error.
+func WithRegularization(strength float64) Option {
+	return func(c *engineConfig) {
+		c.regularization = strength
+	}
+}
+
+// newEngineConfig applies opts to the default settings.
+func newEngineConfig(opts []Option) engineConfig {
+	config := engineConfig{alphaThreshold: AlphaThreshold, maxAlpha: MaxAlpha}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// validate reports the first setting that is out of range.
+func (c *engineConfig) validate() error {
+	if !(c.alphaThreshold > 0 && c.alphaThreshold < c.maxAlpha) {
+		return fmt.Errorf("invalid alpha threshold %g (must be positive and below the maximum alpha %g)",
+			c.alphaThreshold, c.maxAlpha)
+	}
+	if !(c.maxAlpha < 1) {
+		return fmt.Errorf("invalid maximum alpha %g (must be below 1)", c.maxAlpha)
+	}
+	if c.clamp != ClampToMax && c.clamp != SkipAboveMax {
+		return fmt.Errorf("invalid clamp mode %v", c.clamp)
+	}
+	if c.logoColor != nil {
+		for _, v := range c.logoColor {
+			if !(v >= 0 && v <= 255) {
+				return fmt.Errorf("invalid logo color %v (channels must be in [0, 255])", *c.logoColor)
+			}
+		}
+	}
+	if c.strategy != StrategyReverse && c.strategy != StrategyInpaint {
+		return fmt.Errorf("invalid strategy %v", c.strategy)
+	}
+	if !(c.regularization >= 0) {
+		return fmt.Errorf("invalid regularization %g (must not be negative)", c.regularization)
+	}
+	if c.profiles != nil && len(c.profiles) == 0 {
+		return errors.New("no profiles selected")
+	}
+	return nil
+}
+
+// selectProfiles returns the profiles named by WithProfiles, in their
+// original order, or all profiles if none are named.
+func (c *engineConfig) selectProfiles(profiles []Profile) ([]Profile, error) {
+	if c.profiles == nil {
+		return profiles, nil
+	}
+	for _, name := range c.profiles {
+		if !slices.ContainsFunc(profiles, func(p Profile) bool { return p.Name == name }) {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	return slices.DeleteFunc(profiles, func(p Profile) bool {
+		return !slices.Contains(c.profiles, p.Name)
+	}), nil
+}
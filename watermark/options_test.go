@@ -0,0 +1,258 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestNewEngine_Options(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.AlphaThreshold() != AlphaThreshold || engine.MaxAlpha() != MaxAlpha || engine.ClampMode() != ClampToMax {
+		t.Errorf("default limits: threshold %g, maximum %g, clamp %v",
+			engine.AlphaThreshold(), engine.MaxAlpha(), engine.ClampMode())
+	}
+
+	engine, err = NewEngine(
+		WithAlphaThreshold(0.01),
+		WithMaxAlpha(0.9),
+		WithClampMode(SkipAboveMax),
+		WithRestorer(RegularizedBlend{}),
+		WithStrategy(StrategyInpaint),
+		WithInpaintFallback(true),
+		WithRegularization(0.5),
+	)
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.AlphaThreshold() != 0.01 || engine.MaxAlpha() != 0.9 || engine.ClampMode() != SkipAboveMax {
+		t.Errorf("limits: threshold %g, maximum %g, clamp %v",
+			engine.AlphaThreshold(), engine.MaxAlpha(), engine.ClampMode())
+	}
+	if _, ok := engine.Restorer().(RegularizedBlend); !ok {
+		t.Errorf("restorer %T, expected RegularizedBlend", engine.Restorer())
+	}
+	if engine.Strategy() != StrategyInpaint || !engine.InpaintFallback() || engine.Regularization() != 0.5 {
+		t.Errorf("strategy %v, fallback %v, regularization %g",
+			engine.Strategy(), engine.InpaintFallback(), engine.Regularization())
+	}
+}
+
+func TestNewEngine_InvalidOptions(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []Option
+	}{
+		{"zero threshold", []Option{WithAlphaThreshold(0)}},
+		{"negative threshold", []Option{WithAlphaThreshold(-0.01)}},
+		{"threshold above maximum", []Option{WithAlphaThreshold(0.5), WithMaxAlpha(0.4)}},
+		{"opaque maximum", []Option{WithMaxAlpha(1)}},
+		{"clamp mode", []Option{WithClampMode(ClampMode(7))}},
+		{"logo color", []Option{WithLogoColor([3]float64{255, 256, 255})}},
+		{"strategy", []Option{WithStrategy(Strategy(7))}},
+		{"regularization", []Option{WithRegularization(-1)}},
+		{"no profiles", []Option{WithProfiles()}},
+		{"unknown profile", []Option{WithProfiles("nonexistent")}},
+		{"missing bundle", []Option{WithProfilePaths("testdata/nonexistent.json")}},
+	}
+	for _, tc := range testCases {
+		if _, err := NewEngine(tc.opts...); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestNewEngine_ProfileOptions(t *testing.T) {
+	defaults, err := DefaultProfiles()
+	if err != nil {
+		t.Fatalf("DefaultProfiles() error: %v", err)
+	}
+	name := defaults[len(defaults)-1].Name
+
+	engine, err := NewEngine(WithProfiles(name), WithLogoColor([3]float64{250, 248, 240}))
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	profiles := engine.Profiles()
+	if len(profiles) != 1 || profiles[0].Name != name {
+		t.Fatalf("registered %d profiles, expected only %s", len(profiles), name)
+	}
+	if profiles[0].LogoColor != [3]float64{250, 248, 240} {
+		t.Errorf("logo color %v, expected the configured one", profiles[0].LogoColor)
+	}
+	if !slices.Equal(profiles[0].AlphaMap, defaults[len(defaults)-1].AlphaMap) {
+		t.Error("the logo color option changed the alpha map")
+	}
+}
+
+func TestNewEngine_AlphaLimits(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	inputs, detection := watermarkedInputs(engine, 800, 600)
+	delete(inputs, "YCbCr")
+	src := inputs["RGBA"].(*image.RGBA)
+	alphaMap := engine.profileByConfig(detection.Config).AlphaMap
+	size := engine.profileByConfig(detection.Config).Size
+	maxAlpha := float64(slices.Max(alphaMap)) / 2
+	threshold := 0.05
+
+	for _, mode := range []ClampMode{ClampToMax, SkipAboveMax} {
+		opts := []Option{WithAlphaThreshold(threshold), WithMaxAlpha(maxAlpha), WithClampMode(mode)}
+		limited, err := NewEngine(opts...)
+		if err != nil {
+			t.Fatalf("%v: NewEngine() error: %v", mode, err)
+		}
+		generic, err := NewEngine(append(opts, WithRestorer(genericReverseBlend))...)
+		if err != nil {
+			t.Fatalf("%v: NewEngine() error: %v", mode, err)
+		}
+
+		// The inverse tables apply the same limits as the generic path
+		for name, img := range inputs {
+			if got, want := limited.RemoveDetected(img, detection), generic.RemoveDetected(img, detection); !reflect.DeepEqual(got, want) {
+				t.Errorf("%v/%s: inverse table result differs from the generic reverse blend", mode, name)
+			}
+		}
+
+		result := limited.RemoveDetected(src, detection).(*image.RGBA)
+		clamped := 0
+		for i, alpha := range alphaMap {
+			x, y := detection.Region.Min.X+i%size, detection.Region.Min.Y+i/size
+			unchanged := result.RGBAAt(x, y) == src.RGBAAt(x, y)
+			switch {
+			case float64(alpha) < threshold:
+				if !unchanged {
+					t.Fatalf("%v: pixel (%d, %d) below the threshold changed", mode, x, y)
+				}
+			case float64(alpha) > maxAlpha && mode == SkipAboveMax:
+				if !unchanged {
+					t.Fatalf("%v: pixel (%d, %d) above the maximum alpha changed", mode, x, y)
+				}
+			case float64(alpha) > maxAlpha:
+				if !unchanged {
+					clamped++
+				}
+			}
+		}
+		if mode == ClampToMax && clamped == 0 {
+			t.Errorf("%v: no pixel above the maximum alpha was restored", mode)
+		}
+	}
+}
+
+func TestNewEngine_WidenedAlphaLimits(t *testing.T) {
+	opts := []Option{WithAlphaThreshold(0.001), WithMaxAlpha(0.999)}
+	widened, err := NewEngine(opts...)
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	generic, err := NewEngine(append(opts, WithRestorer(genericReverseBlend))...)
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	defaults, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// A faint pixel below the default threshold and nearly opaque ones
+	// above the default maximum alpha, in an alpha map with levels other
+	// than k/255 and in one the inverse tables cover
+	white := [3]float64{255, 255, 255}
+	profiles := []Profile{
+		{Name: "fine", AlphaMap: []float32{0.0015, 0.995, 0.5, 0}, Size: 2, LogoColor: white},
+		{Name: "levels", AlphaMap: []float32{0, 254.0 / 255, 128.0 / 255, 0}, Size: 2, LogoColor: white},
+	}
+	for _, profile := range profiles {
+		for _, engine := range []*Engine{widened, generic, defaults} {
+			if err := engine.RegisterProfile(profile); err != nil {
+				t.Fatalf("RegisterProfile(%s) error: %v", profile.Name, err)
+			}
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		for i, alpha := range profile.AlphaMap {
+			v := uint8(math.Round(float64(alpha)*255 + (1-float64(alpha))*100))
+			img.SetRGBA(i%2, i/2, color.RGBA{R: v, G: v, B: v, A: 0xFF})
+		}
+		detection := Detection{Profile: profile.Name, Region: img.Rect}
+		if _, ok := widened.restoreTable(newResultImage(img), detection); ok != (profile.Name == "levels") {
+			t.Errorf("%s: inverse table used: %v", profile.Name, ok)
+		}
+
+		result := widened.RemoveDetected(img, detection).(*image.RGBA)
+		if want := generic.RemoveDetected(img, detection); !reflect.DeepEqual(result, want) {
+			t.Errorf("%s: inverse table result differs from the generic reverse blend", profile.Name)
+		}
+		unclamped := reverseBlend(rgbAt(img, 1, 0), profile.AlphaMap[1], white)
+		if got, want := result.RGBAAt(1, 0).R, uint8(clamp(unclamped[0], 0, 255)); got != want {
+			t.Errorf("%s: nearly opaque pixel restored to %d, expected %d without clamping", profile.Name, got, want)
+		}
+		if got := defaults.RemoveDetected(img, detection).(*image.RGBA).RGBAAt(1, 0); got == result.RGBAAt(1, 0) {
+			t.Errorf("%s: default engine did not clamp the nearly opaque pixel", profile.Name)
+		}
+	}
+
+	// The faint pixel is restored only with the lower threshold
+	detection := Detection{Profile: "fine", Region: image.Rect(0, 0, 2, 2)}
+	img := image.NewRGBA(detection.Region)
+	img.SetRGBA(0, 0, color.RGBA{R: 200, G: 200, B: 200, A: 0xFF})
+	if widened.RemoveDetected(img, detection).(*image.RGBA).RGBAAt(0, 0).R == 200 {
+		t.Error("pixel above the lowered threshold left unchanged")
+	}
+	if defaults.RemoveDetected(img, detection).(*image.RGBA).RGBAAt(0, 0).R != 200 {
+		t.Error("default engine restored a pixel below its threshold")
+	}
+}
+
+func TestNewEngine_WidenedMaxAlphaFit(t *testing.T) {
+	widened, err := NewEngine(WithMaxAlpha(0.999))
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	defaults, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// The fit tries gains up to maxFitGain; this pixel stays below the
+	// widened maximum alpha at that gain but not below the default one
+	alpha := float32((MaxAlpha + 0.999) / 2 / maxFitGain)
+	profile := Profile{Name: "dense", AlphaMap: []float32{0.5, alpha, 0.25, 0}, Size: 2, LogoColor: [3]float64{255, 255, 255}}
+	for _, engine := range []*Engine{widened, defaults} {
+		if err := engine.RegisterProfile(profile); err != nil {
+			t.Fatalf("RegisterProfile() error: %v", err)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	detection := Detection{Profile: profile.Name, Region: img.Rect}
+	if got := widened.blendSamples(img, detection).alpha; !slices.Contains(got, float64(alpha)) {
+		t.Errorf("widened engine fit on alphas %v, expected %g among them", got, alpha)
+	}
+	if got := defaults.blendSamples(img, detection).alpha; slices.Contains(got, float64(alpha)) {
+		t.Errorf("default engine fit on alphas %v, expected %g excluded", got, alpha)
+	}
+}
+
+func TestParseClampMode(t *testing.T) {
+	for _, mode := range []ClampMode{ClampToMax, SkipAboveMax} {
+		if parsed, err := ParseClampMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("ParseClampMode(%q) = %v, %v", mode.String(), parsed, err)
+		}
+	}
+	if _, err := ParseClampMode("saturate"); err == nil {
+		t.Error("expected an error for an unknown clamp mode")
+	}
+}
@@ -0,0 +1,184 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+)
+
+// Overlay is an image.Image that shows Source with the pixels inside the
+// bounds of each of Patches taken from that patch instead. It is returned by
+// RemoveOverlay, whose patches hold the restored watermark areas, so that
+// removing a watermark does not copy the whole image.
+//
+// Patches are disjoint. Their colors may use a different color model than
+// Source for image types RemoveAll converts (see newResultImage).
+type Overlay struct {
+	Source  image.Image
+	Patches []image.Image
+}
+
+// ColorModel returns the color model of the source image.
+func (o *Overlay) ColorModel() color.Model {
+	return o.Source.ColorModel()
+}
+
+// Bounds returns the bounds of the source image.
+func (o *Overlay) Bounds() image.Rectangle {
+	return o.Source.Bounds()
+}
+
+// At returns the color of the pixel at (x, y), from the patch covering it
+// if any.
+func (o *Overlay) At(x, y int) color.Color {
+	p := image.Pt(x, y)
+	for _, patch := range o.Patches {
+		if p.In(patch.Bounds()) {
+			return patch.At(x, y)
+		}
+	}
+	return o.Source.At(x, y)
+}
+
+// RemoveOverlay removes every watermark in detections like RemoveAll, but
+// returns an Overlay of the original image instead of a copy: only the
+// surroundings of the watermarks, which restorers use for context, are
+// copied and restored, so that memory use is proportional to the watermark
+// size rather than the image size. The result is the same as RemoveAll's.
+//
+// The original image is not modified and must not be modified while the
+// overlay is in use.
+func (e *Engine) RemoveOverlay(img image.Image, detections []Detection) *Overlay {
+	overlay := &Overlay{Source: img}
+	for _, group := range contextGroups(img.Bounds(), detections) {
+		overlay.Patches = append(overlay.Patches, e.RemoveAll(cropImage(img, group.area), group.detections))
+	}
+	return overlay
+}
+
+// RemoveInPlace removes every watermark in detections from img itself
+// instead of a copy, and returns the area it may have changed. Images of the
+// types RemoveAll keeps (see newResultImage) are restored directly; other
+// images are restored on a small copy of each watermark's surroundings (see
+// RemoveOverlay) that is drawn back over the watermark.
+func (e *Engine) RemoveInPlace(img draw.Image, detections []Detection) image.Rectangle {
+	var changed image.Rectangle
+	if restorable(img) {
+		for _, detection := range detections {
+			changed = changed.Union(e.restore(img, detection))
+		}
+		return changed
+	}
+
+	overlay := e.RemoveOverlay(img, detections)
+	bounds := img.Bounds()
+	for _, detection := range detections {
+		region, _, _, ok := e.restoreInputs(detection)
+		if !ok {
+			continue
+		}
+		area := region.Intersect(bounds)
+		for _, patch := range overlay.Patches {
+			if r := area.Intersect(patch.Bounds()); !r.Empty() {
+				draw.Draw(img, r, patch, r.Min, draw.Src)
+			}
+		}
+		changed = changed.Union(area)
+	}
+	return changed
+}
+
+// contextGroup is a set of detections restored together on a copy of area.
+type contextGroup struct {
+	area       image.Rectangle
+	detections []Detection
+}
+
+// contextGroups groups detections whose context areas (see contextRect)
+// overlap, keeping their order within each group, so that each group can be
+// restored on its own copy of the image.
+func contextGroups(bounds image.Rectangle, detections []Detection) []contextGroup {
+	var groups []contextGroup
+	var members [][]int
+	for i, detection := range detections {
+		group := contextGroup{area: contextRect(detection.Region, bounds)}
+		indices := []int{i}
+
+		// Merge every group the new area overlaps, repeating until the
+		// grown area overlaps no other group
+		for merged := true; merged; {
+			merged = false
+			for j := 0; j < len(groups); j++ {
+				if !groups[j].area.Overlaps(group.area) {
+					continue
+				}
+				group.area = group.area.Union(groups[j].area)
+				indices = append(indices, members[j]...)
+				groups = slices.Delete(groups, j, j+1)
+				members = slices.Delete(members, j, j+1)
+				merged = true
+				j--
+			}
+		}
+		groups = append(groups, group)
+		members = append(members, indices)
+	}
+
+	for i := range groups {
+		slices.Sort(members[i])
+		for _, index := range members[i] {
+			groups[i].detections = append(groups[i].detections, detections[index])
+		}
+	}
+	return groups
+}
+
+// contextAlign is the alignment of context areas, the largest JPEG MCU
+// size, so that chroma samples and DCT blocks are never split.
+const contextAlign = 2 * jpegBlockSize
+
+// contextRect returns the part of bounds a restorer may read to restore a
+// watermark covering region: one watermark size around it, which holds the
+// source patches of PatchMatchInpaint and the neighbors used by the other
+// restorers and by the Y'CbCr chroma inversion and deblocking, aligned to
+// contextAlign.
+func contextRect(region image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	r := region.Inset(-max(patchWindowMargin*region.Dx(), contextAlign))
+	align := func(v int, up bool) int {
+		m := v % contextAlign
+		if m < 0 {
+			m += contextAlign
+		}
+		if m == 0 {
+			return v
+		}
+		if up {
+			return v - m + contextAlign
+		}
+		return v - m
+	}
+	r = image.Rect(align(r.Min.X, false), align(r.Min.Y, false), align(r.Max.X, true), align(r.Max.Y, true))
+	return r.Intersect(bounds)
+}
+
+// cropImage returns the part of img inside rect, sharing its pixels.
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	return &croppedImage{Image: img, rect: rect.Intersect(img.Bounds())}
+}
+
+// croppedImage restricts the bounds of an image without a SubImage method.
+type croppedImage struct {
+	image.Image
+	rect image.Rectangle
+}
+
+// Bounds returns the cropped bounds.
+func (c *croppedImage) Bounds() image.Rectangle {
+	return c.rect
+}
@@ -0,0 +1,192 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// samePixels reports whether two images have the same bounds and colors.
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRemoveOverlay_MatchesRemoveAll(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+	rgba := createNoiseImage(width, height, 9)
+	applyWatermark(rgba, region, profile.AlphaMap)
+	cmyk := image.NewCMYK(rgba.Rect)
+	draw.Draw(cmyk, cmyk.Rect, rgba, image.Point{}, draw.Src)
+
+	inputs := map[string]image.Image{
+		"RGBA":  rgba,
+		"YCbCr": toYCbCr(rgba, image.YCbCrSubsampleRatio420),
+		"CMYK":  cmyk,
+	}
+	restorers := []Restorer{
+		ReverseBlend{},
+		Hybrid{Primary: ReverseBlend{}, Fallback: PatchMatchInpaint{}},
+		DiffusionInpaint{},
+		RegularizedBlend{Strength: 1},
+	}
+	for name, img := range inputs {
+		for _, restorer := range restorers {
+			engine.SetRestorer(restorer)
+			overlay := engine.RemoveOverlay(img, []Detection{detection})
+
+			// Only the surroundings of the watermark are copied
+			if len(overlay.Patches) != 1 {
+				t.Fatalf("%s, %T: expected 1 patch, got %d", name, restorer, len(overlay.Patches))
+			}
+			patch := overlay.Patches[0].Bounds()
+			if patch.Dx()*patch.Dy() > 9*region.Dx()*region.Dy() {
+				t.Errorf("%s, %T: patch %v is larger than the watermark surroundings", name, restorer, patch)
+			}
+
+			// The patch matches RemoveAll (which converts CMYK images to
+			// RGBA, so only the patch is compared)
+			if !samePixels(overlay.Patches[0], cropImage(engine.RemoveAll(img, []Detection{detection}), patch)) {
+				t.Errorf("%s, %T: overlay differs from RemoveAll", name, restorer)
+			}
+		}
+	}
+}
+
+func TestRemoveOverlay_SeparateWatermarks(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	profile := engine.profileByConfig(WatermarkConfig{Size: 48, Margin: 32})
+	img := createNoiseImage(1200, 900, 4)
+	var detections []Detection
+	for _, at := range []image.Point{{40, 40}, {1100, 800}, {1070, 780}} {
+		region := image.Rectangle{Min: at, Max: at.Add(image.Pt(48, 48))}
+		applyWatermark(img, region, profile.AlphaMap)
+		detections = append(detections, Detection{Profile: profile.Name, Config: profile.Config(), Region: region, Scale: 1})
+	}
+
+	overlay := engine.RemoveOverlay(img, detections)
+	if len(overlay.Patches) != 2 {
+		t.Errorf("expected the overlapping watermarks to share a patch, got %d patches", len(overlay.Patches))
+	}
+	if !samePixels(overlay, engine.RemoveAll(img, detections)) {
+		t.Error("overlay differs from RemoveAll")
+	}
+}
+
+func TestRemoveInPlace(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	detections := []Detection{{Profile: profile.Name, Config: config, Region: region, Scale: 1}}
+	img := createNoiseImage(width, height, 2)
+	applyWatermark(img, region, profile.AlphaMap)
+
+	for _, restorer := range []Restorer{ReverseBlend{}, Hybrid{Primary: ReverseBlend{}, Fallback: DiffusionInpaint{}}} {
+		engine.SetRestorer(restorer)
+
+		// Native types are restored directly
+		rgba := image.NewRGBA(img.Rect)
+		copy(rgba.Pix, img.Pix)
+		if changed := engine.RemoveInPlace(rgba, detections); changed != region {
+			t.Errorf("%T: changed area %v, expected %v", restorer, changed, region)
+		}
+		if !samePixels(rgba, engine.RemoveAll(img, detections)) {
+			t.Errorf("%T: RGBA restored in place differs from RemoveAll", restorer)
+		}
+
+		// Other types get the restored watermark converted to their model
+		// and keep every other pixel
+		cmyk := image.NewCMYK(img.Rect)
+		draw.Draw(cmyk, cmyk.Rect, img, image.Point{}, draw.Src)
+		source := image.NewCMYK(img.Rect)
+		copy(source.Pix, cmyk.Pix)
+		engine.RemoveInPlace(cmyk, detections)
+		expected := engine.RemoveAll(source, detections)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				want := source.CMYKAt(x, y)
+				if image.Pt(x, y).In(region) {
+					want = color.CMYKModel.Convert(expected.At(x, y)).(color.CMYK)
+				}
+				if got := cmyk.CMYKAt(x, y); got != want {
+					t.Fatalf("%T: CMYK pixel (%d,%d) is %v, expected %v", restorer, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestContextRect(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 300)
+	for _, tc := range []struct {
+		region, expected image.Rectangle
+	}{
+		{image.Rect(320, 220, 368, 268), image.Rect(272, 160, 400, 300)},
+		{image.Rect(10, 10, 14, 14), image.Rect(0, 0, 32, 32)},
+	} {
+		if got := contextRect(tc.region, bounds); got != tc.expected {
+			t.Errorf("contextRect(%v) = %v, expected %v", tc.region, got, tc.expected)
+		}
+	}
+}
+
+func TestNewResultImage_SubImageCopiesItsPixels(t *testing.T) {
+	img := createNoiseImage(400, 300, 12)
+	sub := img.SubImage(image.Rect(100, 101, 120, 110)).(*image.RGBA)
+	result := newResultImage(sub).(*image.RGBA)
+	if want := 20 * 9 * 4; len(result.Pix) != want || result.Stride != 20*4 {
+		t.Errorf("copied %d bytes with stride %d, expected %d bytes with stride %d",
+			len(result.Pix), result.Stride, want, 20*4)
+	}
+	if !samePixels(result, sub) {
+		t.Error("copy differs from the sub-image")
+	}
+
+	// Y'CbCr planes are packed to the chroma width of the bounds
+	ycbcr := image.NewYCbCr(img.Rect, image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 7)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*3), uint8(i*5)
+	}
+	subYCbCr := ycbcr.SubImage(image.Rect(101, 101, 120, 110)).(*image.YCbCr)
+	cloned := cloneYCbCr(subYCbCr)
+	if len(cloned.Y) != 19*9 || len(cloned.Cb) != 10*5 || len(cloned.Cr) != 10*5 {
+		t.Errorf("copied planes of %d, %d and %d bytes, expected %d, %d and %d",
+			len(cloned.Y), len(cloned.Cb), len(cloned.Cr), 19*9, 10*5, 10*5)
+	}
+	if !samePixels(cloned, subYCbCr) {
+		t.Error("copy differs from the Y'CbCr sub-image")
+	}
+}
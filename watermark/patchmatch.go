@@ -0,0 +1,363 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+)
+
+// Strategy selects how the engine restores the pixels under a watermark.
+type Strategy int
+
+const (
+	// StrategyReverse inverts the alpha blend exactly, recovering the
+	// original pixels (see SetInpaintFallback for pixels where the
+	// inversion is unreliable). This is the default.
+	StrategyReverse Strategy = iota
+
+	// StrategyInpaint discards the pixels covered by the alpha map and
+	// synthesizes them from texture around the watermark with PatchMatch
+	// exemplar inpainting. Use it when the inversion leaves visible
+	// residue, e.g. on heavily recompressed or resized images.
+	StrategyInpaint
+)
+
+// String returns the name of the strategy as accepted by ParseStrategy.
+func (s Strategy) String() string {
+	switch s {
+	case StrategyReverse:
+		return "reverse"
+	case StrategyInpaint:
+		return "inpaint"
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy with the given name ("reverse" or
+// "inpaint").
+func ParseStrategy(name string) (Strategy, error) {
+	for _, s := range []Strategy{StrategyReverse, StrategyInpaint} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy %q (want reverse or inpaint)", name)
+}
+
+// SetStrategy selects the restoration strategy used by RemoveWatermark,
+// RemoveDetected and RemoveAll, unless a restorer is set by SetRestorer.
+// The default is StrategyReverse.
+func (e *Engine) SetStrategy(strategy Strategy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.strategy = strategy
+}
+
+// Strategy returns the restoration strategy in use.
+func (e *Engine) Strategy() Strategy {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.strategy
+}
+
+// PatchMatch inpainting parameters. Patches are (2*patchRadius+1) pixels
+// square; the initial fill tries patchInitSamples random source patches per
+// pixel besides those suggested by its neighbors, and each of the
+// patchMatchRounds rounds improves the nearest-neighbor field with
+// patchMatchIterations PatchMatch passes before re-synthesizing the hole.
+const (
+	patchRadius          = 3
+	patchInitSamples     = 32
+	patchMatchIterations = 4
+	patchMatchRounds     = 5
+)
+
+// patchWindowMargin is how far, in multiples of the watermark size, the
+// area supplying source patches extends beyond the watermark region.
+const patchWindowMargin = 1
+
+// patchMatchSeed makes the randomized search reproducible, so that the same
+// input always gives the same output.
+const patchMatchSeed = 1
+
+// PatchMatchInpaint is a Restorer that discards the pixels covered by the
+// alpha map and synthesizes them from the texture within one watermark size
+// around the region (see inpaintPatchMatch). It is the restorer of
+// StrategyInpaint.
+type PatchMatchInpaint struct{}
+
+// Restore implements Restorer.
+func (PatchMatchInpaint) Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+	threshold, _ := profile.alphaLimits()
+	points, indices := holePixels(img.Bounds(), region, alphaMap, threshold)
+	window := region.Inset(-patchWindowMargin * region.Dx())
+	restoration := Restoration{Pixels: make([][3]float64, len(alphaMap))}
+	for k, v := range inpaintPatchMatch(img, points, window) {
+		for c := range v {
+			restoration.Pixels[indices[k]][c] = roundLevel(v[c], img)
+		}
+	}
+	return restoration
+}
+
+// inpaintPatchMatch fills the given pixels of img with texture copied from
+// the known pixels inside window, using PatchMatch (Barnes et al., 2009) to
+// find similar patches. Points outside window are left at zero.
+//
+// The hole is first filled from the outside in: every pixel of a layer is
+// copied from the source patch that best matches the pixels known so far
+// around it, which carries the phase of the surrounding texture into the
+// hole. Every round then matches the full patch around each hole pixel to
+// its most similar patch of known pixels (propagating good matches to
+// neighbors and sampling random candidates at shrinking distances), and sets
+// each hole pixel to the average of the pixels the overlapping matches put
+// there. If window contains no complete patch of known pixels, the hole is
+// filled by inpaintDiffusion instead.
+//
+// It returns the filled RGB values in the order of points; img is not
+// modified.
+func inpaintPatchMatch(img image.Image, points []image.Point, window image.Rectangle) [][3]float64 {
+	rect := window.Intersect(img.Bounds())
+	width, height := rect.Dx(), rect.Dy()
+	values := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values[y*width+x] = rgbAt(img, rect.Min.X+x, rect.Min.Y+y)
+		}
+	}
+
+	// Hole pixels inside the window are the targets
+	target := make([]int, width*height)
+	for i := range target {
+		target[i] = -1
+	}
+	var targets []int
+	for _, p := range points {
+		if !p.In(rect) {
+			continue
+		}
+		i := (p.Y-rect.Min.Y)*width + p.X - rect.Min.X
+		if target[i] < 0 {
+			target[i] = len(targets)
+			targets = append(targets, i)
+		}
+	}
+
+	// A source patch must lie inside the window and contain no hole pixel
+	sources := make([]bool, width*height)
+	var sourceList []int
+	for y := patchRadius; y < height-patchRadius; y++ {
+		for x := patchRadius; x < width-patchRadius; x++ {
+			valid := true
+			for dy := -patchRadius; dy <= patchRadius && valid; dy++ {
+				for dx := -patchRadius; dx <= patchRadius; dx++ {
+					if target[(y+dy)*width+x+dx] >= 0 {
+						valid = false
+						break
+					}
+				}
+			}
+			if valid {
+				sources[y*width+x] = true
+				sourceList = append(sourceList, y*width+x)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return make([][3]float64, len(points))
+	}
+	if len(sourceList) == 0 {
+		return inpaintDiffusion(img, points)
+	}
+
+	// known marks the pixels whose values take part in patch distances
+	known := make([]bool, width*height)
+	for i := range known {
+		known[i] = target[i] < 0
+	}
+
+	// distance compares the patch around target pixel t with the source
+	// patch around s, over the known pixels of the target patch inside the
+	// window. It returns the mean squared difference per pixel.
+	distance := func(t, s int) float64 {
+		tx, ty := t%width, t/width
+		var sum float64
+		n := 0
+		for dy := -patchRadius; dy <= patchRadius; dy++ {
+			if ty+dy < 0 || ty+dy >= height {
+				continue
+			}
+			for dx := -patchRadius; dx <= patchRadius; dx++ {
+				if tx+dx < 0 || tx+dx >= width || !known[t+dy*width+dx] {
+					continue
+				}
+				a := values[t+dy*width+dx]
+				b := values[s+dy*width+dx]
+				for c := range a {
+					d := a[c] - b[c]
+					sum += d * d
+				}
+				n++
+			}
+		}
+		if n == 0 {
+			return math.Inf(1)
+		}
+		return sum / float64(n)
+	}
+
+	rng := rand.New(rand.NewSource(patchMatchSeed))
+	nearest := make([]int, len(targets))
+	cost := make([]float64, len(targets))
+	for k := range nearest {
+		nearest[k] = -1
+	}
+
+	// try replaces the match of target k by candidate source s if s is a
+	// valid source and closer.
+	try := func(k, s int) {
+		if s < 0 || s >= len(sources) || !sources[s] {
+			return
+		}
+		if d := distance(targets[k], s); nearest[k] < 0 || d < cost[k] {
+			nearest[k], cost[k] = s, d
+		}
+	}
+
+	// search improves the match of target k with random candidates around
+	// the current match at shrinking radii.
+	search := func(k int) {
+		sx, sy := nearest[k]%width, nearest[k]/width
+		for radius := max(width, height); radius >= 1; radius /= 2 {
+			x := sx + rng.Intn(2*radius+1) - radius
+			y := sy + rng.Intn(2*radius+1) - radius
+			if x >= 0 && x < width && y >= 0 && y < height {
+				try(k, y*width+x)
+			}
+		}
+	}
+
+	// Fill the hole layer by layer from its boundary. Matches of filled
+	// neighbors, shifted by the offset to them, are the first candidates.
+	for filled := 0; filled < len(targets); {
+		var layer []int
+		for k, t := range targets {
+			if known[t] {
+				continue
+			}
+			tx, ty := t%width, t/width
+			if (tx > 0 && known[t-1]) || (tx < width-1 && known[t+1]) ||
+				(ty > 0 && known[t-width]) || (ty < height-1 && known[t+width]) {
+				layer = append(layer, k)
+			}
+		}
+		if len(layer) == 0 {
+			break // Hole pixels cut off from every known pixel
+		}
+
+		for _, k := range layer {
+			t := targets[k]
+			tx, ty := t%width, t/width
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					x, y := tx+dx, ty+dy
+					if x < 0 || x >= width || y < 0 || y >= height {
+						continue
+					}
+					if j := target[y*width+x]; j >= 0 && nearest[j] >= 0 {
+						try(k, nearest[j]-dy*width-dx)
+					}
+				}
+			}
+			for n := 0; n < patchInitSamples; n++ {
+				try(k, sourceList[rng.Intn(len(sourceList))])
+			}
+			search(k)
+		}
+		for _, k := range layer {
+			t := targets[k]
+			values[t] = values[nearest[k]]
+			known[t] = true
+		}
+		filled += len(layer)
+	}
+	for k := range nearest {
+		if nearest[k] < 0 {
+			nearest[k] = sourceList[rng.Intn(len(sourceList))]
+		}
+	}
+
+	for round := 0; round < patchMatchRounds; round++ {
+		for k, t := range targets {
+			cost[k] = distance(t, nearest[k])
+		}
+
+		for iteration := 0; iteration < patchMatchIterations; iteration++ {
+			// Alternate the scan direction so that good matches spread
+			// both ways.
+			step := 1
+			if iteration%2 == 1 {
+				step = -1
+			}
+			for n := range targets {
+				k := n
+				if step < 0 {
+					k = len(targets) - 1 - n
+				}
+				t := targets[k]
+				tx, ty := t%width, t/width
+
+				// Propagation: a neighbor's match shifted by one pixel
+				if x := tx - step; x >= 0 && x < width {
+					if j := target[t-step]; j >= 0 {
+						try(k, nearest[j]+step)
+					}
+				}
+				if y := ty - step; y >= 0 && y < height {
+					if j := target[t-step*width]; j >= 0 {
+						try(k, nearest[j]+step*width)
+					}
+				}
+				search(k)
+			}
+		}
+
+		// Voting: every hole pixel becomes the average of the pixels that
+		// the matches of the overlapping target patches place on it.
+		sums := make([][3]float64, len(targets))
+		counts := make([]float64, len(targets))
+		for k, t := range targets {
+			tx, ty := t%width, t/width
+			for dy := -patchRadius; dy <= patchRadius; dy++ {
+				for dx := -patchRadius; dx <= patchRadius; dx++ {
+					if tx+dx < 0 || tx+dx >= width || ty+dy < 0 || ty+dy >= height {
+						continue
+					}
+					j := target[t+dy*width+dx]
+					if j < 0 {
+						continue
+					}
+					v := values[nearest[k]+dy*width+dx]
+					for c := range v {
+						sums[j][c] += v[c]
+					}
+					counts[j]++
+				}
+			}
+		}
+		for k, t := range targets {
+			for c := range sums[k] {
+				values[t][c] = sums[k][c] / counts[k]
+			}
+		}
+	}
+
+	result := make([][3]float64, len(points))
+	for k, p := range points {
+		if p.In(rect) {
+			result[k] = values[(p.Y-rect.Min.Y)*width+p.X-rect.Min.X]
+		}
+	}
+	return result
+}
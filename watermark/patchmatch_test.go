@@ -0,0 +1,112 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// createStripeImage creates vertical stripes alternating between two gray
+// levels every 4 pixels.
+func createStripeImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(60)
+			if (x/4)%2 == 1 {
+				v = 180
+			}
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []Strategy{StrategyReverse, StrategyInpaint} {
+		parsed, err := ParseStrategy(s.String())
+		if err != nil || parsed != s {
+			t.Errorf("ParseStrategy(%q) = %v, %v", s.String(), parsed, err)
+		}
+	}
+	if _, err := ParseStrategy("blur"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestInpaintPatchMatch_ContinuesTexture(t *testing.T) {
+	original := createStripeImage(120, 120)
+	var hole []image.Point
+	for y := 40; y < 80; y++ {
+		for x := 40; x < 80; x++ {
+			hole = append(hole, image.Pt(x, y))
+		}
+	}
+
+	damaged := image.NewRGBA(original.Bounds())
+	copy(damaged.Pix, original.Pix)
+	for _, p := range hole {
+		damaged.SetRGBA(p.X, p.Y, color.RGBA{R: 255, A: 255})
+	}
+
+	// Diffusion blurs the stripes away; the exemplar fill continues them
+	meanError := func(filled [][3]float64) float64 {
+		var sum float64
+		for i, p := range hole {
+			want := float64(original.RGBAAt(p.X, p.Y).R)
+			for _, v := range filled[i] {
+				sum += math.Abs(v - want)
+			}
+		}
+		return sum / float64(len(hole)*3)
+	}
+	diffused := meanError(inpaintDiffusion(damaged, hole))
+	synthesized := meanError(inpaintPatchMatch(damaged, hole, original.Bounds()))
+
+	if synthesized > 5 || synthesized >= diffused/4 {
+		t.Errorf("mean error %.2f with PatchMatch, %.2f with diffusion", synthesized, diffused)
+	}
+}
+
+func TestStrategyInpaint_RemovesWatermark(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.Strategy() != StrategyReverse {
+		t.Fatalf("expected the reverse strategy by default, got %v", engine.Strategy())
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	original := createStripeImage(width, height)
+	img := createStripeImage(width, height)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.Detect(img)
+	engine.SetStrategy(StrategyInpaint)
+	first := engine.RemoveDetected(img, detection).(*image.RGBA)
+	second := engine.RemoveDetected(img, detection).(*image.RGBA)
+
+	if err := meanRegionError(first, original, region); err > 5 {
+		t.Errorf("mean error %.2f after inpainting", err)
+	}
+	for i := range first.Pix {
+		if first.Pix[i] != second.Pix[i] {
+			t.Fatalf("byte %d differs between runs: %d and %d", i, first.Pix[i], second.Pix[i])
+		}
+	}
+
+	// Pixels outside the alpha map stay untouched
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if image.Pt(x, y).In(region) {
+				continue
+			}
+			if first.RGBAAt(x, y) != img.RGBAAt(x, y) {
+				t.Fatalf("pixel (%d,%d) outside the watermark changed", x, y)
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// Names of the built-in profiles created from the embedded reference images.
+const (
+	ProfileGemini48 = "gemini-48"
+	ProfileGemini96 = "gemini-96"
+)
+
+// SelectionRule decides for which image dimensions a profile is the expected
+// watermark. A rule matches images whose width exceeds MinWidth and whose
+// height exceeds MinHeight; the zero rule matches every image.
+//
+// When several rules match, the most specific one wins: the one with the
+// larger MinWidth, then the larger MinHeight.
+type SelectionRule struct {
+	MinWidth  int
+	MinHeight int
+}
+
+// Matches reports whether the rule applies to an image of the given size.
+func (r SelectionRule) Matches(width, height int) bool {
+	return width > r.MinWidth && height > r.MinHeight
+}
+
+// moreSpecificThan reports whether r should win over other when both match.
+func (r SelectionRule) moreSpecificThan(other SelectionRule) bool {
+	if r.MinWidth != other.MinWidth {
+		return r.MinWidth > other.MinWidth
+	}
+	return r.MinHeight > other.MinHeight
+}
+
+// Profile describes one watermark variant: its shape (alpha map), color,
+// placement and the image sizes it is expected on.
+type Profile struct {
+	// Name identifies the profile in the engine's registry and in
+	// detection results.
+	Name string
+
+	// AlphaMap holds Size*Size alpha values in row-major order, each in
+	// the range [0.0, 1.0].
+	AlphaMap []float32
+
+	// Size is the width and height of the watermark in pixels.
+	Size int
+
+	// Margin is the distance from the bottom and right image edges in pixels.
+	Margin int
+
+	// LogoColor is the color the watermark blends towards, per RGB channel
+	// in the range [0, 255]. The Gemini logo is white.
+	LogoColor [3]float64
+
+	// Rule selects the image dimensions this profile is expected on.
+	Rule SelectionRule
+
+	// AlphaThreshold and MaxAlpha are the alpha limits restorers apply:
+	// pixels whose alpha is below AlphaThreshold are left unchanged and
+	// the blend is inverted with alpha clamped to MaxAlpha. Zero values
+	// stand for the package constants of the same names. The engine passes
+	// restorers a profile holding its own limits (see WithAlphaThreshold
+	// and WithMaxAlpha), whatever the registered profile holds.
+	AlphaThreshold float64
+	MaxAlpha       float64
+}
+
+// alphaLimits returns the alpha threshold and maximum alpha of the profile,
+// with the package defaults for zero values.
+func (p Profile) alphaLimits() (threshold, maxAlpha float64) {
+	return defaultLimits(p.AlphaThreshold, p.MaxAlpha)
+}
+
+// defaultLimits replaces a zero alpha threshold or maximum alpha by the
+// package default.
+func defaultLimits(threshold, maxAlpha float64) (float64, float64) {
+	if threshold == 0 {
+		threshold = AlphaThreshold
+	}
+	if maxAlpha == 0 {
+		maxAlpha = MaxAlpha
+	}
+	return threshold, maxAlpha
+}
+
+// Config returns the size and margin of the profile.
+func (p Profile) Config() WatermarkConfig {
+	return WatermarkConfig{Size: p.Size, Margin: p.Margin}
+}
+
+// Validate checks that the profile is internally consistent and usable for
+// detection and removal.
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("profile name must not be empty")
+	}
+	if p.Size <= 0 {
+		return fmt.Errorf("profile %q: size must be positive, got %d", p.Name, p.Size)
+	}
+	if p.Margin < 0 {
+		return fmt.Errorf("profile %q: margin must not be negative, got %d", p.Name, p.Margin)
+	}
+	if len(p.AlphaMap) != p.Size*p.Size {
+		return fmt.Errorf("profile %q: alpha map has %d values, expected %d for size %d",
+			p.Name, len(p.AlphaMap), p.Size*p.Size, p.Size)
+	}
+
+	threshold, maxAlpha := p.alphaLimits()
+	var lowest, highest float32 = 1, 0
+	for i, alpha := range p.AlphaMap {
+		if alpha < 0 || alpha > 1 {
+			return fmt.Errorf("profile %q: alpha value %f at index %d outside [0, 1]", p.Name, alpha, i)
+		}
+		if alpha < lowest {
+			lowest = alpha
+		}
+		if alpha > highest {
+			highest = alpha
+		}
+	}
+	if float64(highest) < threshold || highest == lowest {
+		return fmt.Errorf("profile %q: alpha map carries no watermark shape", p.Name)
+	}
+
+	for i, v := range p.LogoColor {
+		if v < 0 || v > 255 {
+			return fmt.Errorf("profile %q: logo color channel %d value %f outside [0, 255]", p.Name, i, v)
+		}
+	}
+	if !(threshold > 0 && threshold < maxAlpha && maxAlpha < 1) {
+		return fmt.Errorf("profile %q: alpha limits %g and %g outside 0 < threshold < maximum < 1",
+			p.Name, threshold, maxAlpha)
+	}
+	if p.Rule.MinWidth < 0 || p.Rule.MinHeight < 0 {
+		return fmt.Errorf("profile %q: selection thresholds must not be negative", p.Name)
+	}
+	return nil
+}
+
+// NewProfile creates a profile with a white logo from a reference image of the
+// watermark on a black background (see CalculateAlphaMap). The reference must
+// be square; its side becomes the profile size.
+func NewProfile(name string, reference image.Image, margin int, rule SelectionRule) (Profile, error) {
+	bounds := reference.Bounds()
+	if bounds.Dx() != bounds.Dy() {
+		return Profile{}, fmt.Errorf("profile %q: reference image must be square, got %dx%d",
+			name, bounds.Dx(), bounds.Dy())
+	}
+
+	profile := Profile{
+		Name:      name,
+		AlphaMap:  CalculateAlphaMap(reference),
+		Size:      bounds.Dx(),
+		Margin:    margin,
+		LogoColor: [3]float64{LogoValue, LogoValue, LogoValue},
+		Rule:      rule,
+	}
+	return profile, profile.Validate()
+}
+
+// DefaultProfiles returns the built-in Gemini profiles, created from the
+// embedded reference images:
+//   - gemini-48: 48x48 watermark, 32px margin, for images up to 1024x1024
+//   - gemini-96: 96x96 watermark, 64px margin, when both dimensions exceed 1024
+func DefaultProfiles() ([]Profile, error) {
+	defaults := []struct {
+		name   string
+		size   int
+		margin int
+		rule   SelectionRule
+	}{
+		{ProfileGemini48, 48, 32, SelectionRule{}},
+		{ProfileGemini96, 96, 64, SelectionRule{MinWidth: 1024, MinHeight: 1024}},
+	}
+
+	profiles := make([]Profile, 0, len(defaults))
+	for _, d := range defaults {
+		reference, err := LoadReferenceImage(d.size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %dpx reference: %w", d.size, err)
+		}
+		profile, err := NewProfile(d.name, reference, d.margin, d.rule)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// RegisterProfile validates a profile and adds it to the engine's registry,
+// so that detection and removal consider it alongside the existing ones.
+// The profile's alpha map is copied, and the reverse blend of 8-bit pixels
+// is precomputed for it (see inverseTable). Registering a name twice is an
+// error.
+func (e *Engine) RegisterProfile(profile Profile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	profile.AlphaMap = append([]float32(nil), profile.AlphaMap...)
+	table := newInverseTable(&profile, e.limitAlpha)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, existing := range e.profiles {
+		if existing.Name == profile.Name {
+			return fmt.Errorf("profile %q is already registered", profile.Name)
+		}
+	}
+	e.profiles = append(e.profiles, &profile)
+	if table != nil {
+		if e.inverse == nil {
+			e.inverse = make(map[*Profile]*inverseTable)
+		}
+		e.inverse[&profile] = table
+	}
+	return nil
+}
+
+// Profiles returns the registered profiles in registration order.
+func (e *Engine) Profiles() []Profile {
+	profiles := e.registered()
+	result := make([]Profile, len(profiles))
+	for i, p := range profiles {
+		result[i] = *p
+		result[i].AlphaMap = append([]float32(nil), p.AlphaMap...)
+	}
+	return result
+}
+
+// Profile returns the registered profile with the given name.
+func (e *Engine) Profile(name string) (Profile, bool) {
+	for _, p := range e.registered() {
+		if p.Name == name {
+			profile := *p
+			profile.AlphaMap = append([]float32(nil), p.AlphaMap...)
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// registered returns a snapshot of the registry. Registered profiles are
+// never modified, so the snapshot can be used without holding the lock.
+func (e *Engine) registered() []*Profile {
+	return e.appendRegistered(nil)
+}
+
+// appendRegistered appends the registered profiles to dst.
+func (e *Engine) appendRegistered(dst []*Profile) []*Profile {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append(dst, e.profiles...)
+}
+
+// expectedProfile returns the profile whose selection rule matches the image
+// dimensions most specifically, or the first profile if none matches.
+func expectedProfile(profiles []*Profile, width, height int) *Profile {
+	var expected *Profile
+	for _, p := range profiles {
+		if !p.Rule.Matches(width, height) {
+			continue
+		}
+		if expected == nil || p.Rule.moreSpecificThan(expected.Rule) {
+			expected = p
+		}
+	}
+	if expected == nil && len(profiles) > 0 {
+		expected = profiles[0]
+	}
+	return expected
+}
+
+// profileFor returns the profile a detection refers to. Detections built by
+// hand may omit the profile name, in which case the first profile with the
+// same size and margin is used.
+func (e *Engine) profileFor(detection Detection) *Profile {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, p := range e.profiles {
+		if detection.Profile != "" && p.Name == detection.Profile {
+			return p
+		}
+	}
+	for _, p := range e.profiles {
+		if detection.Profile == "" && p.Config() == detection.Config {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// profileByConfig returns the first registered profile with the given size
+// and margin, or nil.
+func (e *Engine) profileByConfig(config WatermarkConfig) *Profile {
+	return e.profileFor(Detection{Config: config})
+}
+
+// testProfile returns a valid 64px profile with a warm-tinted logo, derived
+// from the 48px Gemini alpha map.
+func testProfile(t *testing.T, engine *Engine) Profile {
+	t.Helper()
+	base, ok := engine.Profile(ProfileGemini48)
+	if !ok {
+		t.Fatalf("profile %q not registered", ProfileGemini48)
+	}
+	alphaMap, size := resampleAlphaMap(base.AlphaMap, base.Size, 64.0/48.0, 0, 0)
+	return Profile{
+		Name:      "warm-64",
+		AlphaMap:  alphaMap,
+		Size:      size,
+		Margin:    40,
+		LogoColor: [3]float64{255, 230, 160},
+	}
+}
+
+func TestDefaultProfiles(t *testing.T) {
+	profiles, err := DefaultProfiles()
+	if err != nil {
+		t.Fatalf("DefaultProfiles() error: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 default profiles, got %d", len(profiles))
+	}
+
+	// The default selection rules must reproduce DetectConfig
+	testCases := []struct {
+		width, height int
+	}{
+		{800, 600},
+		{1024, 1024},
+		{1025, 1025},
+		{1920, 1080},
+		{2048, 2048},
+	}
+	ptrs := []*Profile{&profiles[0], &profiles[1]}
+	for _, tc := range testCases {
+		expected := DetectConfig(tc.width, tc.height)
+		if got := expectedProfile(ptrs, tc.width, tc.height).Config(); got != expected {
+			t.Errorf("dimensions %dx%d: expected %v, got %v", tc.width, tc.height, expected, got)
+		}
+	}
+}
+
+func TestProfile_Validate(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	valid := testProfile(t, engine)
+	faint := make([]float32, valid.Size*valid.Size)
+	faint[0] = 0.001
+
+	testCases := []struct {
+		name   string
+		modify func(p *Profile)
+		errMsg string
+	}{
+		{"valid", func(p *Profile) {}, ""},
+		{"empty name", func(p *Profile) { p.Name = "" }, "name"},
+		{"zero size", func(p *Profile) { p.Size = 0 }, "size"},
+		{"negative margin", func(p *Profile) { p.Margin = -1 }, "margin"},
+		{"wrong map length", func(p *Profile) { p.AlphaMap = p.AlphaMap[1:] }, "alpha map"},
+		{"alpha out of range", func(p *Profile) {
+			p.AlphaMap = append([]float32(nil), p.AlphaMap...)
+			p.AlphaMap[0] = 1.5
+		}, "outside [0, 1]"},
+		{"flat alpha map", func(p *Profile) { p.AlphaMap = make([]float32, p.Size*p.Size) }, "no watermark shape"},
+		{"logo out of range", func(p *Profile) { p.LogoColor[1] = 300 }, "logo color"},
+		{"negative rule", func(p *Profile) { p.Rule.MinWidth = -1 }, "selection"},
+		{"custom alpha limits", func(p *Profile) { p.AlphaThreshold, p.MaxAlpha = 0.001, 0.999 }, ""},
+		{"faint alpha map", func(p *Profile) { p.AlphaMap = faint }, "no watermark shape"},
+		{"faint alpha map below own threshold", func(p *Profile) {
+			p.AlphaMap, p.AlphaThreshold = faint, 0.0005
+		}, ""},
+		{"negative threshold", func(p *Profile) { p.AlphaThreshold = -0.1 }, "alpha limits"},
+		{"opaque maximum", func(p *Profile) { p.MaxAlpha = 1 }, "alpha limits"},
+		{"threshold above maximum", func(p *Profile) { p.AlphaThreshold, p.MaxAlpha = 0.5, 0.4 }, "alpha limits"},
+	}
+
+	for _, tc := range testCases {
+		profile := valid
+		tc.modify(&profile)
+		err := profile.Validate()
+		if tc.errMsg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.errMsg, err)
+		}
+	}
+}
+
+func TestNewProfile_RejectsNonSquareReference(t *testing.T) {
+	reference := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	if _, err := NewProfile("wide", reference, 32, SelectionRule{}); err == nil {
+		t.Error("expected error for non-square reference")
+	}
+}
+
+func TestRegisterProfile_RejectsDuplicateName(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	profile, _ := engine.Profile(ProfileGemini48)
+	if err := engine.RegisterProfile(profile); err == nil {
+		t.Error("expected error when registering a duplicate profile name")
+	}
+	if got := len(engine.Profiles()); got != 2 {
+		t.Errorf("expected 2 registered profiles, got %d", got)
+	}
+}
+
+func TestRegisterProfile_CopiesAlphaMap(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	profile := testProfile(t, engine)
+	if err := engine.RegisterProfile(profile); err != nil {
+		t.Fatalf("RegisterProfile() error: %v", err)
+	}
+	profile.AlphaMap[0] = 0.75
+
+	registered, ok := engine.Profile(profile.Name)
+	if !ok {
+		t.Fatalf("profile %q not registered", profile.Name)
+	}
+	if registered.AlphaMap[0] == 0.75 {
+		t.Error("registered alpha map changed with the caller's slice")
+	}
+}
+
+func TestRegisterProfile_DetectsAndRemovesCustomProfile(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	profile := testProfile(t, engine)
+	if err := engine.RegisterProfile(profile); err != nil {
+		t.Fatalf("RegisterProfile() error: %v", err)
+	}
+
+	width, height := 800, 600
+	region := CalculatePosition(width, height, profile.Config())
+	original := createNoiseImage(width, height, 11)
+	img := createNoiseImage(width, height, 11)
+
+	// Blend the tinted logo
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			alpha := float64(profile.AlphaMap[(y-region.Min.Y)*profile.Size+(x-region.Min.X)])
+			c := img.RGBAAt(x, y)
+			blend := func(v uint8, logo float64) uint8 {
+				return uint8(alpha*logo + (1-alpha)*float64(v) + 0.5)
+			}
+			img.SetRGBA(x, y, color.RGBA{
+				R: blend(c.R, profile.LogoColor[0]),
+				G: blend(c.G, profile.LogoColor[1]),
+				B: blend(c.B, profile.LogoColor[2]),
+				A: c.A,
+			})
+		}
+	}
+
+	detection := engine.Detect(img)
+	if !detection.Detected || detection.Profile != profile.Name {
+		t.Fatalf("expected detection of profile %q, got %q (confidence %.3f)",
+			profile.Name, detection.Profile, detection.Confidence)
+	}
+	if detection.Selection != SelectedByContent {
+		t.Errorf("expected selection by content, got %v", detection.Selection)
+	}
+	if len(detection.Scores) != 3 {
+		t.Errorf("expected 3 candidate scores, got %d", len(detection.Scores))
+	}
+
+	result := engine.RemoveDetected(img, detection)
+	const tolerance = 3
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			r, g, b, _ := result.At(x, y).RGBA()
+			want := original.RGBAAt(x, y)
+			if absDiff(uint8(r>>8), want.R) > tolerance ||
+				absDiff(uint8(g>>8), want.G) > tolerance ||
+				absDiff(uint8(b>>8), want.B) > tolerance {
+				t.Fatalf("pixel (%d,%d): got (%d,%d,%d), expected (%d,%d,%d)",
+					x, y, r>>8, g>>8, b>>8, want.R, want.G, want.B)
+			}
+		}
+	}
+}
+
+func TestExpectedProfile_MostSpecificRuleWins(t *testing.T) {
+	profiles := []*Profile{
+		{Name: "any"},
+		{Name: "wide", Rule: SelectionRule{MinWidth: 1024}},
+		{Name: "large", Rule: SelectionRule{MinWidth: 1024, MinHeight: 1024}},
+		{Name: "huge", Rule: SelectionRule{MinWidth: 2048, MinHeight: 2048}},
+	}
+
+	testCases := []struct {
+		width, height int
+		expected      string
+	}{
+		{800, 600, "any"},
+		{1920, 600, "wide"},
+		{1920, 1080, "large"},
+		{4096, 4096, "huge"},
+	}
+
+	for _, tc := range testCases {
+		if got := expectedProfile(profiles, tc.width, tc.height).Name; got != tc.expected {
+			t.Errorf("dimensions %dx%d: expected profile %q, got %q", tc.width, tc.height, tc.expected, got)
+		}
+	}
+
+	// Without a matching rule the first profile is used
+	if got := expectedProfile(profiles[3:], 800, 600).Name; got != "huge" {
+		t.Errorf("expected fallback to first profile, got %q", got)
+	}
+	if expectedProfile(nil, 800, 600) != nil {
+		t.Error("expected nil for an empty registry")
+	}
+}
+
+func TestRemoveDetected_UnknownProfile(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	img := createNoiseImage(800, 600, 3)
+	detection := Detection{Profile: "missing", Region: image.Rect(720, 520, 768, 568)}
+	result := engine.RemoveDetected(img, detection)
+	for y := 520; y < 568; y++ {
+		for x := 720; x < 768; x++ {
+			if result.At(x, y) != img.At(x, y) {
+				t.Fatalf("pixel (%d,%d) changed for an unknown profile", x, y)
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package watermark
+
+// raceEnabled reports whether the race detector is on, which makes
+// sync.Pool drop items at random and so defeats allocation tests.
+const raceEnabled = true
@@ -0,0 +1,109 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// addNoise adds uniform noise of up to +/- amplitude levels to every channel
+// of img inside region, as left by lossy compression.
+func addNoise(img *image.RGBA, region image.Rectangle, amplitude int, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			noise := func(v uint8) uint8 {
+				return uint8(clamp(float64(v)+float64(rng.Intn(2*amplitude+1)-amplitude), 0, 255))
+			}
+			img.SetRGBA(x, y, color.RGBA{R: noise(c.R), G: noise(c.G), B: noise(c.B), A: c.A})
+		}
+	}
+}
+
+func TestRegularizedBlend_SuppressesAmplifiedNoise(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+	if engine.Regularization() != 0 {
+		t.Fatalf("expected exact inversion by default, got strength %g", engine.Regularization())
+	}
+	profile := strongProfile(t, engine)
+	if err := engine.RegisterProfile(profile); err != nil {
+		t.Fatalf("RegisterProfile() error: %v", err)
+	}
+
+	width, height := 800, 600
+	region := CalculatePosition(width, height, profile.Config())
+	original := createRampImage(width, height)
+	img := createRampImage(width, height)
+	applyWatermark(img, region, profile.AlphaMap)
+	addNoise(img, region, 3, 5)
+
+	detection := Detection{Profile: profile.Name, Config: profile.Config(), Region: region, Scale: 1}
+	exact := meanRegionError(engine.RemoveDetected(img, detection), original, region)
+
+	// Stronger regularization removes more of the amplified noise on a
+	// smooth background
+	previous := exact
+	for _, strength := range []float64{0.05, 0.2, 1} {
+		engine.SetRegularization(strength)
+		regularized := meanRegionError(engine.RemoveDetected(img, detection), original, region)
+		if regularized >= previous {
+			t.Errorf("strength %g: mean error %.3f, expected below %.3f", strength, regularized, previous)
+		}
+		previous = regularized
+	}
+	if previous >= exact*0.5 {
+		t.Errorf("expected strong regularization to halve the error: %.3f, exact %.3f", previous, exact)
+	}
+}
+
+func TestRegularizedBlend_KeepsTexture(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// On a noise-free textured image, mild regularization stays close to
+	// the exact inversion
+	width, height := 800, 600
+	config, region := GetWatermarkInfo(width, height)
+	original := createNoiseImage(width, height, 12)
+	img := createNoiseImage(width, height, 12)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.Detect(img)
+	engine.SetRegularization(0.02)
+	if err := meanRegionError(engine.RemoveDetected(img, detection), original, region); err > 2 {
+		t.Errorf("mean error %.3f with mild regularization", err)
+	}
+}
+
+func TestRegularizedBlend_ZeroStrengthIsExact(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	img := createNoiseImage(width, height, 6)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+	profile := *engine.profileByConfig(config)
+
+	exact := ReverseBlend{}.Restore(img, region, profile.AlphaMap, profile)
+	regularized := RegularizedBlend{}.Restore(img, region, profile.AlphaMap, profile)
+	for i := range exact.Pixels {
+		if exact.Pixels[i] != regularized.Pixels[i] {
+			t.Fatalf("pixel %d: %v exact, %v regularized", i, exact.Pixels[i], regularized.Pixels[i])
+		}
+	}
+
+	engine.SetRegularization(-1)
+	if engine.Regularization() != 0 {
+		t.Errorf("expected negative strength to be treated as 0, got %g", engine.Regularization())
+	}
+}
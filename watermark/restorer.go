@@ -0,0 +1,264 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+)
+
+// Restorer computes the original pixels under a watermark. Implementations
+// let callers replace or combine the removal algorithms of the engine (see
+// Engine.SetRestorer).
+//
+// Restore receives the image (with any watermarks removed earlier by the same
+// call to RemoveAll already restored), the square region covered by the
+// watermark, its alpha map (region.Dx() * region.Dy() opacities, row by row,
+// already resampled, shifted and scaled by a fitted gain) and the profile of
+// the watermark (with a fitted logo color, if any). The alpha map passed to
+// Restore takes precedence over profile.AlphaMap. Restore may read pixels
+// outside region for context but must not modify img. Colors of
+// semi-transparent pixels are to be restored unpremultiplied: the watermark
+// was blended with their straight color, and the engine premultiplies the
+// results again where the image stores premultiplied colors.
+//
+// The engine replaces the pixels of region inside the image bounds whose
+// alpha is at least profile.AlphaThreshold, which holds the engine's
+// threshold, with the returned values; the others are left unchanged.
+// Implementations must be safe for concurrent use.
+type Restorer interface {
+	Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration
+}
+
+// RestorerFunc adapts an ordinary function to the Restorer interface.
+type RestorerFunc func(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration
+
+// Restore calls f(img, region, alphaMap, profile).
+func (f RestorerFunc) Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+	return f(img, region, alphaMap, profile)
+}
+
+// Restoration holds the pixels a Restorer computed for a watermark region.
+type Restoration struct {
+	// Pixels holds one straight (non-premultiplied) RGB value per alpha
+	// map entry, row by row, on the 0-255 scale. The engine clamps the
+	// values to [0, 255] and truncates them to 8 bits, or rounds them to
+	// 16 bits for 16-bit images.
+	Pixels [][3]float64
+
+	// Confidence optionally holds per pixel how far the value can be
+	// trusted, in [0.0, 1.0]. Hybrid replaces pixels with a confidence
+	// below 1. A nil slice means every pixel is fully trusted.
+	Confidence []float64
+}
+
+// confidence returns the confidence of pixel i.
+func (r Restoration) confidence(i int) float64 {
+	if r.Confidence == nil {
+		return 1
+	}
+	return r.Confidence[i]
+}
+
+// ReverseBlend is the default Restorer. It inverts the alpha blend exactly:
+//
+//	original = (watermarked - alpha * logo) / (1 - alpha)
+//
+// with alpha clamped to profile.MaxAlpha. Its confidence (see
+// blendConfidence) drops where the inversion amplifies noise strongly, where
+// alpha had to be clamped and where the input is saturated or the result
+// out of range.
+type ReverseBlend struct{}
+
+// Restore implements Restorer.
+func (ReverseBlend) Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+	bounds := img.Bounds()
+	size := region.Dx()
+	logo := profile.LogoColor
+	threshold, maxAlpha := profile.alphaLimits()
+	restoration := Restoration{
+		Pixels:     make([][3]float64, len(alphaMap)),
+		Confidence: make([]float64, len(alphaMap)),
+	}
+
+	// Process each pixel in the watermark region.
+	// Apply the reverse alpha blending formula to recover original colors.
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			i := row*size + col
+			restoration.Confidence[i] = 1
+
+			// Skip pixels outside image bounds (edge cases)
+			imgX := region.Min.X + col
+			imgY := region.Min.Y + row
+			if !image.Pt(imgX, imgY).In(bounds) {
+				continue
+			}
+
+			// Skip nearly-transparent pixels (no watermark effect here)
+			alpha := alphaMap[i]
+			if float64(alpha) < threshold {
+				continue
+			}
+
+			// Get the current (watermarked) pixel values on the 0-255
+			// scale, keeping the precision of 16-bit images.
+			watermarked := rgbAt(img, imgX, imgY)
+			original := reverseBlend(watermarked, min(alpha, float32(maxAlpha)), logo)
+			restoration.Pixels[i] = original
+			restoration.Confidence[i] = blendConfidence(float64(alpha), maxAlpha, watermarked, original)
+		}
+	}
+	return restoration
+}
+
+// reverseBlend applies the reverse alpha blending formula to a watermarked
+// straight color:
+//
+//	original = (watermarked - alpha * logo) / (1 - alpha)
+//
+// This inverts the formula Gemini used to apply the watermark:
+//
+//	watermarked = alpha * logo + (1 - alpha) * original
+//
+// Callers clamp alpha to a maximum alpha first to prevent division by
+// values too close to zero: when alpha approaches 1.0, (1 - alpha)
+// approaches 0, causing numerical instability in the division.
+func reverseBlend(watermarked [3]float64, alpha float32, logo [3]float64) [3]float64 {
+	alphaF := float64(alpha)
+	oneMinusAlpha := 1.0 - alphaF
+
+	var original [3]float64
+	for c := range original {
+		original[c] = (watermarked[c] - alphaF*logo[c]) / oneMinusAlpha
+	}
+	return original
+}
+
+// Hybrid picks per pixel between two restorers: pixels the Primary restorer
+// restores with full confidence keep its result, the others are restored
+// by the Fallback restorer and blended with the Primary result according to
+// its confidence (a confidence of 0 uses the Fallback result alone).
+//
+// The Fallback restorer sees a copy of the image within one watermark size
+// around the region, with the trusted Primary results already in place, and
+// an alpha map that is zero everywhere else, so that inpainting restorers
+// fill only the untrusted pixels, from restored neighbors.
+type Hybrid struct {
+	Primary  Restorer
+	Fallback Restorer
+}
+
+// Restore implements Restorer.
+func (h Hybrid) Restore(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+	primary := h.Primary.Restore(img, region, alphaMap, profile)
+	bounds := img.Bounds()
+	size := region.Dx()
+	threshold, _ := profile.alphaLimits()
+
+	// Untrusted pixels keep their alpha; everything else is masked out
+	masked := make([]float32, len(alphaMap))
+	pending := false
+	for i, alpha := range alphaMap {
+		p := image.Pt(region.Min.X+i%size, region.Min.Y+i/size)
+		if float64(alpha) >= threshold && p.In(bounds) && primary.confidence(i) < 1 {
+			masked[i] = alpha
+			pending = true
+		}
+	}
+	if !pending {
+		return primary
+	}
+
+	// Put the trusted pixels in place on a copy of the watermark's
+	// surroundings
+	working := newResultImage(cropImage(img, contextRect(region, bounds)))
+	for i, alpha := range alphaMap {
+		p := image.Pt(region.Min.X+i%size, region.Min.Y+i/size)
+		if float64(alpha) < threshold || masked[i] != 0 || !p.In(bounds) {
+			continue
+		}
+		setRestored(working, p.X, p.Y, primary.Pixels[i])
+	}
+
+	fallback := h.Fallback.Restore(working, region, masked, profile)
+	checkRestoration(fallback, masked)
+
+	restoration := Restoration{
+		Pixels:     make([][3]float64, len(alphaMap)),
+		Confidence: make([]float64, len(alphaMap)),
+	}
+	for i := range alphaMap {
+		if masked[i] == 0 {
+			restoration.Pixels[i] = primary.Pixels[i]
+			restoration.Confidence[i] = primary.confidence(i)
+			continue
+		}
+		w := primary.confidence(i)
+		for c := range restoration.Pixels[i] {
+			blended := w*clamp(primary.Pixels[i][c], 0, 255) + (1-w)*fallback.Pixels[i][c]
+			restoration.Pixels[i][c] = roundLevel(blended, img)
+		}
+		restoration.Confidence[i] = w + (1-w)*fallback.confidence(i)
+	}
+	return restoration
+}
+
+// SetRestorer replaces the restoration algorithm used by RemoveWatermark,
+// RemoveDetected and RemoveAll. Passing nil returns to the restorer
+// selected by SetStrategy, SetRegularization and SetInpaintFallback.
+func (e *Engine) SetRestorer(restorer Restorer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.restorer = restorer
+}
+
+// Restorer returns the restorer in use: the one set by SetRestorer, or
+// otherwise PatchMatchInpaint for StrategyInpaint, and for StrategyReverse
+// ReverseBlend (RegularizedBlend if a regularization strength is set),
+// within a Hybrid with DiffusionInpaint as fallback if the inpainting
+// fallback is enabled.
+func (e *Engine) Restorer() Restorer {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.restorer != nil {
+		return e.restorer
+	}
+	if e.strategy == StrategyInpaint {
+		return PatchMatchInpaint{}
+	}
+
+	var inversion Restorer = ReverseBlend{}
+	if e.regularization > 0 {
+		inversion = RegularizedBlend{Strength: e.regularization}
+	}
+	if e.inpaintFallback {
+		return Hybrid{Primary: inversion, Fallback: DiffusionInpaint{}}
+	}
+	return inversion
+}
+
+// checkRestoration panics if a restorer returned a restoration that does
+// not match the alpha map, which is a programming error in the restorer.
+func checkRestoration(restoration Restoration, alphaMap []float32) {
+	if len(restoration.Pixels) != len(alphaMap) {
+		panic(fmt.Sprintf("watermark: restorer returned %d pixels for an alpha map of %d", len(restoration.Pixels), len(alphaMap)))
+	}
+	if restoration.Confidence != nil && len(restoration.Confidence) != len(alphaMap) {
+		panic(fmt.Sprintf("watermark: restorer returned %d confidences for an alpha map of %d", len(restoration.Confidence), len(alphaMap)))
+	}
+}
+
+// holePixels returns the pixels of region inside the image bounds whose
+// alpha is at least the threshold, with their index in the alpha map.
+func holePixels(bounds, region image.Rectangle, alphaMap []float32, threshold float64) ([]image.Point, []int) {
+	size := region.Dx()
+	var points []image.Point
+	var indices []int
+	for i, alpha := range alphaMap {
+		p := image.Pt(region.Min.X+i%size, region.Min.Y+i/size)
+		if float64(alpha) >= threshold && p.In(bounds) {
+			points = append(points, p)
+			indices = append(indices, i)
+		}
+	}
+	return points, indices
+}
@@ -0,0 +1,166 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// constantRestorer returns a restorer that restores every pixel to v with
+// the given confidence.
+func constantRestorer(v float64, confidence func(i int) float64) Restorer {
+	return RestorerFunc(func(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+		restoration := Restoration{
+			Pixels:     make([][3]float64, len(alphaMap)),
+			Confidence: make([]float64, len(alphaMap)),
+		}
+		for i := range alphaMap {
+			restoration.Pixels[i] = [3]float64{v, v, v}
+			restoration.Confidence[i] = confidence(i)
+		}
+		return restoration
+	})
+}
+
+func TestEngine_RestorerSelection(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	testCases := []struct {
+		strategy       Strategy
+		fallback       bool
+		regularization float64
+		expected       Restorer
+	}{
+		{StrategyReverse, false, 0, ReverseBlend{}},
+		{StrategyReverse, true, 0, Hybrid{Primary: ReverseBlend{}, Fallback: DiffusionInpaint{}}},
+		{StrategyReverse, false, 0.1, RegularizedBlend{Strength: 0.1}},
+		{StrategyReverse, true, 0.1, Hybrid{Primary: RegularizedBlend{Strength: 0.1}, Fallback: DiffusionInpaint{}}},
+		{StrategyInpaint, false, 0, PatchMatchInpaint{}},
+		{StrategyInpaint, true, 0.1, PatchMatchInpaint{}},
+	}
+
+	for _, tc := range testCases {
+		engine.SetStrategy(tc.strategy)
+		engine.SetInpaintFallback(tc.fallback)
+		engine.SetRegularization(tc.regularization)
+		if got := engine.Restorer(); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v, fallback %v, regularization %g: expected %T, got %#v",
+				tc.strategy, tc.fallback, tc.regularization, tc.expected, got)
+		}
+	}
+
+	custom := Hybrid{Primary: PatchMatchInpaint{}, Fallback: DiffusionInpaint{}}
+	engine.SetRestorer(custom)
+	if got := engine.Restorer(); !reflect.DeepEqual(got, custom) {
+		t.Errorf("expected the custom restorer, got %#v", got)
+	}
+	engine.SetRestorer(nil)
+	if _, ok := engine.Restorer().(PatchMatchInpaint); !ok {
+		t.Errorf("expected the strategy's restorer after SetRestorer(nil), got %#v", engine.Restorer())
+	}
+}
+
+func TestEngine_CustomRestorer(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	alphaMap := engine.profileByConfig(config).AlphaMap
+	img := createNoiseImage(width, height, 8)
+	applyWatermark(img, region, alphaMap)
+
+	var received Profile
+	engine.SetRestorer(RestorerFunc(func(img image.Image, r image.Rectangle, a []float32, profile Profile) Restoration {
+		received = profile
+		if r != region || len(a) != len(alphaMap) {
+			t.Errorf("restorer called with region %v and %d alpha values", r, len(a))
+		}
+		return constantRestorer(300, func(int) float64 { return 1 }).Restore(img, r, a, profile)
+	}))
+
+	detection := engine.Detect(img)
+	result := engine.RemoveDetected(img, detection).(*image.RGBA)
+	if received.Name != detection.Profile {
+		t.Errorf("expected profile %s, got %s", detection.Profile, received.Name)
+	}
+
+	// Covered pixels take the (clamped) restored value, the others are kept
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			alpha := alphaMap[(y-region.Min.Y)*region.Dx()+x-region.Min.X]
+			got := result.RGBAAt(x, y)
+			if alpha >= AlphaThreshold && got != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+				t.Fatalf("pixel (%d,%d) with alpha %.3f: got %v", x, y, alpha, got)
+			}
+			if alpha < AlphaThreshold && got != img.RGBAAt(x, y) {
+				t.Fatalf("pixel (%d,%d) with alpha %.3f changed", x, y, alpha)
+			}
+		}
+	}
+}
+
+func TestHybrid_PicksPerPixel(t *testing.T) {
+	size := 8
+	img := createTestImage(32, 32, color.RGBA{R: 100, G: 100, B: 100, A: 255})
+	region := image.Rect(12, 12, 12+size, 12+size)
+	alphaMap := make([]float32, size*size)
+	for i := range alphaMap {
+		alphaMap[i] = 0.5
+	}
+
+	// The primary restorer trusts the left half, is unsure about one column
+	// and distrusts the rest
+	confidence := func(i int) float64 {
+		switch col := i % size; {
+		case col < size/2:
+			return 1
+		case col == size/2:
+			return 0.25
+		}
+		return 0
+	}
+
+	var maskedAlpha []float32
+	var seen *image.RGBA
+	fallback := RestorerFunc(func(img image.Image, region image.Rectangle, alphaMap []float32, profile Profile) Restoration {
+		maskedAlpha = alphaMap
+		seen = img.(*image.RGBA)
+		return constantRestorer(200, func(int) float64 { return 1 }).Restore(img, region, alphaMap, profile)
+	})
+
+	hybrid := Hybrid{Primary: constantRestorer(40, confidence), Fallback: fallback}
+	restoration := hybrid.Restore(img, region, alphaMap, Profile{})
+
+	for i, v := range restoration.Pixels {
+		var want float64
+		switch c := confidence(i); c {
+		case 1:
+			want = 40
+			if maskedAlpha[i] != 0 {
+				t.Errorf("pixel %d: trusted pixel passed to the fallback", i)
+			}
+			p := image.Pt(region.Min.X+i%size, region.Min.Y+i/size)
+			if seen.RGBAAt(p.X, p.Y).R != 40 {
+				t.Errorf("pixel %d: fallback did not see the trusted result", i)
+			}
+		default:
+			want = c*40 + (1-c)*200
+			if maskedAlpha[i] != 0.5 {
+				t.Errorf("pixel %d: expected alpha 0.5 for the fallback, got %.2f", i, maskedAlpha[i])
+			}
+		}
+		if v[0] != want {
+			t.Errorf("pixel %d: expected %.0f, got %.2f", i, want, v[0])
+		}
+	}
+	if img.RGBAAt(region.Min.X, region.Min.Y).R != 100 {
+		t.Error("Hybrid modified the input image")
+	}
+}
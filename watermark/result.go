@@ -0,0 +1,156 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+)
+
+// newResultImage returns a copy of img to restore into. Images of the
+// standard in-memory types keep their type, and with it their color model,
+// alpha kind and depth: *image.RGBA, *image.NRGBA, *image.RGBA64,
+// *image.NRGBA64, *image.Gray, *image.Gray16 and *image.Paletted (with the
+// same palette). Other images are converted to an *image.NRGBA64 or
+// *image.RGBA64 if they have more than 8 bits per channel, to an
+// *image.NRGBA if they use straight alpha and to an *image.RGBA otherwise.
+func newResultImage(img image.Image) draw.Image {
+	switch src := img.(type) {
+	case *image.RGBA:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 4)
+		return &image.RGBA{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.NRGBA:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 4)
+		return &image.NRGBA{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.RGBA64:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 8)
+		return &image.RGBA64{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.NRGBA64:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 8)
+		return &image.NRGBA64{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.Gray:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 1)
+		return &image.Gray{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.Gray16:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 2)
+		return &image.Gray16{Pix: pix, Stride: stride, Rect: src.Rect}
+	case *image.Paletted:
+		pix, stride := clonePix(src.Pix, src.Stride, src.Rect, 1)
+		return &image.Paletted{Pix: pix, Stride: stride, Rect: src.Rect, Palette: slices.Clone(src.Palette)}
+	}
+
+	bounds := img.Bounds()
+	var result draw.Image
+	switch model := img.ColorModel(); {
+	case model == color.NRGBA64Model:
+		result = image.NewNRGBA64(bounds)
+	case highDepth(img):
+		result = image.NewRGBA64(bounds)
+	case model == color.NRGBAModel:
+		result = image.NewNRGBA(bounds)
+	default:
+		result = image.NewRGBA(bounds)
+	}
+	draw.Draw(result, bounds, img, bounds.Min, draw.Src)
+	return result
+}
+
+// restorable reports whether img is of one of the types newResultImage
+// keeps, which are the types setRestored can write to.
+func restorable(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64, *image.Gray, *image.Gray16, *image.Paletted:
+		return true
+	}
+	return false
+}
+
+// clonePix returns a copy of the pixels of rect held in the pixel buffer
+// pix of a standard image type, whose rows are stride bytes apart, with
+// size bytes per pixel. The copy holds only the pixels of rect, without the
+// rest of the rows of a parent image, and its rows are packed; clonePix
+// returns its stride.
+func clonePix(pix []uint8, stride int, rect image.Rectangle, size int) ([]uint8, int) {
+	width := rect.Dx() * size
+	if rect.Empty() {
+		return nil, width
+	}
+	cloned := make([]uint8, width*rect.Dy())
+	copyRows(cloned, width, pix, stride, width, rect.Dy())
+	return cloned, width
+}
+
+// copyRows copies rows of width bytes between two pixel buffers with the
+// given strides, both starting at the first pixel to copy.
+func copyRows(dst []uint8, dstStride int, src []uint8, srcStride int, width, rows int) {
+	for y := 0; y < rows; y++ {
+		copy(dst[y*dstStride:y*dstStride+width], src[y*srcStride:y*srcStride+width])
+	}
+}
+
+// setRestored replaces the color of the pixel at (x, y) of an image created
+// by newResultImage with a restored straight color, keeping its alpha.
+// Values are clamped to [0, 255], premultiplied by alpha for premultiplied
+// images, then truncated to 8 bits or rounded to 16 bits. Grayscale images
+// store the luma of the color and paletted images the nearest palette
+// color. Fully transparent pixels, and images of other types (see
+// restorable), are left unchanged.
+func setRestored(img draw.Image, x, y int, v [3]float64) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		a := img.RGBAAt(x, y).A
+		if a == 0 {
+			return
+		}
+		scale := 1.0
+		if a != 0xFF {
+			scale = float64(a) / 0xFF
+		}
+		premultiply := func(v float64) uint8 {
+			return uint8(clamp(v, 0, 255) * scale)
+		}
+		img.SetRGBA(x, y, color.RGBA{R: premultiply(v[0]), G: premultiply(v[1]), B: premultiply(v[2]), A: a})
+	case *image.NRGBA:
+		if a := img.NRGBAAt(x, y).A; a != 0 {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(clamp(v[0], 0, 255)),
+				G: uint8(clamp(v[1], 0, 255)),
+				B: uint8(clamp(v[2], 0, 255)),
+				A: a,
+			})
+		}
+	case *image.RGBA64:
+		a := img.RGBA64At(x, y).A
+		if a == 0 {
+			return
+		}
+		scale := 1.0
+		if a != 0xFFFF {
+			scale = float64(a) / 0xFFFF
+		}
+		premultiply := func(v float64) uint16 {
+			return to16(clamp(v, 0, 255) * scale)
+		}
+		img.SetRGBA64(x, y, color.RGBA64{R: premultiply(v[0]), G: premultiply(v[1]), B: premultiply(v[2]), A: a})
+	case *image.NRGBA64:
+		if a := img.NRGBA64At(x, y).A; a != 0 {
+			img.SetNRGBA64(x, y, color.NRGBA64{R: to16(v[0]), G: to16(v[1]), B: to16(v[2]), A: a})
+		}
+	case *image.Gray:
+		img.SetGray(x, y, color.Gray{Y: uint8(clamp(luma(v), 0, 255))})
+	case *image.Gray16:
+		img.SetGray16(x, y, color.Gray16{Y: to16(luma(v))})
+	case *image.Paletted:
+		_, _, _, a := img.Palette[img.ColorIndexAt(x, y)].RGBA()
+		if a != 0 {
+			c := color.NRGBA64{R: to16(v[0]), G: to16(v[1]), B: to16(v[2]), A: uint16(a)}
+			img.SetColorIndex(x, y, uint8(img.Palette.Index(c)))
+		}
+	}
+}
+
+// luma returns the luma of an RGB color on the 0-255 scale, with the weights
+// of color.GrayModel.
+func luma(v [3]float64) float64 {
+	return (19595*v[0] + 38470*v[1] + 7471*v[2]) / 65536
+}
@@ -0,0 +1,101 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestRemoveAll_KeepsNativeType(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 400, 300
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+	original := createColorGradient(width, height)
+	watermarked := createColorGradient(width, height)
+	applyWatermark(watermarked, region, profile.AlphaMap)
+
+	testCases := []struct {
+		name     string
+		convert  func(img image.Image) image.Image
+		maxError float64
+	}{
+		{"gray", func(img image.Image) image.Image {
+			gray := image.NewGray(img.Bounds())
+			draw.Draw(gray, gray.Bounds(), img, image.Point{}, draw.Src)
+			return gray
+		}, 1.5},
+		{"gray16", func(img image.Image) image.Image {
+			gray := image.NewGray16(img.Bounds())
+			draw.Draw(gray, gray.Bounds(), img, image.Point{}, draw.Src)
+			return gray
+		}, 1.5},
+		{"paletted", func(img image.Image) image.Image {
+			paletted := image.NewPaletted(img.Bounds(), palette.WebSafe)
+			draw.Draw(paletted, paletted.Bounds(), img, image.Point{}, draw.Src)
+			return paletted
+		}, 30},
+		{"nrgba", func(img image.Image) image.Image {
+			nrgba := image.NewNRGBA(img.Bounds())
+			draw.Draw(nrgba, nrgba.Bounds(), img, image.Point{}, draw.Src)
+			return nrgba
+		}, 1.5},
+	}
+
+	for _, tc := range testCases {
+		src := tc.convert(watermarked)
+		result := engine.RemoveDetected(src, detection)
+		if got, want := fmt.Sprintf("%T", result), fmt.Sprintf("%T", src); got != want {
+			t.Errorf("%s: result is %s, expected %s", tc.name, got, want)
+			continue
+		}
+		if p, ok := result.(*image.Paletted); ok && len(p.Palette) != len(palette.WebSafe) {
+			t.Errorf("%s: palette changed", tc.name)
+		}
+
+		// Compare with the original in the same color model
+		expected := tc.convert(original)
+		if mean := meanError16(result, expected, region, profile.AlphaMap) / 257; mean > tc.maxError {
+			t.Errorf("%s: mean error %.2f", tc.name, mean)
+		}
+		if result.At(5, 5) != src.At(5, 5) {
+			t.Errorf("%s: pixel outside the watermark changed", tc.name)
+		}
+	}
+}
+
+func TestSetRestored_Paletted(t *testing.T) {
+	pal := color.Palette{color.Black, color.Gray{Y: 128}, color.White, color.Transparent}
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), pal)
+	img.SetColorIndex(1, 0, 3)
+
+	// Restored colors take the nearest palette entry
+	setRestored(img, 0, 0, [3]float64{140, 120, 131})
+	if got := img.ColorIndexAt(0, 0); got != 1 {
+		t.Errorf("expected palette index 1, got %d", got)
+	}
+
+	// Transparent pixels are left alone
+	setRestored(img, 1, 0, [3]float64{255, 255, 255})
+	if got := img.ColorIndexAt(1, 0); got != 3 {
+		t.Errorf("transparent pixel changed to index %d", got)
+	}
+}
+
+func TestLuma(t *testing.T) {
+	if got := luma([3]float64{100, 100, 100}); math.Abs(got-100) > 1e-9 {
+		t.Errorf("luma of gray 100 = %v", got)
+	}
+	if got, want := luma([3]float64{255, 0, 0}), 255*19595.0/65536; math.Abs(got-want) > 1e-9 {
+		t.Errorf("luma of red = %v, expected %v", got, want)
+	}
+}
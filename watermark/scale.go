@@ -0,0 +1,174 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// DefaultScales covers watermarks from half to twice their original size in
+// geometric steps of 4%. Matches between two steps are refined further, so
+// the effective precision is well below the step size.
+var DefaultScales = geometricScales(0.5, 2.0, 1.04)
+
+// unitScale is the scale list used by the single-scale detectors.
+var unitScale = []float64{1}
+
+// minScaledSize is the smallest watermark (in pixels) a scaled search will
+// consider. Below that the logo shape is too coarse to be told apart from
+// ordinary image content.
+const minScaledSize = 8
+
+// DetectScaled works like DetectNear but also evaluates every profile at
+// each of the given scales, for images that were downscaled or upscaled after
+// generation. Both the watermark and its margin are assumed to have been
+// resized with the image. A nil or empty scales slice selects DefaultScales.
+//
+// The alpha map is resampled for each scale, and the best scale is refined
+// by fitting a parabola through the scores of its neighbors. Since resizing
+// rounds the watermark position to whole pixels, a radius of at least 2 is
+// recommended. The returned Detection records the winning scale and can be
+// passed to RemoveDetected, which reverses the blend with the resampled map.
+func (e *Engine) DetectScaled(img image.Image, scales []float64, radius int) Detection {
+	if len(scales) == 0 {
+		scales = DefaultScales
+	}
+	if radius < 0 {
+		radius = 0
+	}
+
+	sorted := append([]float64(nil), scales...)
+	sort.Float64s(sorted)
+
+	return e.detect(img, radius, sorted)
+}
+
+// locateScaled finds the best match for a profile over a sorted list of
+// scales, each searched within radius pixels of its expected position.
+func locateScaled(s *scratch, img image.Image, profile *Profile, scales []float64, radius int) CandidateScore {
+	bounds := img.Bounds()
+	config := profile.Config()
+	expectedAt := func(scale float64) image.Rectangle {
+		return CalculatePosition(bounds.Dx(), bounds.Dy(), scaleConfig(config, scale)).Add(bounds.Min)
+	}
+
+	best := CandidateScore{Profile: profile.Name, Config: config, Region: expectedAt(1), Scale: 1}
+	bestIdx := -1
+	s.confidences = grow(s.confidences, len(scales))
+	confidences := s.confidences
+	for i, scale := range scales {
+		if scaleConfig(config, scale).Size < minScaledSize {
+			continue
+		}
+		score := locate(s, img, profile, scale, expectedAt(scale), radius)
+		confidences[i] = score.Confidence
+		if bestIdx < 0 || score.Confidence > best.Confidence {
+			best, bestIdx = score, i
+		}
+	}
+
+	// Refine the scale between the neighboring steps. The parabola is fitted
+	// in log-scale, where DefaultScales is evenly spaced.
+	if bestIdx > 0 && bestIdx < len(scales)-1 && best.Confidence > 0 {
+		t := parabolicPeak(confidences[bestIdx-1], confidences[bestIdx], confidences[bestIdx+1])
+		if t != 0 {
+			logScale := math.Log(scales[bestIdx])
+			neighbor := math.Log(scales[bestIdx+1])
+			if t < 0 {
+				neighbor = math.Log(scales[bestIdx-1])
+			}
+			refined := math.Exp(logScale + math.Abs(t)*(neighbor-logScale))
+
+			score := locate(s, img, profile, refined, expectedAt(refined), radius)
+			if score.Confidence > best.Confidence {
+				best = score
+			}
+		}
+	}
+
+	return best
+}
+
+// scaleConfig returns the size and margin of a configuration resized by scale,
+// rounded to whole pixels.
+func scaleConfig(config WatermarkConfig, scale float64) WatermarkConfig {
+	if scale == 1 {
+		return config
+	}
+	return WatermarkConfig{
+		Size:   int(math.Round(float64(config.Size) * scale)),
+		Margin: int(math.Round(float64(config.Margin) * scale)),
+	}
+}
+
+// scaledAlphaMap returns the alpha map of a profile resampled to scale and
+// translated by a sub-pixel offset, together with its side length. The
+// pre-computed map is returned as is when no resampling is needed.
+func scaledAlphaMap(profile *Profile, scale, dx, dy float64) ([]float32, int) {
+	if scale == 1 && dx == 0 && dy == 0 {
+		return profile.AlphaMap, profile.Size
+	}
+	return resampleAlphaMap(profile.AlphaMap, profile.Size, scale, dx, dy)
+}
+
+// resampleAlphaMap resizes a size x size alpha map by scale and translates it
+// by (dx, dy) destination pixels. It returns the new map and its side length.
+//
+// Each destination pixel averages k x k bilinear samples of the source, with
+// k chosen so that downscaling integrates over the whole source footprint
+// instead of aliasing. Samples outside the source are fully transparent.
+func resampleAlphaMap(alphaMap []float32, size int, scale, dx, dy float64) ([]float32, int) {
+	n := int(math.Round(float64(size) * scale))
+	if n < 1 {
+		n = 1
+	}
+	k := int(math.Ceil(1 / scale))
+	if k < 1 {
+		k = 1
+	}
+
+	sample := func(x, y int) float64 {
+		if x < 0 || y < 0 || x >= size || y >= size {
+			return 0
+		}
+		return float64(alphaMap[y*size+x])
+	}
+	bilinear := func(u, v float64) float64 {
+		x0, y0 := int(math.Floor(u)), int(math.Floor(v))
+		fx, fy := u-float64(x0), v-float64(y0)
+		top := sample(x0, y0)*(1-fx) + sample(x0+1, y0)*fx
+		bottom := sample(x0, y0+1)*(1-fx) + sample(x0+1, y0+1)*fx
+		return top*(1-fy) + bottom*fy
+	}
+
+	result := make([]float32, n*n)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var sum float64
+			for j := 0; j < k; j++ {
+				// Map the sample point from destination pixel space to
+				// source pixel space (pixel centers at integer + 0.5).
+				v := (float64(y)+(float64(j)+0.5)/float64(k)-dy)/scale - 0.5
+				for i := 0; i < k; i++ {
+					u := (float64(x)+(float64(i)+0.5)/float64(k)-dx)/scale - 0.5
+					sum += bilinear(u, v)
+				}
+			}
+			result[y*n+x] = float32(sum / float64(k*k))
+		}
+	}
+	return result, n
+}
+
+// geometricScales returns the powers of step that lie in [min, max], in
+// increasing order. The result always contains 1 when min <= 1 <= max.
+func geometricScales(min, max, step float64) []float64 {
+	first := int(math.Ceil(math.Log(min)/math.Log(step) - 1e-9))
+	last := int(math.Floor(math.Log(max)/math.Log(step) + 1e-9))
+
+	scales := make([]float64, 0, last-first+1)
+	for k := first; k <= last; k++ {
+		scales = append(scales, math.Pow(step, float64(k)))
+	}
+	return scales
+}
@@ -0,0 +1,187 @@
+package watermark
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDetectScaled_ResizedImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	testCases := []struct {
+		width, height int
+		config        WatermarkConfig
+		scale         float64
+	}{
+		{600, 450, WatermarkConfig{Size: 48, Margin: 32}, 0.75},    // 800x600 downscaled
+		{1200, 900, WatermarkConfig{Size: 48, Margin: 32}, 1.5},    // 800x600 upscaled
+		{1000, 1000, WatermarkConfig{Size: 96, Margin: 64}, 0.625}, // 1600x1600 downscaled
+	}
+
+	for _, tc := range testCases {
+		scaled := scaleConfig(tc.config, tc.scale)
+		region := CalculatePosition(tc.width, tc.height, scaled)
+		alphaMap, _ := resampleAlphaMap(engine.profileByConfig(tc.config).AlphaMap, tc.config.Size, tc.scale, 0, 0)
+		img := createNoiseImage(tc.width, tc.height, 30)
+		applyWatermark(img, region, alphaMap)
+
+		detection := engine.DetectScaled(img, nil, 2)
+
+		if !detection.Detected {
+			t.Errorf("scale %.3f: watermark not detected (confidence %.3f)", tc.scale, detection.Confidence)
+			continue
+		}
+		if detection.Config != tc.config {
+			t.Errorf("scale %.3f: expected config %v, got %v", tc.scale, tc.config, detection.Config)
+		}
+		if math.Abs(detection.Scale-tc.scale)/tc.scale > 0.02 {
+			t.Errorf("scale %.3f: estimated scale %.3f is off by more than 2%%", tc.scale, detection.Scale)
+		}
+		if detection.Region.Dx() != scaled.Size {
+			t.Errorf("scale %.3f: expected region size %d, got %d", tc.scale, scaled.Size, detection.Region.Dx())
+		}
+		if detection.Selection != SelectedByContent {
+			t.Errorf("scale %.3f: expected selection by content, got %v", tc.scale, detection.Selection)
+		}
+	}
+}
+
+func TestDetectScaled_UnscaledImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// An untouched image keeps the original scale and the dimension rule
+	config, region := GetWatermarkInfo(800, 600)
+	img := createNoiseImage(800, 600, 31)
+	applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+
+	detection := engine.DetectScaled(img, nil, 2)
+
+	if detection.Scale != 1 {
+		t.Errorf("expected scale 1, got %.3f", detection.Scale)
+	}
+	if detection.Region != region {
+		t.Errorf("expected region %v, got %v", region, detection.Region)
+	}
+	if detection.Selection != SelectedByDimensions {
+		t.Errorf("expected selection by dimensions, got %v", detection.Selection)
+	}
+}
+
+func TestRemoveDetected_ScaledWatermark(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	config := WatermarkConfig{Size: 48, Margin: 32}
+	const scale = 0.75
+	region := CalculatePosition(600, 450, scaleConfig(config, scale))
+	alphaMap, _ := resampleAlphaMap(engine.profileByConfig(config).AlphaMap, config.Size, scale, 0, 0)
+
+	original := createNoiseImage(600, 450, 32)
+	img := createNoiseImage(600, 450, 32)
+	applyWatermark(img, region, alphaMap)
+
+	result := engine.RemoveDetected(img, engine.DetectScaled(img, nil, 2))
+
+	// The estimated scale is not exact, so compare the mean error rather
+	// than every pixel
+	var total, count float64
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			r, _, _, _ := result.At(x, y).RGBA()
+			total += math.Abs(float64(r>>8) - float64(original.RGBAAt(x, y).R))
+			count++
+		}
+	}
+	if mean := total / count; mean > 2 {
+		t.Errorf("mean restoration error %.2f exceeds 2", mean)
+	}
+}
+
+func TestResampleAlphaMap(t *testing.T) {
+	// 4x4 map with a bright 2x2 top-left block
+	alphaMap := []float32{
+		1, 1, 0, 0,
+		1, 1, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+
+	// Halving averages 2x2 blocks
+	result, n := resampleAlphaMap(alphaMap, 4, 0.5, 0, 0)
+	if n != 2 {
+		t.Fatalf("expected size 2, got %d", n)
+	}
+	if math.Abs(float64(result[0])-1) > 1e-6 || result[1] != 0 || result[2] != 0 || result[3] != 0 {
+		t.Errorf("downscale by 0.5: got %v", result)
+	}
+
+	// Doubling keeps the total coverage
+	result, n = resampleAlphaMap(alphaMap, 4, 2, 0, 0)
+	if n != 8 {
+		t.Fatalf("expected size 8, got %d", n)
+	}
+	var sum float32
+	for _, v := range result {
+		sum += v
+	}
+	if math.Abs(float64(sum)/4-4) > 0.5 {
+		t.Errorf("upscale by 2: expected total coverage near 4, got %.2f", sum/4)
+	}
+
+	// Unit scale without offset is an exact copy
+	result, _ = resampleAlphaMap(alphaMap, 4, 1, 0, 0)
+	for i := range alphaMap {
+		if result[i] != alphaMap[i] {
+			t.Fatalf("unit scale: index %d changed from %f to %f", i, alphaMap[i], result[i])
+		}
+	}
+}
+
+func TestScaleConfig(t *testing.T) {
+	testCases := []struct {
+		config   WatermarkConfig
+		scale    float64
+		expected WatermarkConfig
+	}{
+		{WatermarkConfig{Size: 48, Margin: 32}, 1, WatermarkConfig{Size: 48, Margin: 32}},
+		{WatermarkConfig{Size: 48, Margin: 32}, 0.5, WatermarkConfig{Size: 24, Margin: 16}},
+		{WatermarkConfig{Size: 96, Margin: 64}, 1.5, WatermarkConfig{Size: 144, Margin: 96}},
+		{WatermarkConfig{Size: 48, Margin: 32}, 0.75, WatermarkConfig{Size: 36, Margin: 24}},
+	}
+
+	for _, tc := range testCases {
+		if result := scaleConfig(tc.config, tc.scale); result != tc.expected {
+			t.Errorf("scaleConfig(%v, %.2f) = %v, expected %v", tc.config, tc.scale, result, tc.expected)
+		}
+	}
+}
+
+func TestDefaultScales(t *testing.T) {
+	if len(DefaultScales) == 0 {
+		t.Fatal("DefaultScales is empty")
+	}
+
+	hasUnit := false
+	for i, scale := range DefaultScales {
+		if scale < 0.5 || scale > 2.0 {
+			t.Errorf("scale %.3f outside [0.5, 2.0]", scale)
+		}
+		if i > 0 && scale <= DefaultScales[i-1] {
+			t.Errorf("DefaultScales not strictly increasing at index %d", i)
+		}
+		if scale == 1 {
+			hasUnit = true
+		}
+	}
+	if !hasUnit {
+		t.Error("DefaultScales should contain exactly 1.0")
+	}
+}
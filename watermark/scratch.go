@@ -0,0 +1,50 @@
+package watermark
+
+import "sync"
+
+// scratch holds the buffers detection needs, so that repeated calls reuse
+// them instead of allocating. A call takes a scratch from scratchPool and
+// returns it when done, so concurrent calls never share one.
+type scratch struct {
+	// profiles is a snapshot of the engine's registered profiles.
+	profiles []*Profile
+
+	// scores holds the best match of every profile (see detectWith).
+	scores []CandidateScore
+
+	// confidences holds the score of every scale (see locateScaled).
+	confidences []float64
+
+	// correlations holds the score of every position (see locate).
+	correlations []float64
+
+	// luma holds the pixels of a lumaPlane.
+	luma []float32
+}
+
+// scratchPool holds the scratch buffers that are not in use.
+var scratchPool = sync.Pool{New: func() any { return new(scratch) }}
+
+// getScratch takes a scratch from the pool.
+func getScratch() *scratch {
+	return scratchPool.Get().(*scratch)
+}
+
+// release returns s to the pool. It drops the profiles so that the pool
+// does not keep engines alive.
+func (s *scratch) release() {
+	clear(s.profiles)
+	s.profiles = s.profiles[:0]
+	scratchPool.Put(s)
+}
+
+// grow returns buf resized to n zero elements, reallocating it only if it
+// is too small.
+func grow[T any](buf []T, n int) []T {
+	if cap(buf) < n {
+		return make([]T, n)
+	}
+	buf = buf[:n]
+	clear(buf)
+	return buf
+}
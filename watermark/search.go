@@ -0,0 +1,255 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// DefaultFindThreshold is the default minimum confidence for matches returned
+// by FindAll. It is higher than DetectionThreshold because a full-image search
+// evaluates millions of positions, which raises the odds of a chance match.
+const DefaultFindThreshold = 0.6
+
+// coarseTemplateSize is the side length the alpha map is reduced to for the
+// first, coarse pass of FindAll. Small enough to scan large images quickly,
+// large enough to keep the star shape recognizable.
+const coarseTemplateSize = 16
+
+// coarseThresholdRatio scales the FindAll threshold for the coarse pass, which
+// scores lower than full resolution because downsampling blurs the logo.
+const coarseThresholdRatio = 0.75
+
+// FindAll scans the whole image for watermarks of every registered profile
+// and returns each instance whose confidence reaches threshold,
+// ordered by decreasing confidence. A non-positive threshold selects
+// DefaultFindThreshold.
+//
+// This finds watermarks that are nowhere near the bottom-right corner, for
+// example when a Gemini image was pasted into a screenshot, collage or slide.
+// The search runs in two passes: normalized cross-correlation against a
+// downsampled alpha map on a downsampled copy of the image, followed by a
+// full-resolution search (with sub-pixel refinement) around each coarse peak.
+// Overlapping matches are reduced to the most confident one.
+func (e *Engine) FindAll(img image.Image, threshold float64) []Detection {
+	if threshold <= 0 {
+		threshold = DefaultFindThreshold
+	}
+
+	s := getScratch()
+	defer s.release()
+
+	var matches []Detection
+	planes := make(map[int]*coarsePlane)
+	for _, profile := range e.registered() {
+		size := profile.Size
+		factor := size / coarseTemplateSize
+		if factor < 1 {
+			factor = 1
+		}
+		plane, ok := planes[factor]
+		if !ok {
+			plane = newCoarsePlane(img, factor)
+			planes[factor] = plane
+		}
+
+		template := downsampleAlphaMap(profile.AlphaMap, size, factor)
+		for _, peak := range plane.peaks(template, size/factor, threshold*coarseThresholdRatio) {
+			region := image.Rect(peak.X, peak.Y, peak.X+size, peak.Y+size)
+			score := locate(s, img, profile, 1, region, factor)
+			if score.Confidence < threshold {
+				continue
+			}
+			matches = append(matches, Detection{
+				Detected:   true,
+				Profile:    score.Profile,
+				Config:     score.Config,
+				Region:     score.Region,
+				Scale:      1,
+				OffsetX:    score.OffsetX,
+				OffsetY:    score.OffsetY,
+				Confidence: score.Confidence,
+				Selection:  SelectedByContent,
+			})
+		}
+	}
+
+	return suppressOverlaps(matches)
+}
+
+// suppressOverlaps keeps the most confident detection among any group of
+// overlapping ones and returns the survivors ordered by decreasing confidence.
+func suppressOverlaps(matches []Detection) []Detection {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Confidence > matches[j].Confidence
+	})
+
+	var kept []Detection
+	for _, match := range matches {
+		overlaps := false
+		for _, other := range kept {
+			if !match.Region.Intersect(other.Region).Empty() {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			kept = append(kept, match)
+		}
+	}
+	return kept
+}
+
+// downsampleAlphaMap reduces a size x size alpha map by averaging
+// factor x factor blocks. Trailing pixels that do not fill a block are dropped.
+func downsampleAlphaMap(alphaMap []float32, size, factor int) []float32 {
+	n := size / factor
+	result := make([]float32, n*n)
+	for y := 0; y < n*factor; y++ {
+		for x := 0; x < n*factor; x++ {
+			result[(y/factor)*n+x/factor] += alphaMap[y*size+x]
+		}
+	}
+	for i := range result {
+		result[i] /= float32(factor * factor)
+	}
+	return result
+}
+
+// coarsePlane is a block-averaged brightness copy of an image, together with
+// summed-area tables that give the mean and variance of any window in O(1).
+type coarsePlane struct {
+	origin        image.Point // Image coordinates of the first block
+	factor        int         // Block size in image pixels
+	width, height int         // Dimensions in blocks
+	pix           []float64
+
+	// sum and sumSq are (width+1) x (height+1) summed-area tables of pix
+	// and pix squared.
+	sum, sumSq []float64
+}
+
+// newCoarsePlane averages the brightness of img over factor x factor blocks.
+func newCoarsePlane(img image.Image, factor int) *coarsePlane {
+	bounds := img.Bounds()
+	p := &coarsePlane{
+		origin: bounds.Min,
+		factor: factor,
+		width:  bounds.Dx() / factor,
+		height: bounds.Dy() / factor,
+	}
+	p.pix = make([]float64, p.width*p.height)
+
+	for y := 0; y < p.height*factor; y++ {
+		row := (y / factor) * p.width
+		for x := 0; x < p.width*factor; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			p.pix[row+x/factor] += float64(r>>8+g>>8+b>>8) / 3
+		}
+	}
+
+	area := float64(factor * factor)
+	stride := p.width + 1
+	p.sum = make([]float64, stride*(p.height+1))
+	p.sumSq = make([]float64, stride*(p.height+1))
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			v := p.pix[y*p.width+x] / area
+			p.pix[y*p.width+x] = v
+			i := (y+1)*stride + x + 1
+			p.sum[i] = v + p.sum[i-1] + p.sum[i-stride] - p.sum[i-stride-1]
+			p.sumSq[i] = v*v + p.sumSq[i-1] + p.sumSq[i-stride] - p.sumSq[i-stride-1]
+		}
+	}
+	return p
+}
+
+// windowStats returns the sum and sum of squares of the n x n window whose
+// top-left block is (x, y).
+func (p *coarsePlane) windowStats(x, y, n int) (sum, sumSq float64) {
+	stride := p.width + 1
+	a, b := y*stride+x, y*stride+x+n
+	c, d := (y+n)*stride+x, (y+n)*stride+x+n
+	return p.sum[d] - p.sum[b] - p.sum[c] + p.sum[a],
+		p.sumSq[d] - p.sumSq[b] - p.sumSq[c] + p.sumSq[a]
+}
+
+// peaks computes the normalized cross-correlation of an n x n template at
+// every window position and returns the image coordinates of the local maxima
+// that reach threshold.
+func (p *coarsePlane) peaks(template []float32, n int, threshold float64) []image.Point {
+	cols, rows := p.width-n+1, p.height-n+1
+	if cols <= 0 || rows <= 0 {
+		return nil
+	}
+
+	// Zero-mean template: the cross term then needs no window mean
+	var mean, norm float64
+	for _, t := range template {
+		mean += float64(t)
+	}
+	mean /= float64(len(template))
+	centered := make([]float64, len(template))
+	for i, t := range template {
+		centered[i] = float64(t) - mean
+		norm += centered[i] * centered[i]
+	}
+	if norm <= 1e-12 {
+		return nil
+	}
+
+	scores := make([]float64, cols*rows)
+	count := float64(n * n)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			sum, sumSq := p.windowStats(x, y, n)
+			variance := sumSq - sum*sum/count
+			if variance <= 1e-9 {
+				continue
+			}
+
+			var cross float64
+			for ty := 0; ty < n; ty++ {
+				row := p.pix[(y+ty)*p.width+x : (y+ty)*p.width+x+n]
+				tmpl := centered[ty*n : ty*n+n]
+				for tx, t := range tmpl {
+					cross += t * row[tx]
+				}
+			}
+			scores[y*cols+x] = cross / math.Sqrt(norm*variance)
+		}
+	}
+
+	// Keep positions that reach the threshold and dominate their 3x3
+	// neighborhood (ties resolved in favor of the first position).
+	var result []image.Point
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			score := scores[y*cols+x]
+			if score < threshold || !isLocalMax(scores, cols, rows, x, y) {
+				continue
+			}
+			result = append(result, image.Pt(p.origin.X+x*p.factor, p.origin.Y+y*p.factor))
+		}
+	}
+	return result
+}
+
+// isLocalMax reports whether scores[y*cols+x] is a maximum of its 3x3
+// neighborhood, treating equal earlier neighbors as dominant.
+func isLocalMax(scores []float64, cols, rows, x, y int) bool {
+	score := scores[y*cols+x]
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			nx, ny := x+dx, y+dy
+			if (dx == 0 && dy == 0) || nx < 0 || ny < 0 || nx >= cols || ny >= rows {
+				continue
+			}
+			neighbor := scores[ny*cols+nx]
+			if neighbor > score || (neighbor == score && ny*cols+nx < y*cols+x) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package watermark
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFindAll_MultipleInstances(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// A "collage" with watermarks far away from the bottom-right corner
+	img := createNoiseImage(640, 480, 20)
+	small := WatermarkConfig{Size: 48, Margin: 32}
+	large := WatermarkConfig{Size: 96, Margin: 64}
+	expected := map[image.Rectangle]WatermarkConfig{
+		image.Rect(37, 51, 37+48, 51+48):     small,
+		image.Rect(301, 222, 301+48, 222+48): small,
+		image.Rect(450, 90, 450+96, 90+96):   large,
+		image.Rect(120, 300, 120+96, 300+96): large,
+	}
+	for region, config := range expected {
+		applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+	}
+
+	detections := engine.FindAll(img, 0)
+
+	if len(detections) != len(expected) {
+		t.Fatalf("expected %d detections, got %d: %+v", len(expected), len(detections), detections)
+	}
+	for i, detection := range detections {
+		config, ok := expected[detection.Region]
+		if !ok {
+			t.Errorf("unexpected detection at %v (confidence %.3f)", detection.Region, detection.Confidence)
+			continue
+		}
+		if detection.Config != config {
+			t.Errorf("detection at %v: expected config %v, got %v", detection.Region, config, detection.Config)
+		}
+		if !detection.Detected || detection.Confidence < DefaultFindThreshold {
+			t.Errorf("detection at %v: confidence %.3f below threshold", detection.Region, detection.Confidence)
+		}
+		if i > 0 && detection.Confidence > detections[i-1].Confidence {
+			t.Errorf("detections not ordered by decreasing confidence")
+		}
+	}
+}
+
+func TestFindAll_CleanImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	img := createNoiseImage(640, 480, 21)
+	if detections := engine.FindAll(img, 0); len(detections) != 0 {
+		t.Errorf("clean image: expected no detections, got %+v", detections)
+	}
+}
+
+func TestFindAll_SmallImage(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Smaller than either watermark: nothing to find and no panic
+	img := createNoiseImage(30, 30, 22)
+	if detections := engine.FindAll(img, 0); len(detections) != 0 {
+		t.Errorf("tiny image: expected no detections, got %+v", detections)
+	}
+}
+
+func TestRemoveAll_RestoresEveryInstance(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	config := WatermarkConfig{Size: 48, Margin: 32}
+	regions := []image.Rectangle{
+		image.Rect(40, 40, 88, 88),
+		image.Rect(200, 150, 248, 198),
+	}
+	original := createNoiseImage(320, 240, 23)
+	img := createNoiseImage(320, 240, 23)
+	for _, region := range regions {
+		applyWatermark(img, region, engine.profileByConfig(config).AlphaMap)
+	}
+
+	result := engine.RemoveAll(img, engine.FindAll(img, 0))
+
+	const tolerance = 3
+	for _, region := range regions {
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				r, g, b, _ := result.At(x, y).RGBA()
+				want := original.RGBAAt(x, y)
+				if absDiff(uint8(r>>8), want.R) > tolerance ||
+					absDiff(uint8(g>>8), want.G) > tolerance ||
+					absDiff(uint8(b>>8), want.B) > tolerance {
+					t.Fatalf("pixel (%d,%d): got (%d,%d,%d), expected (%d,%d,%d)",
+						x, y, r>>8, g>>8, b>>8, want.R, want.G, want.B)
+				}
+			}
+		}
+	}
+}
+
+func TestSuppressOverlaps(t *testing.T) {
+	matches := []Detection{
+		{Region: image.Rect(0, 0, 48, 48), Confidence: 0.7},
+		{Region: image.Rect(10, 10, 58, 58), Confidence: 0.9},
+		{Region: image.Rect(100, 100, 148, 148), Confidence: 0.8},
+	}
+
+	kept := suppressOverlaps(matches)
+
+	if len(kept) != 2 {
+		t.Fatalf("expected 2 detections after suppression, got %d", len(kept))
+	}
+	if kept[0].Confidence != 0.9 || kept[1].Confidence != 0.8 {
+		t.Errorf("expected confidences [0.9 0.8], got [%.1f %.1f]", kept[0].Confidence, kept[1].Confidence)
+	}
+}
+
+func TestDownsampleAlphaMap(t *testing.T) {
+	alphaMap := []float32{
+		1, 1, 0, 0,
+		1, 1, 0, 0,
+		0, 0, 0.5, 0.5,
+		0, 0, 0.5, 0.5,
+	}
+
+	result := downsampleAlphaMap(alphaMap, 4, 2)
+	expected := []float32{1, 0, 0, 0.5}
+
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("index %d: expected %f, got %f", i, expected[i], result[i])
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// jpegBlockSize is the size of the DCT blocks of a JPEG image, in samples
+// of the plane they belong to.
+const jpegBlockSize = 8
+
+// deblockLimit is the largest step (in 8-bit levels, before scaling by the
+// noise amplification of the reverse blend) across a block boundary that the
+// deblocking filter treats as a compression artifact. Larger steps are kept
+// as edges of the image content.
+const deblockLimit = 4.0
+
+// removeYCbCr removes the watermarks in detections from a copy of a
+// Y'CbCr image (typically a decoded JPEG), keeping its chroma subsampling.
+//
+// The blend is inverted on the planes directly: since Y'CbCr is an affine
+// function of RGB, the blend with the logo color holds per component. Luma
+// is inverted per pixel. A subsampled chroma sample is the mean over the
+// pixels it covers, so it is inverted with the mean alpha of those pixels;
+// inverting upsampled chroma with per-pixel alpha instead leaves blocky
+// color fringes along the logo outline. A light deblocking filter then
+// smooths the JPEG block boundaries inside the watermark, where the
+// inversion amplifies quantization steps.
+func (e *Engine) removeYCbCr(src *image.YCbCr, detections []Detection) *image.YCbCr {
+	result := cloneYCbCr(src)
+	for _, detection := range detections {
+		e.restoreYCbCr(result, detection)
+	}
+	return result
+}
+
+// cloneYCbCr returns a copy of img with its own planes, holding only the
+// samples of its bounds with packed rows (see clonePix).
+func cloneYCbCr(img *image.YCbCr) *image.YCbCr {
+	cloned := image.NewYCbCr(img.Rect, img.SubsampleRatio)
+	if img.Rect.Empty() {
+		return cloned
+	}
+	copyRows(cloned.Y, cloned.YStride, img.Y, img.YStride, cloned.YStride, img.Rect.Dy())
+	rows := len(cloned.Cb) / cloned.CStride
+	copyRows(cloned.Cb, cloned.CStride, img.Cb, img.CStride, cloned.CStride, rows)
+	copyRows(cloned.Cr, cloned.CStride, img.Cr, img.CStride, cloned.CStride, rows)
+	return cloned
+}
+
+// mergeYCbCr returns a copy of src with the pixels that differ in restored,
+// an RGBA copy of src restored within areas, converted back to Y'CbCr. Luma
+// is converted per changed pixel; chroma samples covering a changed pixel
+// are recomputed as the mean over all the pixels they cover, like a JPEG
+// encoder does.
+func mergeYCbCr(src *image.YCbCr, restored *image.RGBA, areas []image.Rectangle) *image.YCbCr {
+	result := cloneYCbCr(src)
+	dirty := make(map[int]bool)
+	var union image.Rectangle
+	for _, area := range areas {
+		union = union.Union(area)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				c := restored.RGBAAt(x, y)
+				sc := src.YCbCrAt(x, y)
+				r, g, b := color.YCbCrToRGB(sc.Y, sc.Cb, sc.Cr)
+				if c.R == r && c.G == g && c.B == b {
+					continue
+				}
+				result.Y[result.YOffset(x, y)], _, _ = color.RGBToYCbCr(c.R, c.G, c.B)
+				dirty[result.COffset(x, y)] = true
+			}
+		}
+	}
+	if len(dirty) == 0 {
+		return result
+	}
+
+	// The pixels covered by the dirty samples lie within the areas grown
+	// by the largest subsampling factor
+	sums := make(map[int][3]int)
+	union = union.Inset(-4).Intersect(src.Rect)
+	for y := union.Min.Y; y < union.Max.Y; y++ {
+		for x := union.Min.X; x < union.Max.X; x++ {
+			i := result.COffset(x, y)
+			if !dirty[i] {
+				continue
+			}
+			c := restored.RGBAAt(x, y)
+			_, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			sum := sums[i]
+			sums[i] = [3]int{sum[0] + int(cb), sum[1] + int(cr), sum[2] + 1}
+		}
+	}
+	for i, sum := range sums {
+		result.Cb[i] = uint8((sum[0] + sum[2]/2) / sum[2])
+		result.Cr[i] = uint8((sum[1] + sum[2]/2) / sum[2])
+	}
+	return result
+}
+
+// restoreYCbCr inverts the blend of the detected watermark in place on the
+// planes of img and deblocks the affected region.
+func (e *Engine) restoreYCbCr(img *image.YCbCr, detection Detection) {
+	region, alphaMap, profile, ok := e.restoreInputs(detection)
+	if !ok {
+		return
+	}
+	size := region.Dx()
+	logo := rgbToYCbCr(profile.LogoColor)
+	threshold, maxAlpha := profile.alphaLimits()
+
+	// alphaAt returns the opacity at an image pixel, zero outside the
+	// watermark region
+	alphaAt := func(x, y int) float64 {
+		if !image.Pt(x, y).In(region) {
+			return 0
+		}
+		return float64(alphaMap[(y-region.Min.Y)*size+x-region.Min.X])
+	}
+	invert := func(v uint8, alpha, logo float64) uint8 {
+		alpha = math.Min(alpha, maxAlpha)
+		return uint8(clamp(math.Round((float64(v)-alpha*logo)/(1-alpha)), 0, 255))
+	}
+
+	// Luma, per pixel
+	area := region.Intersect(img.Rect)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if alpha := alphaAt(x, y); alpha >= threshold {
+				i := img.YOffset(x, y)
+				img.Y[i] = invert(img.Y[i], alpha, logo[0])
+			}
+		}
+	}
+
+	// Chroma, per sample with the mean alpha of the pixels it covers. The
+	// footprint of a sample is at most 4 pixels wide and 2 high.
+	hs, vs := subsampleFactors(img.SubsampleRatio)
+	footprint := region.Inset(-4).Intersect(img.Rect)
+	sums := make(map[int][2]float64)
+	for y := footprint.Min.Y; y < footprint.Max.Y; y++ {
+		for x := footprint.Min.X; x < footprint.Max.X; x++ {
+			i := img.COffset(x, y)
+			sum := sums[i]
+			sums[i] = [2]float64{sum[0] + alphaAt(x, y), sum[1] + 1}
+		}
+	}
+	chromaAlpha := make(map[int]float64, len(sums))
+	for i, sum := range sums {
+		alpha := sum[0] / sum[1]
+		if alpha < threshold {
+			continue
+		}
+		chromaAlpha[i] = alpha
+		img.Cb[i] = invert(img.Cb[i], alpha, logo[1])
+		img.Cr[i] = invert(img.Cr[i], alpha, logo[2])
+	}
+
+	// Deblock the luma plane in pixel coordinates and the chroma planes in
+	// sample coordinates
+	yOffset := func(x, y int) int {
+		if !image.Pt(x, y).In(img.Rect) {
+			return -1
+		}
+		return img.YOffset(x, y)
+	}
+	deblockPlane(img.Y, area, yOffset, alphaAt, threshold, maxAlpha)
+
+	chromaRect := image.Rect(img.Rect.Min.X/hs, img.Rect.Min.Y/vs,
+		(img.Rect.Max.X+hs-1)/hs, (img.Rect.Max.Y+vs-1)/vs)
+	cOffset := func(cx, cy int) int {
+		if !image.Pt(cx, cy).In(chromaRect) {
+			return -1
+		}
+		return (cy-img.Rect.Min.Y/vs)*img.CStride + cx - img.Rect.Min.X/hs
+	}
+	cAlpha := func(cx, cy int) float64 {
+		if i := cOffset(cx, cy); i >= 0 {
+			return chromaAlpha[i]
+		}
+		return 0
+	}
+	chromaArea := image.Rect(area.Min.X/hs, area.Min.Y/vs,
+		(area.Max.X+hs-1)/hs, (area.Max.Y+vs-1)/vs)
+	deblockPlane(img.Cb, chromaArea, cOffset, cAlpha, threshold, maxAlpha)
+	deblockPlane(img.Cr, chromaArea, cOffset, cAlpha, threshold, maxAlpha)
+}
+
+// deblockPlane smooths the block boundaries of one image plane that cross
+// rect (in plane coordinates). offset maps plane coordinates to an index
+// into pix, or -1 outside the plane; alpha returns the watermark opacity of
+// a sample. Only boundaries next to samples with alpha of at least
+// threshold are filtered, with a limit scaled by the noise amplification
+// there (with alpha clamped to maxAlpha).
+func deblockPlane(pix []uint8, rect image.Rectangle, offset func(x, y int) int, alpha func(x, y int) float64, threshold, maxAlpha float64) {
+	// edge filters the four samples p1 p0 | q0 q1 across a boundary
+	edge := func(p1, p0, q0, q1 int, a float64) {
+		if p1 < 0 || p0 < 0 || q0 < 0 || q1 < 0 || a < threshold {
+			return
+		}
+		limit := deblockLimit / (1 - math.Min(a, maxAlpha))
+		filtered := deblockEdge([4]float64{float64(pix[p1]), float64(pix[p0]), float64(pix[q0]), float64(pix[q1])}, limit)
+		for k, i := range [4]int{p1, p0, q0, q1} {
+			pix[i] = uint8(clamp(math.Round(filtered[k]), 0, 255))
+		}
+	}
+
+	// Vertical boundaries, between columns x-1 and x
+	for x := rect.Min.X; x <= rect.Max.X; x++ {
+		if x%jpegBlockSize != 0 {
+			continue
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			a := math.Max(alpha(x-1, y), alpha(x, y))
+			edge(offset(x-2, y), offset(x-1, y), offset(x, y), offset(x+1, y), a)
+		}
+	}
+
+	// Horizontal boundaries, between rows y-1 and y
+	for y := rect.Min.Y; y <= rect.Max.Y; y++ {
+		if y%jpegBlockSize != 0 {
+			continue
+		}
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			a := math.Max(alpha(x, y-1), alpha(x, y))
+			edge(offset(x, y-2), offset(x, y-1), offset(x, y), offset(x, y+1), a)
+		}
+	}
+}
+
+// deblockEdge spreads a small step between the samples p0 and q0 of
+// p1 p0 | q0 q1 over the four samples. Steps of limit or more, or
+// neighborhoods that are not flat on either side, are left alone.
+func deblockEdge(s [4]float64, limit float64) [4]float64 {
+	step := s[2] - s[1]
+	if math.Abs(step) >= limit || math.Abs(s[1]-s[0]) >= limit/2 || math.Abs(s[3]-s[2]) >= limit/2 {
+		return s
+	}
+	delta := step / 4
+	return [4]float64{s[0] + delta/2, s[1] + delta, s[2] - delta, s[3] - delta/2}
+}
+
+// subsampleFactors returns the horizontal and vertical number of pixels
+// covered by a chroma sample.
+func subsampleFactors(ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 1, 1
+}
+
+// rgbToYCbCr converts an RGB color in [0, 255] to JFIF Y'CbCr without
+// rounding, as used by JPEG.
+func rgbToYCbCr(c [3]float64) [3]float64 {
+	r, g, b := c[0], c[1], c[2]
+	return [3]float64{
+		0.299*r + 0.587*g + 0.114*b,
+		128 - 0.168736*r - 0.331264*g + 0.5*b,
+		128 + 0.5*r - 0.418688*g - 0.081312*b,
+	}
+}
@@ -0,0 +1,176 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"slices"
+	"testing"
+)
+
+// createColorGradient creates a smooth, saturated color gradient.
+func createColorGradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(200 - 120*x/width),
+				G: uint8(40 + 100*y/height),
+				B: uint8(90 + 60*x/width),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// toYCbCr converts img to Y'CbCr with the given subsampling the way a JPEG
+// encoder does: chroma samples are the mean over the pixels they cover.
+func toYCbCr(img *image.RGBA, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	bounds := img.Bounds()
+	result := image.NewYCbCr(bounds, ratio)
+	sums := make(map[int][3]float64)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			v := rgbToYCbCr([3]float64{float64(c.R), float64(c.G), float64(c.B)})
+			result.Y[result.YOffset(x, y)] = uint8(math.Round(v[0]))
+			i := result.COffset(x, y)
+			sum := sums[i]
+			sums[i] = [3]float64{sum[0] + v[1], sum[1] + v[2], sum[2] + 1}
+		}
+	}
+	for i, sum := range sums {
+		result.Cb[i] = uint8(math.Round(sum[0] / sum[2]))
+		result.Cr[i] = uint8(math.Round(sum[1] / sum[2]))
+	}
+	return result
+}
+
+func TestRemoveAll_YCbCrSubsampling(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	width, height := 800, 600
+	config, region := GetWatermarkInfo(width, height)
+	profile := engine.profileByConfig(config)
+	original := createColorGradient(width, height)
+	detection := Detection{Profile: profile.Name, Config: config, Region: region, Scale: 1}
+
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio444,
+	}
+	for _, ratio := range ratios {
+		watermarked := createColorGradient(width, height)
+		applyWatermark(watermarked, region, profile.AlphaMap)
+		img := toYCbCr(watermarked, ratio)
+
+		result, ok := engine.RemoveDetected(img, detection).(*image.YCbCr)
+		if !ok {
+			t.Fatalf("%v: expected an *image.YCbCr result", ratio)
+		}
+		if result.SubsampleRatio != ratio {
+			t.Errorf("%v: subsampling changed to %v", ratio, result.SubsampleRatio)
+		}
+
+		// Inverting upsampled chroma per pixel does worse wherever chroma
+		// is subsampled
+		rgba := image.NewRGBA(img.Bounds())
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				rgba.Set(x, y, img.At(x, y))
+			}
+		}
+		aware := meanRegionError(result, original, region)
+		naive := meanRegionError(engine.RemoveDetected(rgba, detection), original, region)
+		if aware > 1.5 {
+			t.Errorf("%v: mean error %.3f in Y'CbCr", ratio, aware)
+		}
+		if ratio != image.YCbCrSubsampleRatio444 && aware >= naive*0.75 {
+			t.Errorf("%v: mean error %.3f in Y'CbCr, %.3f in RGB", ratio, aware, naive)
+		}
+
+		// The input is left alone, and so is everything far from the
+		// watermark
+		if img.At(region.Min.X+24, region.Min.Y+24) != toYCbCr(watermarked, ratio).At(region.Min.X+24, region.Min.Y+24) {
+			t.Errorf("%v: input image modified", ratio)
+		}
+		for _, p := range []image.Point{{0, 0}, {region.Min.X - 10, region.Min.Y}, {width - 1, height - 1}} {
+			if result.At(p.X, p.Y) != img.At(p.X, p.Y) {
+				t.Errorf("%v: pixel %v outside the watermark changed", ratio, p)
+			}
+		}
+	}
+}
+
+func TestRemoveAll_YCbCrOtherRestorers(t *testing.T) {
+	engine, err := NewEngine()
+	if err != nil {
+		t.Fatalf("NewEngine() error: %v", err)
+	}
+
+	// Restorers other than the exact reverse blend work in RGB; their
+	// result is converted back to Y'CbCr
+	img := toYCbCr(createNoiseImage(200, 200, 3), image.YCbCrSubsampleRatio420)
+	engine.SetInpaintFallback(true)
+	detection := engine.Detect(img)
+	result, ok := engine.RemoveDetected(img, detection).(*image.YCbCr)
+	if !ok {
+		t.Fatal("expected an *image.YCbCr result with the inpainting fallback")
+	}
+	if result.SubsampleRatio != img.SubsampleRatio {
+		t.Errorf("subsampling changed to %v", result.SubsampleRatio)
+	}
+
+	// Samples away from the watermark are kept as they are
+	outside := detection.Region.Inset(-8)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			if image.Pt(x, y).In(outside) {
+				continue
+			}
+			if result.YCbCrAt(x, y) != img.YCbCrAt(x, y) {
+				t.Fatalf("pixel (%d,%d) outside the watermark changed", x, y)
+			}
+		}
+	}
+	if slices.Equal(result.Y, img.Y) {
+		t.Error("luma unchanged")
+	}
+}
+
+func TestMergeYCbCr_Unchanged(t *testing.T) {
+	img := toYCbCr(createColorGradient(64, 48), image.YCbCrSubsampleRatio420)
+	rgba := image.NewRGBA(img.Rect)
+	draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Src)
+
+	// An unmodified RGBA copy converts back to the same planes
+	merged := mergeYCbCr(img, rgba, []image.Rectangle{img.Rect})
+	if !slices.Equal(merged.Y, img.Y) || !slices.Equal(merged.Cb, img.Cb) || !slices.Equal(merged.Cr, img.Cr) {
+		t.Error("merging an unchanged copy changed the planes")
+	}
+}
+
+func TestDeblockEdge(t *testing.T) {
+	testCases := []struct {
+		name     string
+		samples  [4]float64
+		expected [4]float64
+	}{
+		{"small step", [4]float64{100, 100, 108, 108}, [4]float64{101, 102, 106, 107}},
+		{"edge", [4]float64{100, 100, 140, 140}, [4]float64{100, 100, 140, 140}},
+		{"texture", [4]float64{90, 100, 104, 104}, [4]float64{90, 100, 104, 104}},
+		{"flat", [4]float64{100, 100, 100, 100}, [4]float64{100, 100, 100, 100}},
+	}
+
+	for _, tc := range testCases {
+		if got := deblockEdge(tc.samples, 10); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}